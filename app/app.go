@@ -7,8 +7,9 @@ import (
 )
 
 func init() {
-	router := Setup(AppFactory{"e2e", nil}, []Registration{
+	router := Setup(AppFactory{Env: "e2e"}, []Registration{
 		{MessageController{}, "message"},
+		{HealthController{}, "health"},
 	})
 	http.Handle("/", router)
 }
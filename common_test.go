@@ -9,8 +9,21 @@ import (
 	"testing"
 
 	. "github.com/kkrs/godi-code"
+	"github.com/kkrs/godi-code/di"
 )
 
+// factoryFunc adapts a function to di.ApplicationFactory and di.RequestFactory
+// for tests that need control over the Controllers constructed.
+type factoryFunc func(label string) di.Controller
+
+func (f factoryFunc) With(*http.Request) di.RequestFactory {
+	return f
+}
+
+func (f factoryFunc) NewController(label string) di.Controller {
+	return f(label)
+}
+
 func sendRequest(address string, msg Message) (*http.Request, string) {
 	urlStr := APIPath
 	if len(address) > 0 {
@@ -39,6 +52,14 @@ func listRequest(address string) (*http.Request, string) {
 	return req, fmt.Sprintf("Request GET, %s", SpyPath)
 }
 
+func statsRequest(address string) (*http.Request, string) {
+	req, err := http.NewRequest("GET", address+DebugPath, nil)
+	if err != nil {
+		panic(err)
+	}
+	return req, fmt.Sprintf("Request GET, %s", DebugPath)
+}
+
 // verify resp against expected status, body
 func verify(t *testing.T, desc string, resp *http.Response, err error, status int, body interface{}) {
 	t.Log(desc, " should succeed")
@@ -65,16 +86,33 @@ func verify(t *testing.T, desc string, resp *http.Response, err error, status in
 func testSend(t *testing.T, server string) {
 	t.Logf("Scenario: Sending a message delivers it successfully")
 	t.Log()
-	msg := Message{"kkrs", "world", "hello"}
+	msg := Message{From: "kkrs", To: "world", Message: "hello"}
 	// create request to send message
 	req, desc := sendRequest(server, msg)
 	resp, err := http.DefaultClient.Do(req)
-	verify(t, desc, resp, err, http.StatusOK, nil)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+
+	// verify that the message is echoed back with an ID and time
+	t.Logf("\tbody with the message, its ID and the time it was sent")
+	var sent Message
+	if err := Unmarshal(resp.Body, &sent); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	if sent.ID == "" || sent.Sent.IsZero() {
+		t.Fatalf("got %+v", sent)
+	}
+	t.Logf("\tLocation of the message")
+	if location := resp.Header.Get("Location"); location != APIPath+"/"+sent.ID {
+		t.Fatalf("got Location '%s'", location)
+	}
+	if sent.From != msg.From || sent.To != msg.To || sent.Message != msg.Message {
+		t.Fatalf("got %+v", sent)
+	}
 
 	// create request to list all messages sent
 	req, desc = listRequest(server)
 	resp, err = http.DefaultClient.Do(req)
 
 	// verify that it contains the one sent earlier
-	verify(t, desc, resp, err, http.StatusOK, []Message{msg})
+	verify(t, desc, resp, err, http.StatusOK, []Message{sent})
 }
@@ -0,0 +1,113 @@
+package di
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// A Principal is who a request was authenticated as.
+type Principal struct {
+	Name string
+}
+
+// An Authenticator tells who a request is made by. The Dispatcher runs the
+// Authenticator of a Binding before constructing its Controller and hands
+// requests it fails to the ErrorHandler: with 403 if the error is ErrForbidden,
+// or wraps it, and with 401 otherwise.
+type Authenticator interface {
+	Authenticate(*http.Request) (Principal, error)
+}
+
+var (
+	// ErrNoCredentials is returned by Authenticators for requests that carry
+	// no credentials.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrBadCredentials is returned by Authenticators for requests whose
+	// credentials are not valid.
+	ErrBadCredentials = errors.New("bad credentials")
+	// ErrForbidden is returned by Authenticators for requests whose principal
+	// may not make them.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// A Challenger is an Authenticator that tells clients how to authenticate in
+// the WWW-Authenticate header of 401 responses.
+type Challenger interface {
+	Challenge() string
+}
+
+// anonymous authenticates every request as the zero Principal.
+type anonymous struct{}
+
+func (anonymous) Authenticate(*http.Request) (Principal, error) {
+	return Principal{}, nil
+}
+
+// Anonymous is an Authenticator that lets every request through. A Binding
+// with Auth set to it is served without authentication when the Dispatcher
+// has an Authenticator.
+var Anonymous Authenticator = anonymous{}
+
+// PrincipalContextKey is the context key of the Principal a request was
+// authenticated as. The value is a Principal.
+var PrincipalContextKey = &contextKey{"principal"}
+
+// PrincipalFromContext returns the Principal req was authenticated as. It
+// reports false if req was not authenticated.
+func PrincipalFromContext(req *http.Request) (Principal, bool) {
+	p, ok := req.Context().Value(PrincipalContextKey).(Principal)
+	return p, ok
+}
+
+// authenticate returns req carrying the Principal auth authenticates it as. It
+// responds and returns nil if authentication fails.
+func (di Dispatcher) authenticate(auth Authenticator, rw http.ResponseWriter, req *http.Request) *http.Request {
+	p, err := auth.Authenticate(req)
+	if err == nil {
+		return req.WithContext(context.WithValue(req.Context(), PrincipalContextKey, p))
+	}
+	status := http.StatusUnauthorized
+	if errors.Is(err, ErrForbidden) {
+		status = http.StatusForbidden
+	} else if c, ok := auth.(Challenger); ok {
+		rw.Header().Set("WWW-Authenticate", c.Challenge())
+	}
+	di.onError(rw, req, status, err)
+	return nil
+}
+
+// BearerTokens is an Authenticator that authenticates requests with an
+// Authorization header of the form "Bearer <token>" as the Principal of token.
+type BearerTokens map[string]Principal
+
+func (bt BearerTokens) Authenticate(req *http.Request) (Principal, error) {
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	const scheme = "Bearer "
+	if len(header) < len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return Principal{}, ErrBadCredentials
+	}
+	token := []byte(strings.TrimSpace(header[len(scheme):]))
+	// compare with every token in constant time not to leak how much of one
+	// matched
+	var found Principal
+	ok := false
+	for t, p := range bt {
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			found, ok = p, true
+		}
+	}
+	if !ok {
+		return Principal{}, ErrBadCredentials
+	}
+	return found, nil
+}
+
+func (BearerTokens) Challenge() string {
+	return "Bearer"
+}
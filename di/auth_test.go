@@ -0,0 +1,99 @@
+package di
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kkrs/godi-code/di/router"
+)
+
+// whoController responds with the Principal requests were authenticated as.
+type whoController struct{}
+
+func (whoController) Bindings() []Binding {
+	return []Binding{
+		{Verb: "GET", Path: "/api/messages", Name: "Who"},
+		{Verb: "GET", Path: "/healthz", Name: "Who", Auth: Anonymous},
+	}
+}
+
+func (whoController) Who(rw http.ResponseWriter, req *http.Request) {
+	p, ok := PrincipalFromContext(req)
+	fmt.Fprintf(rw, "%s %t", p.Name, ok)
+}
+
+// authFunc adapts a function to Authenticator.
+type authFunc func(*http.Request) (Principal, error)
+
+func (f authFunc) Authenticate(req *http.Request) (Principal, error) {
+	return f(req)
+}
+
+func TestBearerTokens(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return whoController{} }))
+	dispatcher.SetAuthenticator(BearerTokens{"s3cret": {Name: "alice"}})
+	if err := dispatcher.Register(whoController{}, "who"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	get := func(path, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, authorization := range []string{"", "Bearer guess", "Basic s3cret", "Bearer"} {
+		t.Logf("Scenario: Requests with Authorization '%s' fail with 401 and a challenge", authorization)
+		rec := get("/api/messages", authorization)
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Fatalf("got status %d and WWW-Authenticate '%s'", rec.Code, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	t.Logf("Scenario: Requests with a valid token are served as its Principal")
+	for _, authorization := range []string{"Bearer s3cret", "bearer s3cret"} {
+		if rec := get("/api/messages", authorization); rec.Code != http.StatusOK || rec.Body.String() != "alice true" {
+			t.Fatalf("got %d '%s'", rec.Code, rec.Body)
+		}
+	}
+
+	t.Logf("Scenario: Bindings with the Anonymous Authenticator are served without a token")
+	if rec := get("/healthz", ""); rec.Code != http.StatusOK || rec.Body.String() != " true" {
+		t.Fatalf("got %d '%s'", rec.Code, rec.Body)
+	}
+}
+
+func TestForbidden(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return whoController{} }))
+	dispatcher.SetAuthenticator(authFunc(func(*http.Request) (Principal, error) {
+		return Principal{}, fmt.Errorf("mallory: %w", ErrForbidden)
+	}))
+	var failed error
+	dispatcher.SetErrorHandler(func(rw http.ResponseWriter, req *http.Request, status int, err error) {
+		failed = err
+		DefaultErrorHandler(rw, req, status, err)
+	})
+	if err := dispatcher.Register(whoController{}, "who"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+
+	t.Logf("Scenario: Requests failing with ErrForbidden respond with 403 and no challenge")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/messages", nil))
+	if rec.Code != http.StatusForbidden || rec.Header().Get("WWW-Authenticate") != "" || !errors.Is(failed, ErrForbidden) {
+		t.Fatalf("got status %d, WWW-Authenticate '%s' and error '%v'", rec.Code, rec.Header().Get("WWW-Authenticate"), failed)
+	}
+
+	t.Logf("Scenario: Requests not dispatched have no Principal")
+	if _, ok := PrincipalFromContext(httptest.NewRequest("GET", "/api/messages", nil)); ok {
+		t.Fatalf("got a Principal")
+	}
+}
@@ -0,0 +1,49 @@
+package di
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/kkrs/godi-code/di/router"
+)
+
+// A RouteLister is a Router that can list its routes, as router.Mux does.
+type RouteLister interface {
+	Router
+	Routes() []router.Route
+}
+
+// DebugRoute describes a route served by DebugHandler.
+type DebugRoute struct {
+	Verb    string `json:"verb"`
+	Pattern string `json:"pattern"`
+	Label   string `json:"label,omitempty"` // of the Controller, if a Dispatcher registered the route
+}
+
+// DebugHandler returns a handler responding with the routes of r as a JSON
+// list of DebugRoutes, for operators to see what a running service serves. It
+// responds with 501 if r is not a RouteLister. It is not registered by
+// anything: mounting it, say at "/debug/routes", is up to applications, which
+// should protect it as it exposes the route table. It may be served by r
+// itself, like by router.Mux, which lists routes with a lock it does not hold
+// while serving.
+func DebugHandler(r Router) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lister, ok := r.(RouteLister)
+		if !ok {
+			DefaultErrorHandler(rw, req, http.StatusNotImplemented, errors.New("router cannot list routes"))
+			return
+		}
+		routes := []DebugRoute{}
+		for _, route := range lister.Routes() {
+			dr := DebugRoute{Verb: route.Verb, Pattern: route.Pattern}
+			if rh, ok := route.Handler.(*routedHandler); ok {
+				dr.Label = rh.as
+			}
+			routes = append(routes, dr)
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(routes)
+	})
+}
@@ -0,0 +1,71 @@
+package di
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kkrs/godi-code/di/router"
+)
+
+func TestDebugRoutes(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return nil }))
+	var want []DebugRoute
+	for label, ctrl := range map[string]Controller{"spy": spyController{}, "health": pathController{"/healthz"}} {
+		if err := dispatcher.Register(ctrl, label); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		for _, b := range ctrl.Bindings() {
+			want = append(want, DebugRoute{Verb: b.Verb, Pattern: b.Path, Label: label})
+		}
+	}
+	mux.Handle("GET", "/debug/routes", DebugHandler(mux))
+	want = append(want, DebugRoute{Verb: "GET", Pattern: "/debug/routes"})
+	sort.Slice(want, func(i, j int) bool {
+		if want[i].Pattern != want[j].Pattern {
+			return want[i].Pattern < want[j].Pattern
+		}
+		return want[i].Verb < want[j].Verb
+	})
+
+	t.Logf("Scenario: The debug handler lists the Bindings of every Controller with its label")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/routes", nil))
+	var got []DebugRoute
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got routes %+v but expected %+v", got, want)
+	}
+
+	t.Logf("Scenario: The routes are listed while Controllers are registered and deregistered")
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/routes", nil))
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		dispatcher.Register(pathController{"/extra"}, "extra")
+		dispatcher.Deregister(pathController{"/extra"})
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("listing routes deadlocked with registration")
+	}
+
+	t.Logf("Scenario: Routers that cannot list their routes are answered with 501")
+	rec = httptest.NewRecorder()
+	DebugHandler(struct{ Router }{mux}).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/routes", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("got status %d", rec.Code)
+	}
+}
@@ -0,0 +1,888 @@
+/*
+Package di helps implement Dependency Injection for web development. Dependency
+Injection aims to make dependencies accessible to its clients without them
+having to construct or ask for their dependencies explicitly. This raises the
+questions
+
+	- Where should objects be constructed ?
+	- How to make those objects available to all of the places it is needed ?
+
+di uses factories to isolate dependency construction and make them available via
+struct fields. This makes them accessible to code that uses them residing in
+methods on those structs.
+
+To that end di provides the types Dispatcher, Binding and interfaces
+ApplicationFactory, RequestFactory, Controller and Router.
+
+A Controller represents a type whose methods can serve HTTP requests and exports
+Bindings. A Binding specifies binds an HTTP request with a specific <Verb,Path>
+to a method on that Controller. A Controller can be registered with a Dispatcher
+teaching it how to route requests.
+
+ApplicationFactory and RequestFactory encapsulate all object construction
+including Controllers. Dispatcher uses the factories to get hold of a Controller
+object for the request and call the appropriate method.
+
+The Dispatcher uses a Router to handle request multiplexing.
+
+The flow of control while serving requests looks like
+
+	- Request arrives.
+	- Router routes it based on <Verb, Path> to a closure registered by the
+	  Dispatcher.
+	- The closure gets hold of RequestFactory by calling ApplicationFactory.With
+	  passing it the request object.
+	- The closure gets hold of Controller by passing the appropriate label to
+	  RequestFactory.NewController .
+	- The closure looks up and calls the Controller method registered.
+
+The example demonstrates how to wire everything up.
+*/
+package di
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/kkrs/godi-code/di/router"
+)
+
+// An ApplicationFactory is expected to have access to all singletons and know
+// how to create a RequestFactory given a request object.
+type ApplicationFactory interface {
+	// With associates a RequestFactory with the request object.
+	With(*http.Request) RequestFactory
+}
+
+// A RequestFactory is expected to know to create Controllers along with their
+// dependencies. The Dispatcher uses RequestFactory to get hold of the
+// Controller to dispatch the request to.
+type RequestFactory interface {
+	// NewController returns a controller instance given the label it was
+	// registered with. It is expected to panic if it encounters errors during
+	// construction, unless the RequestFactory is a RequestFactory2.
+	NewController(label string) Controller
+}
+
+// A RequestFactory2 is a RequestFactory that reports errors constructing
+// Controllers rather than panic. The Dispatcher prefers NewControllerErr when
+// a RequestFactory implements it, handing requests whose Controller cannot be
+// constructed to the ErrorHandler: with 503 if the error is ErrUnavailable, or
+// wraps it, and with 500 otherwise.
+type RequestFactory2 interface {
+	RequestFactory
+	NewControllerErr(label string) (Controller, error)
+}
+
+// ErrUnavailable is returned, possibly wrapped, by RequestFactory2s that
+// cannot construct a Controller for now, like when a dependency is down.
+var ErrUnavailable = errors.New("unavailable")
+
+// A Binding describes how a request is to be routed and is returned by
+// Controller.Bindings. It specifies that the request <Verb, Path> be delivered
+// to the method Name. The method Name refers to is required to be of type
+//
+//		func(Controller, http.ResponseWriter, *http.Request)
+//
+// Reflection is used to lookup Name and validate it during registration.
+//
+// Path must start with '/' and cannot contain spaces or control characters.
+// Runs of slashes in it are collapsed into one. It is relative to the BasePath
+// of Controllers that are BasePathers.
+//
+// Verb may list several verbs separated by commas, like "PUT, PATCH", to bind
+// them all to the method. Each verb must be in Methods once normalized by
+// NormalizeVerb. Verb "*" binds every verb that is not bound otherwise for
+// Path, when the Router supports it as router.Mux does.
+//
+// Wrap is optional and lists Middleware for just this Binding. Requests pass
+// through the Dispatcher's Middleware first and then through Wrap, both in the
+// order listed, before reaching the method. Auth is optional too and overrides
+// the Authenticator set with SetAuthenticator; Anonymous serves the Binding
+// without authentication.
+//
+// Match is optional too and lets several Bindings share a <Verb, Path>, so
+// that Controllers for versions of an API can be served side by side. When
+// every Binding of a route has a Match, requests are dispatched to the first
+// Binding, in the order registered, whose Match reports true for them, and
+// handed to the ErrorHandler with 406 if none does. AcceptsMediaType makes a
+// Match selecting requests by their Accept header.
+//
+// Fields should be named in Binding literals as more optional fields may be
+// added.
+type Binding struct {
+	Verb string        // The HTTP Verb to use
+	Path string        // The URL path to attach the method to
+	Name string        // Name of the method the request should be dispatched to
+	Wrap []Middleware  // Middleware applied to requests for this Binding only
+	Auth Authenticator // authenticates requests, overriding the Dispatcher's if set
+
+	// Match selects the requests dispatched to this Binding among those of
+	// its route.
+	Match func(*http.Request) bool
+
+	// Status is the status responded with if the method writes none itself,
+	// 200 when zero.
+	Status int
+}
+
+// Middleware wraps an http.Handler to act on requests before or after it.
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h with mws so that requests pass through mws in order.
+func chain(h http.Handler, mws []Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// A Controller has methods that handle requests. It exports Bindings describing
+// how those methods are to be bound.
+type Controller interface {
+	Bindings() []Binding
+}
+
+// A BasePather is a Controller whose Binding Paths are relative to BasePath.
+// The Dispatcher prepends BasePath to each of them, so Path may be empty to
+// bind BasePath itself, and the same Controller type can be mounted under
+// several bases by deriving BasePath from a field. The Paths of Controllers
+// that are not BasePathers are used as they are.
+type BasePather interface {
+	Controller
+	BasePath() string
+}
+
+// pathOf returns the path Binding b of ctrl is bound to, with runs of slashes
+// collapsed, as clients rarely send them.
+func pathOf(ctrl Controller, b Binding) string {
+	path := b.Path
+	if bp, ok := ctrl.(BasePather); ok {
+		path = strings.TrimSuffix(bp.BasePath(), "/") + b.Path
+		if path == "" {
+			path = "/"
+		}
+	}
+	for strings.Contains(path, "//") {
+		path = strings.Replace(path, "//", "/", -1)
+	}
+	return path
+}
+
+// A Router represents the ability to multiplex an http request with <Verb,
+// Path> to handler. The Dispatcher delegates request multiplexing to Router. A
+// simple implementation around http.ServeMux is provided in sub-package router.
+type Router interface {
+	Handle(verb string, path string, handler http.Handler)
+	HandleFunc(verb string, path string, handler func(http.ResponseWriter, *http.Request))
+
+	// Must be a handler itself
+	http.Handler
+}
+
+// A Remover is a Router that can remove handlers. Remove undoes Handle for
+// <verb, path>. Deregister requires it. router.Mux implements it.
+type Remover interface {
+	Router
+	Remove(verb string, path string)
+}
+
+// A BatchRouter is a Router that can register several handlers at once.
+// HandleBatch registers every handler register passes to handle as Handle
+// does, making none of them visible to requests until all are registered.
+// Register uses it, when the Router implements it, so that Controllers can be
+// registered while serving without requests seeing half of their Bindings.
+// router.Mux implements it.
+type BatchRouter interface {
+	Router
+	HandleBatch(register func(handle func(verb, path string, handler http.Handler)))
+}
+
+// An ErrorHandler responds to a request the Dispatcher could not dispatch
+// because of err. status is the HTTP status code to respond with.
+type ErrorHandler func(rw http.ResponseWriter, req *http.Request, status int, err error)
+
+// DefaultErrorHandler responds with status and its text, leaving err out of
+// the response.
+func DefaultErrorHandler(rw http.ResponseWriter, req *http.Request, status int, err error) {
+	http.Error(rw, http.StatusText(status), status)
+}
+
+// Dispatcher orchestrates request handling with the help of the other types in
+// this package. It uses Router to multiplex requests, ApplicationFactory and
+// RequestFactory to get hold of fully constructed Controllers. It then
+// dispatches the request to the appropriate Controller method.
+type Dispatcher struct {
+	name     string
+	router   Router
+	factory  ApplicationFactory
+	onError  ErrorHandler
+	use      []Middleware
+	observer Observer
+	auth     Authenticator
+	onPanic  PanicHandler
+	routes   *routes // shared by copies of the Dispatcher
+}
+
+// routes keeps track of the <Verb, Path> bound by a Dispatcher so that
+// registrations don't silently replace each other.
+type routes struct {
+	mu     sync.Mutex // held for the duration of Register and Deregister
+	owners map[string]owner
+	// matched holds the candidates of routes bound by Bindings with Match,
+	// in the order registered.
+	matched map[string][]candidate
+}
+
+// owner is the Controller a route is bound for, the first registered if
+// Bindings with Match share the route.
+type owner struct {
+	as       string
+	ctrlType reflect.Type
+}
+
+func routeKey(verb, path string) string {
+	return verb + " " + path
+}
+
+// New creates a new Dispatcher. It panics if any of its arguments have zero
+// values. NewDispatcher is more convenient when options are to be set.
+func New(name string, router Router, factory ApplicationFactory) Dispatcher {
+	if router == nil {
+		panic(errors.New("argument 'router' cannot be nil"))
+	}
+	di, err := NewDispatcher(name, WithRouter(router), WithFactory(factory))
+	if err != nil {
+		panic(err)
+	}
+	return di
+}
+
+// SetErrorHandler sets the handler used to respond to requests that cannot be
+// dispatched. It applies to Controllers registered after it is called. The
+// handler defaults to DefaultErrorHandler.
+func (di *Dispatcher) SetErrorHandler(h ErrorHandler) {
+	if h == nil {
+		h = DefaultErrorHandler
+	}
+	di.onError = h
+}
+
+// Use appends mws to the Middleware applied to requests for every Binding.
+// Like SetErrorHandler it applies to Controllers registered after it is called.
+func (di *Dispatcher) Use(mws ...Middleware) {
+	di.use = append(di.use, mws...)
+}
+
+// An Observer is told about every request dispatched to a Controller, for
+// instance to collect metrics. verb and path are those of the Binding matched
+// and dur is how long the Controller took, including its construction.
+type Observer interface {
+	ObserveRequest(label, verb, path string, status int, dur time.Duration)
+}
+
+// SetObserver sets the Observer of requests, which is nil by default. Like
+// SetErrorHandler it applies to Controllers registered after it is called.
+func (di *Dispatcher) SetObserver(o Observer) {
+	di.observer = o
+}
+
+// Name returns the name the Dispatcher was created with.
+func (di Dispatcher) Name() string {
+	return di.name
+}
+
+// Router returns the Router Controllers are registered with, so that other
+// handlers, like those of static files, can be served alongside them.
+func (di Dispatcher) Router() Router {
+	return di.router
+}
+
+// SetAuthenticator sets the Authenticator of Bindings that have none, which is
+// nil, authenticating nothing, by default. Like SetErrorHandler it applies to
+// Controllers registered after it is called.
+func (di *Dispatcher) SetAuthenticator(a Authenticator) {
+	di.auth = a
+}
+
+// A PanicHandler responds to a request whose handling panicked with v, the
+// value recovered.
+type PanicHandler func(rw http.ResponseWriter, req *http.Request, v interface{})
+
+// SetPanicHandler sets the handler of requests whose Controller method, or
+// Middleware, panics. Without one, which is the default, panics are left to
+// the caller of the Router, as http.Server, which drops the connection.
+// http.ErrAbortHandler is never handled. Like SetErrorHandler it applies to
+// Controllers registered after it is called.
+func (di *Dispatcher) SetPanicHandler(h PanicHandler) {
+	di.onPanic = h
+}
+
+// recovering returns h with the panics it raises handled by onPanic.
+func recovering(h http.Handler, onPanic PanicHandler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				onPanic(rw, req, v)
+			}
+		}()
+		h.ServeHTTP(rw, req)
+	})
+}
+
+func (di Dispatcher) String() string {
+	return fmt.Sprintf("di.Dispatcher<%s>", di.name)
+}
+
+// validate methods that will handle requests
+func validate(meth reflect.Method) error {
+	// PkgPath will be empty for exported names, since a method name will
+	// not be unique in a method set if it is spelled the same and is
+	// exported. See http://golang.org/ref/spec#Uniqueness_of_identifiers
+	//
+	// Since 1.7, the Method and NumMethod methods of Type and Value no longer
+	// return or count unexported methods. That makes this test redundant.
+	if meth.PkgPath != "" {
+		return errors.New("not an exported type")
+	}
+
+	// acceptable methods should have 3 ins:
+	// receiver, http.ResponseWriter, *http.Request
+	expectedNumIn := 3
+	if numIn := meth.Type.NumIn(); numIn != expectedNumIn {
+		return fmt.Errorf("wrong number of arguments: %d, expect %d", numIn, expectedNumIn)
+	}
+
+	// There is no need to validate that the receiver implements type
+	// Controller as that is how we got here.
+
+	// Using the return of reflect.TypeOf(http.ResponseWriter(nil)) causes
+	// Type.Implements to panic with
+	// panic: reflect: nil type passed to Type.Implements
+	// but dereferncing pointer to the interface doesn't
+	// The method is passed the http.ResponseWriter of the request, whatever
+	// its dynamic type, so the argument must accept any.
+	expectedRespType := reflect.TypeOf((*http.ResponseWriter)(nil)).Elem()
+	if respType := meth.Type.In(1); !expectedRespType.AssignableTo(respType) {
+		return fmt.Errorf("1st argument of type %s cannot hold a %s", respType, expectedRespType)
+	}
+
+	expectedReqType := reflect.TypeOf((*http.Request)(nil))
+	if reqType := meth.Type.In(2); reqType != expectedReqType {
+		return fmt.Errorf("2nd argument of type %s, but expect %s", reqType, expectedReqType)
+	}
+	return nil
+}
+
+// missingMethod describes ctrlType not having the method name, telling apart a
+// method declared with a pointer receiver for a Controller registered as a
+// value, which cannot call it.
+func (di Dispatcher) missingMethod(ctrlType reflect.Type, name string) error {
+	typeName := nameOf(ctrlType)
+	if ctrlType.Kind() != reflect.Ptr {
+		if _, ok := reflect.PtrTo(ctrlType).MethodByName(name); ok {
+			return fmt.Errorf(
+				"%s: method '%s' has receiver *%s but type '%s' was registered as a value: "+
+					"register a *%s, and return one from NewController, or declare %s on %s",
+				di, name, typeName, typeName, typeName, name, typeName,
+			)
+		}
+	}
+	return fmt.Errorf("%s: could not find method '%s' in type '%s'", di, name, typeName)
+}
+
+// nameOf names the Controller type t in error messages: by the name of the type
+// t, or t points to, if it has one and as written otherwise, like
+// "struct { Base }" for an anonymous struct embedding Base.
+func nameOf(t reflect.Type) string {
+	elem := t
+	for elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	if name := elem.Name(); name != "" {
+		return name
+	}
+	return elem.String()
+}
+
+// validatePath checks that path is acceptable to Router as a pattern,
+// including that its variable segments, like "{id}", are well formed, so that
+// Register fails rather than Router panicking.
+func validatePath(path string) error {
+	if path == "" {
+		return errors.New("path cannot be empty")
+	}
+	if path[0] != '/' {
+		return fmt.Errorf("path %q must start with '/'", path)
+	}
+	for _, c := range path {
+		if c == ' ' || unicode.IsControl(c) {
+			return fmt.Errorf("path %q cannot contain spaces or control characters", path)
+		}
+	}
+	return router.ValidatePattern(path)
+}
+
+// adapt returns an http.Handler that gets run in the course of handling a
+// request. The handler receives control from the router.ServeHTTP, creates a
+// RequestFactory for the request, uses it to get hold the Controller instance
+// by name and dispatches it the appropriate method. If auth is set, the
+// request is authenticated first. If status is set, it is written unless the
+// method writes another. If NewController returns nil or a Controller
+// of a type other than the one registered, the error is logged and the request
+// handed to the ErrorHandler with a 500, as it is, with a 500 or 503, if
+// NewControllerErr fails. The request is reported to the
+// Observer, if one is set, once it has been served.
+func (di Dispatcher) adapt(ctrlType reflect.Type, as string, meth reflect.Method, auth Authenticator, status int) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if di.observer != nil {
+			sw := WrapResponseWriter(rw)
+			defer di.observe(req, as, sw, time.Now())
+			rw = sw
+		}
+		if auth != nil {
+			if req = di.authenticate(auth, rw, req); req == nil {
+				return
+			}
+		}
+		rcvr, err := di.newController(req, as)
+		if err != nil {
+			log.Print(err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrUnavailable) {
+				status = http.StatusServiceUnavailable
+			}
+			di.onError(rw, req, status, err)
+			return
+		}
+		// the Controller type and method were validated by Register, so a
+		// comparison of types is all that is left to do per request
+		if reflect.TypeOf(rcvr) != ctrlType {
+			err := di.wrongController(req, as, ctrlType, rcvr)
+			log.Print(err)
+			di.onError(rw, req, http.StatusInternalServerError, err)
+			return
+		}
+		var dw *defaultStatusWriter
+		if status != 0 {
+			dw = &defaultStatusWriter{ResponseWriter: rw, status: status}
+			rw = dw
+		}
+		// rw is passed as an http.ResponseWriter rather than as its dynamic
+		// type, which Call would check implements the interface on every
+		// request. The variable holding it comes from a pool as taking the
+		// address of rw would allocate.
+		w := responseWriters.Get().(*http.ResponseWriter)
+		*w = rw
+		meth.Func.Call([]reflect.Value{reflect.ValueOf(rcvr), reflect.ValueOf(w).Elem(), reflect.ValueOf(req)})
+		*w = nil
+		responseWriters.Put(w) // not if the method panics
+		if dw != nil {
+			dw.finish() // not if the method panics
+		}
+	}
+}
+
+// responseWriters pools the variables adapt passes http.ResponseWriters to
+// methods in.
+var responseWriters = sync.Pool{New: func() interface{} { return new(http.ResponseWriter) }}
+
+// defaultStatusWriter is an http.ResponseWriter that writes status unless
+// another status is written first.
+type defaultStatusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *defaultStatusWriter) WriteHeader(code int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *defaultStatusWriter) Write(p []byte) (int, error) {
+	w.finish()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *defaultStatusWriter) Flush() {
+	w.finish()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes status if no status has been written.
+func (w *defaultStatusWriter) finish() {
+	if !w.wrote {
+		w.WriteHeader(w.status)
+	}
+}
+
+// newController constructs the Controller registered as as for req, with
+// NewControllerErr if the RequestFactory is a RequestFactory2.
+func (di Dispatcher) newController(req *http.Request, as string) (Controller, error) {
+	rf := di.factory.With(req)
+	rf2, ok := rf.(RequestFactory2)
+	if !ok {
+		return rf.NewController(as), nil
+	}
+	rcvr, err := rf2.NewControllerErr(as)
+	if err != nil {
+		return nil, fmt.Errorf("%s: for %s, %s NewControllerErr(%s) failed: %w", di, req.Method, req.URL.Path, as, err)
+	}
+	return rcvr, nil
+}
+
+// wrongController describes NewController returning rcvr rather than a
+// Controller of type ctrlType.
+func (di Dispatcher) wrongController(req *http.Request, as string, ctrlType reflect.Type, rcvr Controller) error {
+	got, hint := "nil", ""
+	if rcvr != nil {
+		t := reflect.TypeOf(rcvr)
+		got = t.String()
+		if t == reflect.PtrTo(ctrlType) || ctrlType.Kind() == reflect.Ptr && t == ctrlType.Elem() {
+			hint = ", return a pointer if one was registered and a value otherwise"
+		}
+	}
+	return fmt.Errorf(
+		"%s: for %s, %s NewController(%s) returned %s but expected %s%s",
+		di, req.Method, req.URL.Path, as, got, ctrlType, hint,
+	)
+}
+
+// observe reports a request to the Observer. It is deferred and so observes
+// requests whose handler panics too, as having failed with 500, before
+// resuming the panic.
+func (di Dispatcher) observe(req *http.Request, as string, sw *RecordingWriter, start time.Time) {
+	status := sw.Status()
+	p := recover()
+	if p != nil {
+		status = http.StatusInternalServerError
+	}
+	verb, path, _ := RouteFromContext(req)
+	di.observer.ObserveRequest(as, verb, path, status, time.Since(start))
+	if p != nil {
+		panic(p)
+	}
+}
+
+// bound is a Binding that has been validated and is ready to be handed to the
+// Router.
+type bound struct {
+	verbs   []string
+	path    string
+	handler http.Handler
+	match   func(*http.Request) bool
+}
+
+// bind validates method and prepares the handler for it. pending holds the
+// routes of the Bindings of ctrl prepared before method so that a Controller
+// cannot bind a route twice, and whether they have Match.
+func (di Dispatcher) bind(ctrl Controller, as string, method Binding, pending map[string]bool) (bound, error) {
+	ctrlType := reflect.TypeOf(ctrl)
+	typeName := nameOf(ctrlType)
+	path := pathOf(ctrl, method)
+	if err := validatePath(path); err != nil {
+		return bound{}, fmt.Errorf("%s: error validating path of %s.%s: %s", di, typeName, method.Name, err)
+	}
+	ctrlMeth, ok := ctrlType.MethodByName(method.Name)
+	if !ok {
+		return bound{}, di.missingMethod(ctrlType, method.Name)
+	}
+
+	if err := validate(ctrlMeth); err != nil {
+		return bound{}, fmt.Errorf("%s: error validating %s.%s: %s", di, typeName, method.Name, err)
+	}
+
+	if method.Status != 0 && (method.Status < 100 || method.Status > 599) {
+		return bound{}, fmt.Errorf("%s: error validating status of %s.%s: %d is not a status code", di, typeName, method.Name, method.Status)
+	}
+
+	verbs, err := splitVerbs(method.Verb)
+	if err != nil {
+		return bound{}, fmt.Errorf("%s: error validating verb of %s.%s: %s", di, typeName, method.Name, err)
+	}
+	for _, verb := range verbs {
+		key := routeKey(verb, path)
+		o, ok := di.routes.owners[key]
+		label := o.as
+		matched := len(di.routes.matched[key]) > 0
+		if m, isPending := pending[key]; isPending {
+			label, ok, matched = as, true, m
+		}
+		if ok && (method.Match == nil || !matched) {
+			hint := ""
+			if method.Match != nil || matched {
+				hint = ", which only Bindings that all have Match can share"
+			}
+			return bound{}, fmt.Errorf("%s: cannot bind %s.%s to %s %s, already bound for '%s'%s",
+				di, typeName, method.Name, verb, path, label, hint)
+		}
+		pending[key] = method.Match != nil
+	}
+
+	auth := method.Auth
+	if auth == nil {
+		auth = di.auth
+	}
+	adapter := di.adapt(ctrlType, as, ctrlMeth, auth, method.Status)
+	handler := chain(chain(adapter, method.Wrap), di.use)
+	if di.onPanic != nil {
+		handler = recovering(handler, di.onPanic)
+	}
+	return bound{verbs, path, handler, method.Match}, nil
+}
+
+// contextKey is the type of the keys of values the Dispatcher stores in the
+// request context.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string {
+	return "di context value " + k.name
+}
+
+var (
+	// LabelContextKey is the context key of the label of the Controller a
+	// request is dispatched to. The value is a string.
+	LabelContextKey = &contextKey{"label"}
+
+	// VerbContextKey and PathContextKey are the context keys of the Verb and
+	// Path of the Binding that matched a request. A Binding with several verbs
+	// stores the one that matched. The values are strings.
+	VerbContextKey = &contextKey{"verb"}
+	PathContextKey = &contextKey{"path"}
+)
+
+// routed stores as, verb and path in the context of requests before passing
+// them to h, so that Middleware and Controller methods can read them.
+func routed(as, verb, path string, h http.Handler) http.Handler {
+	return &routedHandler{as: as, asValue: as, verbValue: verb, pathValue: path, h: h}
+}
+
+// routedHandler is the handler routed returns. It tells DebugHandler the label
+// of its route.
+type routedHandler struct {
+	as                            string
+	asValue, verbValue, pathValue interface{} // boxed once rather than for every request
+	h                             http.Handler
+}
+
+func (rh *routedHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	entries, _ := req.Context().Value(entryKey{}).([]*Entry)
+	for _, e := range entries {
+		e.Label = rh.as
+	}
+	ctx := &routeContext{req.Context(), rh.asValue, rh.verbValue, rh.pathValue}
+	rh.h.ServeHTTP(rw, req.WithContext(ctx))
+}
+
+// routeContext is a context.Context holding the values of LabelContextKey,
+// VerbContextKey and PathContextKey, in a single allocation rather than one
+// per key.
+type routeContext struct {
+	context.Context
+	as, verb, path interface{}
+}
+
+func (ctx *routeContext) Value(key interface{}) interface{} {
+	switch key {
+	case LabelContextKey:
+		return ctx.as
+	case VerbContextKey:
+		return ctx.verb
+	case PathContextKey:
+		return ctx.path
+	}
+	return ctx.Context.Value(key)
+}
+
+// LabelFromContext returns the label of the Controller req is dispatched to. It
+// reports false if req was not dispatched by a Dispatcher.
+func LabelFromContext(req *http.Request) (string, bool) {
+	as, ok := req.Context().Value(LabelContextKey).(string)
+	return as, ok
+}
+
+// RouteFromContext returns the Verb and Path of the Binding req matched. It
+// reports false if req was not dispatched by a Dispatcher.
+func RouteFromContext(req *http.Request) (verb, path string, ok bool) {
+	verb, ok = req.Context().Value(VerbContextKey).(string)
+	path, _ = req.Context().Value(PathContextKey).(string)
+	return verb, path, ok
+}
+
+// Methods is the set of verbs a Binding may use besides "*". Custom methods
+// may be added before Controllers using them are registered.
+var Methods = map[string]bool{
+	"GET":     true,
+	"POST":    true,
+	"PUT":     true,
+	"PATCH":   true,
+	"DELETE":  true,
+	"HEAD":    true,
+	"OPTIONS": true,
+}
+
+// NormalizeVerb is applied to each verb of a Binding before it is checked
+// against Methods and handed to the Router. It defaults to upper casing.
+var NormalizeVerb = strings.ToUpper
+
+// splitVerbs splits the comma separated verbs of a Binding and normalizes
+// them. Verbs that are not in Methods are rejected.
+func splitVerbs(verbs string) ([]string, error) {
+	split := strings.Split(verbs, ",")
+	for i, verb := range split {
+		verb = strings.TrimSpace(verb)
+		if verb == "" {
+			return nil, fmt.Errorf("empty verb in %q", verbs)
+		}
+		verb = NormalizeVerb(verb)
+		if verb != "*" && !Methods[verb] {
+			return nil, fmt.Errorf("unknown verb %q", verb)
+		}
+		split[i] = verb
+	}
+	return split, nil
+}
+
+// Register registers Bindings returned by Controller. It looks up and validates
+// that each method of the Binding is of the appropriate type and arranges for
+// requests to be delivered to the appropriate methods. Refer to the
+// documentation for Binding.
+//
+// Register may be called concurrently. A Binding for a <Verb, Path> that is
+// already bound by the Dispatcher is an error, whichever Controller bound it.
+//
+// The same Controller type may be registered under several labels, so that
+// RequestFactory.NewController constructs it with different dependencies for
+// each, as long as the Bindings of each registration use distinct routes. This
+// is usually done by deriving Paths from fields of the Controller. Requests
+// for a route are always dispatched with the label it was registered under.
+//
+// Every Binding is validated before any is registered. If some fail, none are
+// registered and the error returned joins those of every failing Binding, one
+// per line. If the Router is a BatchRouter, the Bindings are served all at
+// once, so a Controller may be registered while the Router is serving.
+func (di Dispatcher) Register(ctrl Controller, as string) error {
+	if as == "" {
+		return fmt.Errorf("%s: argument 'as' cannot be empty", di)
+	}
+	bindings := ctrl.Bindings()
+	if len(bindings) == 0 {
+		return fmt.Errorf("%s: type '%s' returns 0 bindings", di, as)
+	}
+	di.routes.mu.Lock()
+	defer di.routes.mu.Unlock()
+	var errs []error
+	bounds := make([]bound, 0, len(bindings))
+	pending := make(map[string]bool)
+	for _, m := range bindings {
+		b, err := di.bind(ctrl, as, m, pending)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		bounds = append(bounds, b)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	register := func(handle func(verb, path string, handler http.Handler)) {
+		for _, b := range bounds {
+			for _, verb := range b.verbs {
+				key := routeKey(verb, b.path)
+				h := routed(as, verb, b.path, b.handler)
+				if b.match != nil {
+					cands := di.routes.matched[key]
+					cands = append(cands[:len(cands):len(cands)], candidate{as, reflect.TypeOf(ctrl), b.match, h})
+					di.routes.matched[key] = cands
+					h = di.negotiate(cands)
+				}
+				handle(verb, b.path, h)
+				if _, ok := di.routes.owners[key]; !ok {
+					di.routes.owners[key] = owner{as, reflect.TypeOf(ctrl)}
+				}
+			}
+		}
+	}
+	if br, ok := di.router.(BatchRouter); ok {
+		br.HandleBatch(register)
+	} else {
+		register(di.router.Handle)
+	}
+	return nil
+}
+
+// Deregister removes the Bindings returned by Controller from the Router so that
+// requests are no longer delivered to it. Routes shared by Bindings with Match
+// keep serving those of other Controller types, and routes that are not bound
+// are skipped. It is safe to call while the Router is serving if the Router is
+// safe for concurrent use, as router.Mux is.
+//
+// Deregister fails, removing nothing, if the Router is not a Remover or if a
+// route of Controller is bound for a Controller of another type.
+func (di Dispatcher) Deregister(ctrl Controller) error {
+	remover, ok := di.router.(Remover)
+	if !ok {
+		return fmt.Errorf("%s: router %T cannot remove routes", di, di.router)
+	}
+	ctrlType := reflect.TypeOf(ctrl)
+	di.routes.mu.Lock()
+	defer di.routes.mu.Unlock()
+	type route struct{ verb, path string }
+	var owned []route
+	var errs []error
+	for _, m := range ctrl.Bindings() {
+		verbs, _ := splitVerbs(m.Verb) // Register rejected bindings that fail
+		path := pathOf(ctrl, m)
+		for _, verb := range verbs {
+			key := routeKey(verb, path)
+			o, ok := di.routes.owners[key]
+			if !ok {
+				continue
+			}
+			mine := o.ctrlType == ctrlType
+			if cands := di.routes.matched[key]; len(cands) > 0 {
+				mine = len(without(cands, ctrlType)) < len(cands)
+			}
+			if !mine {
+				errs = append(errs, fmt.Errorf("%s: cannot deregister %s.%s from %s %s, bound for '%s'",
+					di, nameOf(ctrlType), m.Name, verb, path, o.as))
+				continue
+			}
+			owned = append(owned, route{verb, path})
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	for _, r := range owned {
+		key := routeKey(r.verb, r.path)
+		if cands := di.routes.matched[key]; len(cands) > 0 {
+			if cands = without(cands, ctrlType); len(cands) > 0 {
+				di.routes.matched[key] = cands
+				di.routes.owners[key] = owner{cands[0].as, cands[0].ctrlType}
+				remover.Handle(r.verb, r.path, di.negotiate(cands))
+				continue
+			}
+			delete(di.routes.matched, key)
+		}
+		remover.Remove(r.verb, r.path)
+		delete(di.routes.owners, key)
+	}
+	return nil
+}
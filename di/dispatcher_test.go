@@ -0,0 +1,987 @@
+package di
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kkrs/godi-code/di/router"
+)
+
+// factoryFunc adapts a function to ApplicationFactory and RequestFactory for
+// tests that need control over the Controllers constructed.
+type factoryFunc func(label string) Controller
+
+func (f factoryFunc) With(*http.Request) RequestFactory {
+	return f
+}
+
+func (f factoryFunc) NewController(label string) Controller {
+	return f(label)
+}
+
+// pathController binds List to path.
+type pathController struct {
+	path string
+}
+
+func (ct pathController) Bindings() []Binding {
+	return []Binding{{Verb: "GET", Path: ct.path, Name: "List"}}
+}
+
+func (pathController) List(http.ResponseWriter, *http.Request) {}
+
+// otherController is a Controller of a type no test registers.
+type otherController struct{}
+
+func (otherController) Bindings() []Binding {
+	return nil
+}
+
+func TestWrongController(t *testing.T) {
+	for _, c := range []struct {
+		desc string
+		ctrl Controller
+		want string
+	}{
+		{"of the wrong type", otherController{}, "returned di.otherController but expected di.pathController"},
+		{"that is nil", nil, "returned nil but expected di.pathController"},
+	} {
+		t.Logf("Scenario: A factory returning a controller %s fails the request", c.desc)
+		ctrl := c.ctrl
+		mux := router.New()
+		dispatcher := New("test", mux, factoryFunc(func(string) Controller { return ctrl }))
+		var failed error
+		dispatcher.SetErrorHandler(func(rw http.ResponseWriter, req *http.Request, status int, err error) {
+			failed = err
+			DefaultErrorHandler(rw, req, status, err)
+		})
+		if err := dispatcher.Register(pathController{"/spy/messages"}, "message"); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/spy/messages", nil))
+		if rec.Code != http.StatusInternalServerError || failed == nil || !strings.Contains(failed.Error(), c.want) {
+			t.Fatalf("got %d and error '%v'", rec.Code, failed)
+		}
+		t.Logf("\tand DefaultErrorHandler leaves the error out of the response")
+		if rec.Body.String() != "Internal Server Error\n" {
+			t.Fatalf("got '%s'", rec.Body.String())
+		}
+	}
+}
+
+func TestBindingPath(t *testing.T) {
+	for _, c := range []struct{ path, want string }{
+		{"api/messages", `path "api/messages" must start with '/'`},
+		{"", "path cannot be empty"},
+		{"/api/new messages", `path "/api/new messages" cannot contain spaces or control characters`},
+		{"/api/messages\n", `path "/api/messages\n" cannot contain spaces or control characters`},
+	} {
+		t.Logf("Scenario: Registering a binding with path %q fails", c.path)
+		dispatcher := New("test", router.New(), factoryFunc(nil))
+		err := dispatcher.Register(pathController{c.path}, "bad")
+		want := "di.Dispatcher<test>: error validating path of pathController.List: " + c.want
+		if err == nil || err.Error() != want {
+			t.Fatalf("got error '%v' but expected '%s'", err, want)
+		}
+	}
+
+	t.Logf("Scenario: Runs of slashes in binding paths are collapsed")
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return pathController{} }))
+	if err := dispatcher.Register(pathController{"//api//messages"}, "slashes"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/messages", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	dispatcher.Deregister(pathController{"//api//messages"})
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/messages", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d after Deregister", rec.Code)
+	}
+}
+
+// verbController echoes the method it was dispatched to in the X-Method
+// header.
+type verbController struct{}
+
+func (verbController) Bindings() []Binding {
+	return []Binding{
+		{Verb: "GET", Path: "/api/messages", Name: "Get"},
+		{Verb: "POST", Path: "/api/messages", Name: "Post"},
+		{Verb: "*", Path: "/api/messages", Name: "Any"},
+	}
+}
+
+func (verbController) Get(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("X-Method", "Get")
+}
+
+func (verbController) Post(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("X-Method", "Post")
+}
+
+func (verbController) Any(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("X-Method", "Any")
+}
+
+func TestWildcardVerb(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return verbController{} }))
+	if err := dispatcher.Register(verbController{}, "verb"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+
+	for verb, method := range map[string]string{"GET": "Get", "POST": "Post", "DELETE": "Any", "PUT": "Any"} {
+		t.Logf("Scenario: %s is dispatched to %s", verb, method)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(verb, "/api/messages", nil))
+		if got := rec.Header().Get("X-Method"); rec.Code != http.StatusOK || got != method {
+			t.Fatalf("got %d and method '%s'", rec.Code, got)
+		}
+	}
+}
+
+// spyController binds POST to /api/messages and GET to /spy/messages.
+type spyController struct{}
+
+func (spyController) Bindings() []Binding {
+	return []Binding{
+		{Verb: "POST", Path: "/api/messages", Name: "Send"},
+		{Verb: "GET", Path: "/spy/messages", Name: "List"},
+	}
+}
+
+func (spyController) Send(http.ResponseWriter, *http.Request) {}
+func (spyController) List(http.ResponseWriter, *http.Request) {}
+
+func TestDeregister(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(label string) Controller {
+		if label == "spy" {
+			return spyController{}
+		}
+		return pathController{"/api/messages"}
+	}))
+	if err := dispatcher.Register(pathController{"/api/messages"}, "path"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	if err := dispatcher.Register(spyController{}, "spy"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+
+	do := func(verb, path string, status int) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(verb, path, nil))
+		t.Logf("\t%s %s responds with %d", verb, path, status)
+		if rec.Code != status {
+			t.Fatalf("got status %d", rec.Code)
+		}
+	}
+	t.Logf("Scenario: Requests are dispatched before deregistering")
+	do("POST", "/api/messages", http.StatusOK)
+	do("GET", "/spy/messages", http.StatusOK)
+
+	t.Logf("Scenario: Routes bound for a Controller of another type are not deregistered")
+	if err := dispatcher.Deregister(pathController{"/spy/messages"}); err == nil || !strings.Contains(err.Error(), "bound for 'spy'") {
+		t.Fatalf("got error '%v'", err)
+	}
+	do("GET", "/spy/messages", http.StatusOK)
+
+	t.Logf("Scenario: Deregistered routes are not allowed or not found")
+	if err := dispatcher.Deregister(spyController{}); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	do("GET", "/api/messages", http.StatusOK)
+	do("POST", "/api/messages", http.StatusMethodNotAllowed)
+	do("GET", "/spy/messages", http.StatusNotFound)
+
+	t.Logf("Scenario: Deregistering what is not registered does nothing")
+	if err := dispatcher.Deregister(spyController{}); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+
+	t.Logf("Scenario: Routers that cannot remove routes cannot deregister")
+	fixed := New("test", struct{ Router }{router.New()}, factoryFunc(func(string) Controller { return spyController{} }))
+	if err := fixed.Register(spyController{}, "spy"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	if err := fixed.Deregister(spyController{}); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestConcurrentRegister(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(label string) Controller {
+		return pathController{"/" + label}
+	}))
+
+	t.Logf("Scenario: Controllers registered concurrently are all served")
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 2; j++ { // every path is registered twice
+			wg.Add(1)
+			go func(label string) {
+				defer wg.Done()
+				errs <- dispatcher.Register(pathController{"/" + label}, label)
+			}(fmt.Sprint(i))
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	var failed int
+	for err := range errs {
+		if err != nil {
+			failed++
+			if !strings.Contains(err.Error(), "already bound") {
+				t.Fatalf("got error '%s'", err)
+			}
+		}
+	}
+	t.Logf("\tand registering a path twice fails once")
+	if failed != 10 {
+		t.Fatalf("got %d errors but expected 10", failed)
+	}
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprint("/", i), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /%d: got status %d", i, rec.Code)
+		}
+	}
+}
+
+// tag returns Middleware appending name to the X-Trace header of the response.
+func tag(name string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Add("X-Trace", name)
+			h.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// wrapController binds List with Middleware and Send without.
+type wrapController struct{}
+
+func (wrapController) Bindings() []Binding {
+	return []Binding{
+		{Verb: "GET", Path: "/spy/messages", Name: "List", Wrap: []Middleware{tag("binding1"), tag("binding2")}},
+		{Verb: "POST", Path: "/api/messages", Name: "Send"},
+	}
+}
+
+func (wrapController) List(http.ResponseWriter, *http.Request) {}
+func (wrapController) Send(http.ResponseWriter, *http.Request) {}
+
+func TestBindingMiddleware(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return wrapController{} }))
+	dispatcher.Use(tag("global"))
+	if err := dispatcher.Register(wrapController{}, "wrap"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+
+	for _, c := range []struct {
+		verb, path string
+		trace      []string
+	}{
+		{"GET", "/spy/messages", []string{"global", "binding1", "binding2"}},
+		{"POST", "/api/messages", []string{"global"}},
+	} {
+		t.Logf("Scenario: %s %s passes through %v", c.verb, c.path, c.trace)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(c.verb, c.path, nil))
+		if got := rec.Header()["X-Trace"]; strings.Join(got, ",") != strings.Join(c.trace, ",") {
+			t.Fatalf("got %v", got)
+		}
+	}
+}
+
+// verbsController binds Update to the verbs it is given.
+type verbsController struct {
+	verbs string
+}
+
+func (ct verbsController) Bindings() []Binding {
+	return []Binding{{Verb: ct.verbs, Path: "/api/messages", Name: "Update"}}
+}
+
+func (verbsController) Update(http.ResponseWriter, *http.Request) {}
+
+func TestMultipleVerbs(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return verbsController{"put, PATCH"} }))
+
+	t.Logf("Scenario: A binding with an empty verb fails to register")
+	want := `di.Dispatcher<test>: error validating verb of verbsController.Update: empty verb in "PUT,,PATCH"`
+	if err := dispatcher.Register(verbsController{"PUT,,PATCH"}, "bad"); err == nil || err.Error() != want {
+		t.Fatalf("got error '%v' but expected '%s'", err, want)
+	}
+
+	t.Logf("Scenario: Every verb of a binding is dispatched to its method")
+	if err := dispatcher.Register(verbsController{"put, PATCH"}, "verbs"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	for verb, status := range map[string]int{"PUT": http.StatusOK, "PATCH": http.StatusOK, "POST": http.StatusMethodNotAllowed} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(verb, "/api/messages", nil))
+		t.Logf("\t%s responds with %d", verb, status)
+		if rec.Code != status {
+			t.Fatalf("got status %d", rec.Code)
+		}
+	}
+}
+
+// routeController echoes the route it was dispatched through.
+type routeController struct{}
+
+func (routeController) Bindings() []Binding {
+	return []Binding{{Verb: "GET, POST", Path: "/api/messages", Name: "Echo"}}
+}
+
+func (routeController) Echo(rw http.ResponseWriter, req *http.Request) {
+	as, _ := LabelFromContext(req)
+	verb, path, _ := RouteFromContext(req)
+	fmt.Fprintf(rw, "%s %s %s", as, verb, path)
+}
+
+func TestRouteFromContext(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return routeController{} }))
+	var fromMiddleware string
+	dispatcher.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			fromMiddleware, _ = LabelFromContext(req)
+			next.ServeHTTP(rw, req)
+		})
+	})
+	if err := dispatcher.Register(routeController{}, "route"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+
+	t.Logf("Scenario: Handlers and Middleware read the route a request was dispatched through")
+	for _, verb := range []string{"GET", "POST"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(verb, "/api/messages", nil))
+		if want := "route " + verb + " " + "/api/messages"; rec.Body.String() != want || fromMiddleware != "route" {
+			t.Fatalf("got '%s' and '%s' from Middleware but expected '%s'", rec.Body, fromMiddleware, want)
+		}
+	}
+
+	t.Logf("Scenario: Requests not dispatched have no label")
+	if _, ok := LabelFromContext(httptest.NewRequest("GET", "/api/messages", nil)); ok {
+		t.Fatalf("got a label")
+	}
+}
+
+// observation is a call to Observer.ObserveRequest.
+type observation struct {
+	label, verb, path string
+	status            int
+}
+
+type observerFunc func(label, verb, path string, status int, dur time.Duration)
+
+func (f observerFunc) ObserveRequest(label, verb, path string, status int, dur time.Duration) {
+	f(label, verb, path, status, dur)
+}
+
+// panicController panics serving requests.
+type panicController struct{}
+
+func (panicController) Bindings() []Binding {
+	return []Binding{{Verb: "GET", Path: "/panic", Name: "Panic"}}
+}
+
+func (panicController) Panic(http.ResponseWriter, *http.Request) {
+	panic("controller panicked")
+}
+
+// rejectController rejects what is sent and lists nothing.
+type rejectController struct{}
+
+func (rejectController) Bindings() []Binding {
+	return []Binding{
+		{Verb: "POST", Path: "/api/messages", Name: "Send"},
+		{Verb: "GET", Path: "/spy/messages", Name: "List"},
+	}
+}
+
+func (rejectController) Send(rw http.ResponseWriter, req *http.Request) {
+	rw.WriteHeader(http.StatusBadRequest)
+}
+
+func (rejectController) List(http.ResponseWriter, *http.Request) {}
+
+func TestObserver(t *testing.T) {
+	var obs []observation
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(label string) Controller {
+		if label == "panic" {
+			return panicController{}
+		}
+		return rejectController{}
+	}))
+	dispatcher.SetObserver(observerFunc(func(label, verb, path string, status int, dur time.Duration) {
+		if dur <= 0 {
+			t.Errorf("got duration %s", dur)
+		}
+		obs = append(obs, observation{label, verb, path, status})
+	}))
+	for label, ctrl := range map[string]Controller{"reject": rejectController{}, "panic": panicController{}} {
+		if err := dispatcher.Register(ctrl, label); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+	}
+
+	t.Logf("Scenario: Requests are observed with their route and status")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/messages", nil))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/spy/messages", nil))
+
+	t.Logf("Scenario: Requests whose handler panics are observed before the panic resumes")
+	func() {
+		defer func() {
+			if p := recover(); p != "controller panicked" {
+				t.Fatalf("recovered %v", p)
+			}
+		}()
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	}()
+
+	want := []observation{
+		{"reject", "POST", "/api/messages", http.StatusBadRequest},
+		{"reject", "GET", "/spy/messages", http.StatusOK},
+		{"panic", "GET", "/panic", http.StatusInternalServerError},
+	}
+	if !reflect.DeepEqual(obs, want) {
+		t.Fatalf("got %+v but expected %+v", obs, want)
+	}
+}
+
+// badController has several Bindings that fail to register and one that does
+// not.
+type badController struct{}
+
+func (badController) Bindings() []Binding {
+	return []Binding{
+		{Verb: "GET", Path: "/good", Name: "Good"},
+		{Verb: "GET", Path: "/missing", Name: "Missing"},
+		{Verb: "GET", Path: "relative", Name: "Good"},
+		{Verb: "GET", Path: "/good", Name: "Good"},
+	}
+}
+
+func (badController) Good(http.ResponseWriter, *http.Request) {}
+
+func TestRegisterReportsAllErrors(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return badController{} }))
+
+	t.Logf("Scenario: Every failing Binding is reported, one per line")
+	err := dispatcher.Register(badController{}, "bad")
+	want := strings.Join([]string{
+		"di.Dispatcher<test>: could not find method 'Missing' in type 'badController'",
+		`di.Dispatcher<test>: error validating path of badController.Good: path "relative" must start with '/'`,
+		"di.Dispatcher<test>: cannot bind badController.Good to GET /good, already bound for 'bad'",
+	}, "\n")
+	if err == nil || err.Error() != want {
+		t.Fatalf("got error '%v' but expected '%s'", err, want)
+	}
+
+	t.Logf("Scenario: No Binding of a Controller that failed is registered")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/good", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d", rec.Code)
+	}
+}
+
+func TestUnknownVerb(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return verbsController{"PURGE"} }))
+
+	t.Logf("Scenario: A misspelled verb fails to register")
+	want := `di.Dispatcher<test>: error validating verb of verbsController.Update: unknown verb "PSOT"`
+	if err := dispatcher.Register(verbsController{"GET, psot"}, "typo"); err == nil || err.Error() != want {
+		t.Fatalf("got error '%v' but expected '%s'", err, want)
+	}
+
+	t.Logf("Scenario: A custom method registers once added to Methods")
+	Methods["PURGE"] = true
+	defer delete(Methods, "PURGE")
+	if err := dispatcher.Register(verbsController{"PURGE"}, "purge"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("PURGE", "/api/messages", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+}
+
+// depsController binds Serve to path and responds with deps, which stands in
+// for the dependencies it is constructed with.
+type depsController struct {
+	path string
+	deps string
+}
+
+func (ct depsController) Bindings() []Binding {
+	return []Binding{{Verb: "GET", Path: ct.path, Name: "Serve"}}
+}
+
+func (ct depsController) Serve(rw http.ResponseWriter, req *http.Request) {
+	as, _ := LabelFromContext(req)
+	fmt.Fprintf(rw, "%s %s", as, ct.deps)
+}
+
+func TestControllerUnderSeveralLabels(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(label string) Controller {
+		switch label {
+		case "reader":
+			return depsController{deps: "read-only"}
+		case "writer":
+			return depsController{deps: "read-write"}
+		}
+		panic(label)
+	}))
+
+	t.Logf("Scenario: A Controller type registered under two labels with distinct routes")
+	for label, path := range map[string]string{"reader": "/read", "writer": "/write"} {
+		if err := dispatcher.Register(depsController{path: path}, label); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+	}
+	for path, want := range map[string]string{"/read": "reader read-only", "/write": "writer read-write"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		t.Logf("\t%s is served with the dependencies for its label", path)
+		if rec.Body.String() != want {
+			t.Fatalf("got '%s' but expected '%s'", rec.Body, want)
+		}
+	}
+
+	t.Logf("Scenario: Registering it under another label with the same route fails")
+	want := "di.Dispatcher<test>: cannot bind depsController.Serve to GET /read, already bound for 'reader'"
+	if err := dispatcher.Register(depsController{path: "/read"}, "other"); err == nil || err.Error() != want {
+		t.Fatalf("got error '%v' but expected '%s'", err, want)
+	}
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return spyController{} }))
+	if err := dispatcher.Register(spyController{}, "spy"); err != nil {
+		b.Fatalf("got error '%s'", err)
+	}
+	req := httptest.NewRequest("GET", "/spy/messages", nil)
+	rec := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mux.ServeHTTP(rec, req)
+	}
+}
+
+func BenchmarkDispatchParallel(b *testing.B) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return routeController{} }))
+	if err := dispatcher.Register(routeController{}, "route"); err != nil {
+		b.Fatalf("got error '%s'", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req := httptest.NewRequest("GET", "/api/messages", nil)
+		rec := httptest.NewRecorder()
+		for pb.Next() {
+			rec.Body.Reset()
+			mux.ServeHTTP(rec, req)
+		}
+	})
+}
+
+// baseController has a method and Binding shared by the Controllers
+// embedding it.
+type baseController struct{}
+
+func (baseController) baseBindings() []Binding {
+	return []Binding{{Verb: "GET", Path: "/healthz", Name: "Health"}}
+}
+
+func (baseController) Health(rw http.ResponseWriter, req *http.Request) {
+	io.WriteString(rw, "healthy")
+}
+
+// embeddingController binds Health, promoted from baseController, along with
+// its own List.
+type embeddingController struct {
+	baseController
+}
+
+func (ct embeddingController) Bindings() []Binding {
+	return append(ct.baseBindings(), Binding{Verb: "GET", Path: "/spy/messages", Name: "List"})
+}
+
+func (embeddingController) List(rw http.ResponseWriter, req *http.Request) {
+	io.WriteString(rw, "listed")
+}
+
+// pointerEmbeddingController embeds baseController through a pointer and
+// binds a method it does not have.
+type pointerEmbeddingController struct {
+	*baseController
+}
+
+func (pointerEmbeddingController) Bindings() []Binding {
+	return append(baseController{}.baseBindings(), Binding{Verb: "GET", Path: "/spy/messages", Name: "Missing"})
+}
+
+// narrowController binds a method whose first argument cannot hold every
+// http.ResponseWriter.
+type narrowController struct{}
+
+func (narrowController) Bindings() []Binding {
+	return []Binding{{Verb: "GET", Path: "/spy/messages", Name: "List"}}
+}
+
+func (narrowController) List(*httptest.ResponseRecorder, *http.Request) {}
+
+func TestEmbeddedController(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return embeddingController{} }))
+	if err := dispatcher.Register(embeddingController{}, "embedding"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+
+	for path, want := range map[string]string{"/healthz": "healthy", "/spy/messages": "listed"} {
+		t.Logf("Scenario: GET %s is served by the method bound, promoted or not", path)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+		}
+	}
+
+	for _, c := range []struct {
+		ctrl Controller
+		want string
+	}{
+		{pointerEmbeddingController{}, "could not find method 'Missing' in type 'pointerEmbeddingController'"},
+		{&pointerEmbeddingController{}, "could not find method 'Missing' in type 'pointerEmbeddingController'"},
+		{struct{ pointerEmbeddingController }{}, "in type 'struct { di.pointerEmbeddingController }'"},
+		{narrowController{}, "error validating narrowController.List: 1st argument of type *httptest.ResponseRecorder cannot hold a http.ResponseWriter"},
+	} {
+		t.Logf("Scenario: Registering %T fails naming its type", c.ctrl)
+		dispatcher := New("test", router.New(), factoryFunc(func(string) Controller { return nil }))
+		if err := dispatcher.Register(c.ctrl, "bad"); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("got error '%v'", err)
+		}
+	}
+}
+
+// statusController binds methods with a default Status.
+type statusController struct{}
+
+func (statusController) Bindings() []Binding {
+	return []Binding{
+		{Verb: "DELETE", Path: "/api/messages", Name: "Delete", Status: http.StatusNoContent},
+		{Verb: "POST", Path: "/api/messages", Name: "Send", Status: http.StatusCreated},
+		{Verb: "PUT", Path: "/api/messages", Name: "Fail", Status: http.StatusCreated},
+	}
+}
+
+func (statusController) Delete(http.ResponseWriter, *http.Request) {}
+
+func (statusController) Send(rw http.ResponseWriter, req *http.Request) {
+	io.WriteString(rw, "sent")
+}
+
+func (statusController) Fail(rw http.ResponseWriter, req *http.Request) {
+	rw.WriteHeader(http.StatusConflict)
+}
+
+func TestBindingStatus(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return statusController{} }))
+	if err := dispatcher.Register(statusController{}, "status"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+
+	for _, c := range []struct {
+		verb   string
+		status int
+		body   string
+	}{
+		{"DELETE", http.StatusNoContent, ""},
+		{"POST", http.StatusCreated, "sent"},
+		{"PUT", http.StatusConflict, ""},
+	} {
+		t.Logf("Scenario: %s %s responds with %d", c.verb, "/api/messages", c.status)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(c.verb, "/api/messages", nil))
+		if rec.Code != c.status || rec.Body.String() != c.body {
+			t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// pairController binds two paths below prefix that are served together.
+type pairController struct {
+	prefix string
+}
+
+func (ct pairController) Bindings() []Binding {
+	return []Binding{
+		{Verb: "GET", Path: ct.prefix + "/a", Name: "Serve"},
+		{Verb: "GET", Path: ct.prefix + "/b", Name: "Serve"},
+	}
+}
+
+func (ct pairController) Serve(rw http.ResponseWriter, req *http.Request) {}
+
+func TestRegisterWhileServing(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(label string) Controller {
+		return pairController{"/" + label}
+	}))
+	const n = 200
+	status := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	t.Logf("Scenario: Controllers registered while serving have all or none of their Bindings served")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			label := fmt.Sprint(i)
+			if err := dispatcher.Register(pairController{"/" + label}, label); err != nil {
+				t.Errorf("got error '%s'", err)
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i := 0; i < n; i++ {
+					if status(fmt.Sprint("/", i, "/a")) != http.StatusOK {
+						continue
+					}
+					if code := status(fmt.Sprint("/", i, "/b")); code != http.StatusOK {
+						t.Errorf("GET /%d/a was served but GET /%d/b got status %d", i, i, code)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < n; i++ {
+		if code := status(fmt.Sprint("/", i, "/b")); code != http.StatusOK {
+			t.Fatalf("GET /%d/b: got status %d", i, code)
+		}
+	}
+}
+
+// pointerController declares Serve with a pointer receiver.
+type pointerController struct{}
+
+func (pointerController) Bindings() []Binding {
+	return []Binding{{Verb: "GET", Path: "/pointer", Name: "Serve"}}
+}
+
+func (*pointerController) Serve(rw http.ResponseWriter, req *http.Request) {
+	io.WriteString(rw, "served")
+}
+
+func TestPointerReceiver(t *testing.T) {
+	var ctrl Controller
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return ctrl }))
+	var failed error
+	dispatcher.SetErrorHandler(func(rw http.ResponseWriter, req *http.Request, status int, err error) {
+		failed = err
+		rw.WriteHeader(status)
+	})
+
+	t.Logf("Scenario: Registering a value whose methods have pointer receivers fails")
+	want := "di.Dispatcher<test>: method 'Serve' has receiver *pointerController but type 'pointerController' " +
+		"was registered as a value: register a *pointerController, and return one from NewController, " +
+		"or declare Serve on pointerController"
+	if err := dispatcher.Register(pointerController{}, "pointer"); err == nil || err.Error() != want {
+		t.Fatalf("got error '%v' but expected '%s'", err, want)
+	}
+
+	t.Logf("Scenario: Registering a pointer serves requests with the pointer NewController returns")
+	if err := dispatcher.Register(&pointerController{}, "pointer"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	ctrl = &pointerController{}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/pointer", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "served" {
+		t.Fatalf("got %d '%s'", rec.Code, rec.Body)
+	}
+
+	t.Logf("Scenario: NewController returning a value instead fails the request, telling why")
+	ctrl = pointerController{}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/pointer", nil))
+	want = "di.Dispatcher<test>: for GET, /pointer NewController(pointer) returned di.pointerController " +
+		"but expected *di.pointerController, return a pointer if one was registered and a value otherwise"
+	if rec.Code != http.StatusInternalServerError || failed == nil || failed.Error() != want {
+		t.Fatalf("got %d and error '%v' but expected '%s'", rec.Code, failed, want)
+	}
+}
+
+// mountedController binds paths relative to its base, so it can be registered
+// under several.
+type mountedController struct {
+	base string
+}
+
+func (ct mountedController) BasePath() string {
+	return ct.base
+}
+
+func (mountedController) Bindings() []Binding {
+	return []Binding{
+		{Verb: "GET", Path: "", Name: "List"},
+		{Verb: "GET", Path: "/spy", Name: "Spy"},
+	}
+}
+
+func (ct mountedController) List(rw http.ResponseWriter, req *http.Request) {
+	io.WriteString(rw, "listed "+ct.base)
+}
+
+func (ct mountedController) Spy(rw http.ResponseWriter, req *http.Request) {
+	io.WriteString(rw, "spied "+ct.base)
+}
+
+func TestBasePath(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(label string) Controller {
+		if label == "embedding" {
+			return embeddingController{}
+		}
+		return mountedController{base: label}
+	}))
+	for _, ctrl := range []Controller{mountedController{"/a"}, mountedController{"/b/"}, embeddingController{}} {
+		label := "embedding"
+		if m, ok := ctrl.(mountedController); ok {
+			label = m.base
+		}
+		if err := dispatcher.Register(ctrl, label); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+	}
+
+	for _, c := range []struct{ path, want string }{
+		{"/a", "listed /a"},
+		{"/a/spy", "spied /a"},
+		{"/b", "listed /b/"},
+		{"/b/spy", "spied /b/"},
+		{"/healthz", "healthy"},
+		{"/spy/messages", "listed"},
+	} {
+		t.Logf("Scenario: GET %s is served by the Controller mounted there", c.path)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", c.path, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != c.want {
+			t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+		}
+	}
+
+	t.Logf("Scenario: Mounting a Controller twice under a base fails naming the full path")
+	err := dispatcher.Register(mountedController{"/a"}, "again")
+	if err == nil || !strings.Contains(err.Error(), "GET /a/spy, already bound for '/a'") {
+		t.Fatalf("got error '%v'", err)
+	}
+
+	t.Logf("Scenario: Deregistering removes the paths under the base only")
+	dispatcher.Deregister(mountedController{"/a"})
+	for path, want := range map[string]int{"/a": http.StatusNotFound, "/a/spy": http.StatusNotFound, "/b/spy": http.StatusOK} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != want {
+			t.Fatalf("GET %s: got %d", path, rec.Code)
+		}
+	}
+}
+
+// failingFactory fails to construct Controllers with err, or panics if it is
+// asked to with NewController.
+type failingFactory struct {
+	err error
+}
+
+func (f failingFactory) With(*http.Request) RequestFactory {
+	return f
+}
+
+func (failingFactory) NewController(string) Controller {
+	panic("NewController called")
+}
+
+func (f failingFactory) NewControllerErr(string) (Controller, error) {
+	return nil, f.err
+}
+
+func TestFactoryError(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		status int
+	}{
+		{errors.New("misconfigured"), http.StatusInternalServerError},
+		{fmt.Errorf("database down: %w", ErrUnavailable), http.StatusServiceUnavailable},
+	} {
+		t.Logf("Scenario: A factory failing with '%s' is answered with %d without panicking", c.err, c.status)
+		mux := router.New()
+		dispatcher := New("test", mux, failingFactory{c.err})
+		var handled error
+		dispatcher.SetErrorHandler(func(rw http.ResponseWriter, req *http.Request, status int, err error) {
+			handled = err
+			DefaultErrorHandler(rw, req, status, err)
+		})
+		if err := dispatcher.Register(spyController{}, "spy"); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/spy/messages", nil))
+		if rec.Code != c.status || !errors.Is(handled, c.err) {
+			t.Fatalf("got %d and error '%v'", rec.Code, handled)
+		}
+	}
+}
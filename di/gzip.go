@@ -0,0 +1,221 @@
+package di
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultGzipMinSize is the size, in bytes, below which GzipMiddleware does not
+// compress responses when passed a size that is not positive.
+const DefaultGzipMinSize = 1024
+
+// GzipMiddleware returns Middleware that compresses responses with gzip for
+// clients that accept it. Responses are buffered until minSize bytes have been
+// written, and those that end before are not compressed, nor are responses
+// whose Content-Type is already compressed, like images, or that set
+// Content-Encoding. Flushing the response starts compressing it right away so
+// that streamed responses keep flowing. Requests to upgrade the connection, as
+// to a WebSocket, are passed through untouched so that it can be hijacked.
+func GzipMiddleware(minSize int) Middleware {
+	if minSize <= 0 {
+		minSize = DefaultGzipMinSize
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsGzip(req.Header.Get("Accept-Encoding")) || IsUpgrade(req) {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			gw := &gzipWriter{ResponseWriter: rw, minSize: minSize}
+			defer gw.release() // even if next panics
+			next.ServeHTTP(gw, req)
+			gw.close()
+		})
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header value accept lists gzip
+// or *, without q=0.
+func acceptsGzip(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		if q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUpgrade reports whether req asks to upgrade the connection to another
+// protocol, as WebSocket handshakes do. Middleware that buffers or replaces
+// the response passes such requests through so that it can be hijacked.
+func IsUpgrade(req *http.Request) bool {
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return req.Header.Get("Upgrade") != ""
+			}
+		}
+	}
+	return false
+}
+
+// compressedTypes are the prefixes of the media types of compressed content.
+var compressedTypes = []string{
+	"image/", "video/", "audio/",
+	"application/gzip", "application/x-gzip", "application/zip", "application/x-compress",
+}
+
+// compressible reports whether content of contentType is worth compressing.
+func compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if strings.HasPrefix(contentType, "image/svg") {
+		return true
+	}
+	for _, prefix := range compressedTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// gzipWriter is an http.ResponseWriter that buffers the response until it
+// decides whether to compress it.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer // set if compressing
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < w.minSize {
+			return len(p), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection if nothing was written yet and the wrapped
+// http.ResponseWriter allows it, for handlers that upgrade it without the
+// request asking to.
+func (w *gzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.decided || w.status != 0 || len(w.buf) > 0 {
+		return nil, nil, errors.New("hijacking a response already written")
+	}
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.ResponseWriter cannot be hijacked")
+	}
+	conn, buf, err := h.Hijack()
+	if err == nil {
+		w.decided = true // so that close writes nothing
+	}
+	return conn, buf, err
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// decide writes the header, compressing the response from then on if compress
+// is set and the response can be, and writes what was buffered.
+func (w *gzipWriter) decide(compress bool) error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		// sniffed here as it cannot be once compressed
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	bodyless := w.status == http.StatusNoContent || w.status == http.StatusNotModified
+	if compress && !bodyless && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	_, err := w.Write(buf)
+	return err
+}
+
+// close writes the rest of the response once the handler has returned.
+func (w *gzipWriter) close() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// release returns the gzip.Writer, if any, to the pool.
+func (w *gzipWriter) release() {
+	if w.gz != nil {
+		w.gz.Reset(nil)
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
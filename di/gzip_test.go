@@ -0,0 +1,104 @@
+package di
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipMiddleware(t *testing.T) {
+	large := strings.Repeat("hello world\n", 200)
+	serve := func(contentType, body, acceptEncoding string, header http.Header) *httptest.ResponseRecorder {
+		handler := GzipMiddleware(0)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if contentType != "" {
+				rw.Header().Set("Content-Type", contentType)
+			}
+			io.WriteString(rw, body)
+		}))
+		req := httptest.NewRequest("GET", "/spy/messages", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Logf("Scenario: Large responses are compressed for clients accepting gzip")
+	rec := serve("", large, "gzip, deflate", nil)
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("got header %v", rec.Header())
+	}
+	t.Logf("\tand keep the Content-Type sniffed from the uncompressed body")
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Fatalf("got Content-Type '%s'", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	if body, err := io.ReadAll(zr); err != nil || string(body) != large {
+		t.Fatalf("got error '%v' and %d bytes", err, len(body))
+	}
+
+	for _, c := range []struct {
+		desc, contentType, body, acceptEncoding string
+		header                                  http.Header
+	}{
+		{"Small responses", "", "hello", "gzip", nil},
+		{"Responses to clients not accepting gzip", "", large, "identity", nil},
+		{"Responses to clients refusing gzip with q=0", "", large, "gzip;q=0, identity", nil},
+		{"Responses of a compressed type", "image/png", large, "gzip", nil},
+		{"Responses to requests upgrading the connection", "", large, "gzip",
+			http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}}},
+	} {
+		t.Logf("Scenario: %s are not compressed", c.desc)
+		rec := serve(c.contentType, c.body, c.acceptEncoding, c.header)
+		if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != c.body {
+			t.Fatalf("got header %v and %d bytes", rec.Header(), rec.Body.Len())
+		}
+	}
+
+	t.Logf("Scenario: Flushing passes through to the client")
+	handler := GzipMiddleware(0)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "first line\n")
+		rw.(http.Flusher).Flush()
+	}))
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/spy/messages", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, req)
+	if !rec.Flushed || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got flushed %v with header %v", rec.Flushed, rec.Header())
+	}
+	if zr, err := gzip.NewReader(rec.Body); err != nil {
+		t.Fatalf("got error '%s'", err)
+	} else if body, _ := io.ReadAll(zr); string(body) != "first line\n" {
+		t.Fatalf("got '%s'", body)
+	}
+}
+
+func TestIsUpgrade(t *testing.T) {
+	for _, c := range []struct {
+		connection, upgrade string
+		want                bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, upgrade", "websocket", true},
+		{"Upgrade", "", false},
+		{"keep-alive", "websocket", false},
+		{"", "", false},
+	} {
+		t.Logf("Scenario: Connection '%s' and Upgrade '%s' is an upgrade: %t", c.connection, c.upgrade, c.want)
+		req := httptest.NewRequest("GET", "/api/messages/watch", nil)
+		req.Header.Set("Connection", c.connection)
+		req.Header.Set("Upgrade", c.upgrade)
+		if got := IsUpgrade(req); got != c.want {
+			t.Fatalf("got %t", got)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package di
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Entry describes a request served through LoggingMiddleware.
+type Entry struct {
+	Time    time.Time     // when the request arrived
+	Method  string        // the request method
+	Path    string        // the request URL path
+	Label   string        // the label of the Controller served, "" if none
+	Status  int           // the status code responded with
+	Latency time.Duration // how long serving the request took
+}
+
+func (e Entry) String() string {
+	label := e.Label
+	if label == "" {
+		label = "-"
+	}
+	return fmt.Sprintf("%s %s %s %d %s", e.Method, e.Path, label, e.Status, e.Latency)
+}
+
+type entryKey struct{}
+
+// LoggingMiddleware returns Middleware that passes an Entry for every request
+// to sink once it has been served. Label is set when the request reaches a
+// Controller through a Dispatcher, so the Middleware may be passed to
+// Dispatcher.Use or wrap the Router as a whole.
+func LoggingMiddleware(sink func(Entry)) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			e := &Entry{Time: time.Now(), Method: req.Method, Path: req.URL.Path}
+			e.Label, _ = LabelFromContext(req)
+			// keep the entries of enclosing LoggingMiddleware so that they are
+			// labeled once the request is routed
+			entries, _ := req.Context().Value(entryKey{}).([]*Entry)
+			entries = append(entries[:len(entries):len(entries)], e)
+			sw := WrapResponseWriter(rw)
+			next.ServeHTTP(sw, req.WithContext(context.WithValue(req.Context(), entryKey{}, entries)))
+			e.Status, e.Latency = sw.Status(), time.Since(e.Time)
+			sink(*e)
+		})
+	}
+}
+
+// LogTo returns a sink for LoggingMiddleware that prints entries to l.
+func LogTo(l *log.Logger) func(Entry) {
+	return func(e Entry) { l.Print(e) }
+}
+
+// CommonLogFormat is the layout of the date in Common Log Format.
+const CommonLogFormat = "02/Jan/2006:15:04:05 -0700"
+
+// CommonLogMiddleware returns Middleware that writes a line in the Common Log
+// Format of Apache and NCSA to w for every request once it has been served:
+//
+//	host ident authuser [date] "request" status bytes
+//
+// host is that of RemoteAddr, authuser the user of Basic Auth credentials and
+// ident is always "-", as are fields that are unknown or bytes when no body was
+// written. Lines are written whole, one Write each, so that those of
+// concurrent requests do not interleave.
+func CommonLogMiddleware(w io.Writer) Middleware {
+	var mu sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			sw := WrapResponseWriter(rw)
+			next.ServeHTTP(sw, req)
+
+			host, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				host = req.RemoteAddr
+			}
+			user, _, _ := req.BasicAuth()
+			uri := req.RequestURI
+			if uri == "" {
+				uri = req.URL.RequestURI()
+			}
+			size := "-"
+			if n := sw.BytesWritten(); n > 0 {
+				size = strconv.FormatInt(n, 10)
+			}
+			line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s\n",
+				orDash(host), orDash(user), start.Format(CommonLogFormat),
+				req.Method, strings.Replace(uri, `"`, `\"`, -1), req.Proto, sw.Status(), size)
+			mu.Lock()
+			defer mu.Unlock()
+			io.WriteString(w, line)
+		})
+	}
+}
+
+// orDash returns s, or "-" if it is empty, as Common Log Format has it.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,94 @@
+package di
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/kkrs/godi-code/di/router"
+)
+
+func TestLoggingMiddleware(t *testing.T) {
+	var entries []Entry
+	sink := func(e Entry) { entries = append(entries, e) }
+
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return spyController{} }))
+	dispatcher.Use(LoggingMiddleware(sink))
+	if err := dispatcher.Register(spyController{}, "spy"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	serve := func(h http.Handler, verb, path string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(verb, path, nil))
+	}
+
+	t.Logf("Scenario: Requests through Dispatcher.Use are logged with their label")
+	serve(mux, "POST", "/api/messages")
+	serve(mux, "GET", "/spy/messages")
+	if len(entries) != 2 {
+		t.Fatalf("got entries %+v", entries)
+	}
+	for i, want := range []Entry{
+		{Method: "POST", Path: "/api/messages", Label: "spy", Status: http.StatusOK},
+		{Method: "GET", Path: "/spy/messages", Label: "spy", Status: http.StatusOK},
+	} {
+		got := entries[i]
+		if got.Time.IsZero() || got.Latency <= 0 {
+			t.Fatalf("got entry %+v", got)
+		}
+		got.Time, got.Latency = time.Time{}, 0
+		if got != want {
+			t.Fatalf("got entry %+v but expected %+v", got, want)
+		}
+	}
+
+	t.Logf("Scenario: Requests through a wrapped Router are logged, unrouted ones without label")
+	entries = nil
+	logged := LoggingMiddleware(sink)(mux)
+	serve(logged, "GET", "/spy/messages")
+	serve(logged, "GET", "/nowhere")
+	// the Dispatcher's Middleware logs too, so the routed request is logged twice
+	if len(entries) != 3 || entries[0].Label != "spy" || entries[1].Label != "spy" ||
+		entries[2].Label != "" || entries[2].Status != http.StatusNotFound {
+		t.Fatalf("got entries %+v", entries)
+	}
+}
+
+func TestCommonLogMiddleware(t *testing.T) {
+	var log bytes.Buffer
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(string) Controller { return statusController{} }))
+	dispatcher.Use(CommonLogMiddleware(&log))
+	if err := dispatcher.Register(statusController{}, "status"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+
+	t.Logf("Scenario: A request is logged in Common Log Format with its status and size")
+	req := httptest.NewRequest("POST", "/api/messages?dryRun=true", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.SetBasicAuth("kkrs", "secret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	clf := regexp.MustCompile(`^192\.0\.2\.1 - kkrs \[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /api/messages\?dryRun=true HTTP/1\.1" 201 (\d+)\n$`)
+	m := clf.FindStringSubmatch(log.String())
+	if m == nil || m[1] != fmt.Sprint(rec.Body.Len()) {
+		t.Fatalf("got line '%s' for a body of %d bytes", log.String(), rec.Body.Len())
+	}
+
+	t.Logf("Scenario: Unknown fields and empty bodies are logged as -")
+	log.Reset()
+	handler := CommonLogMiddleware(&log)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	req = httptest.NewRequest("DELETE", "/api/messages/1", nil)
+	req.RemoteAddr = "192.0.2.1"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	clf = regexp.MustCompile(`^192\.0\.2\.1 - - \[[^]]+\] "DELETE /api/messages/1 HTTP/1\.1" 204 -\n$`)
+	if !clf.MatchString(log.String()) {
+		t.Fatalf("got line '%s'", log.String())
+	}
+}
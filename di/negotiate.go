@@ -0,0 +1,70 @@
+package di
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// candidate is a handler of a route shared by Bindings with Match.
+type candidate struct {
+	as       string
+	ctrlType reflect.Type
+	match    func(*http.Request) bool
+	handler  http.Handler
+}
+
+// negotiate returns a handler passing requests to the first of cands that
+// matches them, and to the ErrorHandler with 406 if none does.
+func (di Dispatcher) negotiate(cands []candidate) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for _, c := range cands {
+			if c.match(req) {
+				c.handler.ServeHTTP(rw, req)
+				return
+			}
+		}
+		di.onError(rw, req, http.StatusNotAcceptable, errors.New("no Binding matches the request"))
+	})
+}
+
+// without returns a copy of cands without those of Controllers of ctrlType.
+func without(cands []candidate, ctrlType reflect.Type) []candidate {
+	var kept []candidate
+	for _, c := range cands {
+		if c.ctrlType != ctrlType {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// AcceptsMediaType returns a Match for Bindings that serves requests whose
+// Accept header lists mediaType, like "application/vnd.myapp.v2+json", without
+// q=0. Wildcards like "*/*" are not matched, so that a version is only served
+// to clients asking for it.
+func AcceptsMediaType(mediaType string) func(*http.Request) bool {
+	return func(req *http.Request) bool {
+		for _, accept := range req.Header["Accept"] {
+			for _, part := range strings.Split(accept, ",") {
+				params := strings.Split(part, ";")
+				if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+					continue
+				}
+				q := 1.0
+				for _, param := range params[1:] {
+					param = strings.TrimSpace(param)
+					if strings.HasPrefix(param, "q=") {
+						q, _ = strconv.ParseFloat(param[2:], 64)
+					}
+				}
+				if q > 0 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
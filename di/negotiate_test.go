@@ -0,0 +1,96 @@
+package di
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kkrs/godi-code/di/router"
+)
+
+// versionController serves List for clients accepting its version of the
+// media type of messages.
+type versionController struct {
+	version string
+}
+
+func (ct versionController) Bindings() []Binding {
+	mediaType := "application/vnd.myapp." + ct.version + "+json"
+	return []Binding{{Verb: "GET", Path: "/api/messages", Name: "List", Match: AcceptsMediaType(mediaType)}}
+}
+
+func (ct versionController) List(rw http.ResponseWriter, req *http.Request) {
+	io.WriteString(rw, ct.version)
+}
+
+// v2Controller is the Controller of version 2, of a type of its own so that
+// it can be deregistered apart from version 1.
+type v2Controller struct {
+	versionController
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	mux := router.New()
+	dispatcher := New("test", mux, factoryFunc(func(label string) Controller {
+		if label == "v2" {
+			return v2Controller{versionController{"v2"}}
+		}
+		return versionController{label}
+	}))
+	for _, r := range []struct {
+		ctrl  Controller
+		label string
+	}{{versionController{"v1"}, "v1"}, {v2Controller{versionController{"v2"}}, "v2"}} {
+		if err := dispatcher.Register(r.ctrl, r.label); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+	}
+	get := func(accept string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/messages", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, c := range []struct {
+		accept string
+		status int
+		body   string
+	}{
+		{"application/vnd.myapp.v1+json", http.StatusOK, "v1"},
+		{"text/html, application/vnd.myapp.v2+json;q=0.9", http.StatusOK, "v2"},
+		{"application/vnd.myapp.v2+json;q=0", http.StatusNotAcceptable, ""},
+		{"application/json", http.StatusNotAcceptable, ""},
+		{"", http.StatusNotAcceptable, ""},
+	} {
+		t.Logf("Scenario: GET /api/messages accepting '%s' is dispatched by version", c.accept)
+		rec := get(c.accept)
+		if rec.Code != c.status || c.body != "" && rec.Body.String() != c.body {
+			t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+		}
+	}
+
+	t.Logf("Scenario: A Binding without Match cannot share the route")
+	err := dispatcher.Register(pathController{"/api/messages"}, "plain")
+	if err == nil || !strings.Contains(err.Error(), "already bound for 'v1', which only Bindings that all have Match can share") {
+		t.Fatalf("got error '%v'", err)
+	}
+
+	t.Logf("Scenario: Deregistering a version keeps serving the others")
+	dispatcher.Deregister(v2Controller{versionController{"v2"}})
+	if rec := get("application/vnd.myapp.v2+json"); rec.Code != http.StatusNotAcceptable {
+		t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+	}
+	if rec := get("application/vnd.myapp.v1+json"); rec.Code != http.StatusOK || rec.Body.String() != "v1" {
+		t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+	}
+	dispatcher.Deregister(versionController{"v1"})
+	if rec := get("application/vnd.myapp.v1+json"); rec.Code != http.StatusNotFound {
+		t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,76 @@
+package di
+
+import (
+	"errors"
+
+	"github.com/kkrs/godi-code/di/router"
+)
+
+// An Option configures a Dispatcher made with NewDispatcher.
+type Option func(*Dispatcher)
+
+// WithRouter sets the Router Controllers are registered with. It defaults to
+// a router.Mux.
+func WithRouter(r Router) Option {
+	return func(di *Dispatcher) {
+		if r != nil {
+			di.router = r
+		}
+	}
+}
+
+// WithFactory sets the ApplicationFactory Controllers are constructed with.
+// It is required.
+func WithFactory(f ApplicationFactory) Option {
+	return func(di *Dispatcher) { di.factory = f }
+}
+
+// WithMiddleware appends mws to the Middleware applied to every Binding, as
+// Use does.
+func WithMiddleware(mws ...Middleware) Option {
+	return func(di *Dispatcher) { di.Use(mws...) }
+}
+
+// WithErrorHandler sets the ErrorHandler, as SetErrorHandler does.
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(di *Dispatcher) { di.SetErrorHandler(h) }
+}
+
+// WithPanicHandler sets the PanicHandler, as SetPanicHandler does.
+func WithPanicHandler(h PanicHandler) Option {
+	return func(di *Dispatcher) { di.SetPanicHandler(h) }
+}
+
+// WithObserver sets the Observer, as SetObserver does.
+func WithObserver(o Observer) Option {
+	return func(di *Dispatcher) { di.SetObserver(o) }
+}
+
+// WithAuthenticator sets the Authenticator of Bindings that have none, as
+// SetAuthenticator does.
+func WithAuthenticator(a Authenticator) Option {
+	return func(di *Dispatcher) { di.SetAuthenticator(a) }
+}
+
+// NewDispatcher creates a new Dispatcher configured by opts, applied in order.
+// It fails if name is empty or no ApplicationFactory is set with WithFactory.
+func NewDispatcher(name string, opts ...Option) (Dispatcher, error) {
+	if name == "" {
+		return Dispatcher{}, errors.New("argument 'name' cannot be empty")
+	}
+	di := Dispatcher{
+		name:    name,
+		onError: DefaultErrorHandler,
+		routes:  &routes{owners: make(map[string]owner), matched: make(map[string][]candidate)},
+	}
+	for _, opt := range opts {
+		opt(&di)
+	}
+	if di.factory == nil {
+		return Dispatcher{}, errors.New("argument 'factory' cannot be nil")
+	}
+	if di.router == nil {
+		di.router = router.New()
+	}
+	return di, nil
+}
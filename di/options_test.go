@@ -0,0 +1,79 @@
+package di
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kkrs/godi-code/di/router"
+)
+
+func TestNewDispatcher(t *testing.T) {
+	factory := factoryFunc(func(label string) Controller {
+		if label == "panic" {
+			return panicController{}
+		}
+		return pathController{"/spy/messages"}
+	})
+
+	t.Logf("Scenario: A Dispatcher made with only a factory routes with a router.Mux")
+	dispatcher, err := NewDispatcher("test", WithFactory(factory))
+	if err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	if _, ok := dispatcher.Router().(*router.Mux); !ok {
+		t.Fatalf("got router %T", dispatcher.Router())
+	}
+	if err := dispatcher.Register(pathController{"/spy/messages"}, "path"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	rec := httptest.NewRecorder()
+	dispatcher.Router().ServeHTTP(rec, httptest.NewRequest("GET", "/spy/messages", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+
+	t.Logf("Scenario: A Dispatcher cannot be made without a name or a factory")
+	if _, err := NewDispatcher("", WithFactory(factory)); err == nil || err.Error() != "argument 'name' cannot be empty" {
+		t.Fatalf("got error '%v'", err)
+	}
+	if _, err := NewDispatcher("test", WithRouter(router.New())); err == nil || err.Error() != "argument 'factory' cannot be nil" {
+		t.Fatalf("got error '%v'", err)
+	}
+
+	t.Logf("Scenario: Options set the router, middleware and panic handler")
+	mux := router.New()
+	dispatcher, err = NewDispatcher("test",
+		WithRouter(mux),
+		WithFactory(factory),
+		WithMiddleware(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("X-Wrapped", "yes")
+				next.ServeHTTP(rw, req)
+			})
+		}),
+		WithPanicHandler(func(rw http.ResponseWriter, req *http.Request, v interface{}) {
+			http.Error(rw, fmt.Sprintf("recovered %v", v), http.StatusInternalServerError)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	if err := dispatcher.Register(panicController{}, "panic"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/panic", nil))
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != "recovered controller panicked\n" || rec.Header().Get("X-Wrapped") != "yes" {
+		t.Fatalf("got %d '%s' %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	t.Logf("Scenario: New still panics on a missing factory")
+	defer func() {
+		if p := recover(); fmt.Sprint(p) != "argument 'factory' cannot be nil" {
+			t.Fatalf("recovered %v", p)
+		}
+	}()
+	New("test", router.New(), nil)
+}
@@ -0,0 +1,113 @@
+package di
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+// RecordingWriter is an http.ResponseWriter that records the status code and
+// the number of bytes of body written through it, for Middleware to tell what
+// the handlers it wraps responded. It is made with WrapResponseWriter and
+// forwards Flush, Hijack and ReadFrom to the http.ResponseWriter it wraps when
+// that supports them.
+type RecordingWriter struct {
+	http.ResponseWriter
+	code    int
+	written int64
+}
+
+// WrapResponseWriter returns a RecordingWriter writing to rw.
+func WrapResponseWriter(rw http.ResponseWriter) *RecordingWriter {
+	return &RecordingWriter{ResponseWriter: rw}
+}
+
+func (w *RecordingWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *RecordingWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom copies the body from r, with the ReadFrom of the wrapped
+// http.ResponseWriter if it is an io.ReaderFrom, as http.Server's is, so that
+// files can be sent without copying them through user space.
+func (w *RecordingWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(writerOnly{w.ResponseWriter}, r)
+	}
+	w.written += n
+	return n, err
+}
+
+// writerOnly hides the methods of a Writer other than Write, so that io.Copy
+// does not call ReadFrom back.
+type writerOnly struct {
+	io.Writer
+}
+
+// Flush sends what was written to the client if the wrapped
+// http.ResponseWriter is an http.Flusher, and does nothing otherwise.
+func (w *RecordingWriter) Flush() {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection, as to upgrade it to a WebSocket, if the
+// wrapped http.ResponseWriter allows it. The status is then 101.
+func (w *RecordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.ResponseWriter cannot be hijacked")
+	}
+	conn, buf, err := h.Hijack()
+	if err == nil && w.code == 0 {
+		w.code = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController.
+func (w *RecordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Written reports whether a status or any of the body was written.
+func (w *RecordingWriter) Written() bool {
+	return w.code != 0
+}
+
+// Status returns the status code written, which is 200 if nothing was.
+func (w *RecordingWriter) Status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+// BytesWritten returns the number of bytes of body written.
+func (w *RecordingWriter) BytesWritten() int64 {
+	return w.written
+}
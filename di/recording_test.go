@@ -0,0 +1,64 @@
+package di
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecordingWriter(t *testing.T) {
+	t.Logf("Scenario: Nothing is recorded until the handler writes")
+	rec := httptest.NewRecorder()
+	w := WrapResponseWriter(rec)
+	if w.Written() || w.Status() != http.StatusOK || w.BytesWritten() != 0 {
+		t.Fatalf("got written %t, status %d and %d bytes", w.Written(), w.Status(), w.BytesWritten())
+	}
+
+	t.Logf("Scenario: Flushes pass through to a flushable writer")
+	var rw http.ResponseWriter = w
+	rw.(http.Flusher).Flush()
+	if !rec.Flushed || !w.Written() || w.Status() != http.StatusOK {
+		t.Fatalf("got flushed %t, written %t and status %d", rec.Flushed, w.Written(), w.Status())
+	}
+
+	t.Logf("Scenario: The status and bytes written are recorded, through ReadFrom too")
+	rec = httptest.NewRecorder()
+	w = WrapResponseWriter(rec)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("hello "))
+	if n, err := io.Copy(w, strings.NewReader("world")); n != 5 || err != nil {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if w.Status() != http.StatusCreated || w.BytesWritten() != 11 || rec.Body.String() != "hello world" {
+		t.Fatalf("got status %d, %d bytes and '%s'", w.Status(), w.BytesWritten(), rec.Body.String())
+	}
+
+	t.Logf("Scenario: Hijacking fails for writers that cannot be hijacked")
+	if _, _, err := w.Hijack(); err == nil {
+		t.Fatalf("hijacked a recorder")
+	}
+
+	t.Logf("Scenario: Hijacking passes through to the server's writer")
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		w := WrapResponseWriter(rw)
+		conn, buf, err := w.Hijack()
+		if err != nil {
+			t.Errorf("got error '%s'", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n")
+		buf.Flush()
+		if w.Status() != http.StatusSwitchingProtocols {
+			t.Errorf("got status %d", w.Status())
+		}
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got response %v and error '%v'", resp, err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,113 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Adapter implements di.Router on top of a router that routes by path alone,
+// like gorilla/mux or chi, so that applications standardized on one can keep
+// it. The router routes each pattern to Adapter, which dispatches by verb as
+// Mux does and makes the variables the router matched available from Vars:
+//
+//	r := mux.NewRouter()
+//	adapter := router.Adapt(r, func(pattern string, h http.Handler) {
+//		r.Handle(pattern, h)
+//	}, mux.Vars)
+//
+// Requests are served by the router, through ServeHTTP of Adapter.
+type Adapter struct {
+	router http.Handler
+	handle func(pattern string, h http.Handler)
+	vars   func(*http.Request) map[string]string
+
+	mu        sync.RWMutex
+	byPattern map[string]map[string]http.Handler // handlers by verb by pattern
+}
+
+// Adapt returns an Adapter for router, which handle registers handlers with
+// for a pattern and vars returns the variables matched by. vars may be nil if
+// router has no variables.
+func Adapt(router http.Handler, handle func(pattern string, h http.Handler), vars func(*http.Request) map[string]string) *Adapter {
+	return &Adapter{router: router, handle: handle, vars: vars, byPattern: make(map[string]map[string]http.Handler)}
+}
+
+// Handle registers handler for <verb, pattern>, registering pattern with the
+// router the first time it is seen. verb may be Wildcard.
+func (a *Adapter) Handle(verb, pattern string, handler http.Handler) {
+	a.mu.Lock()
+	handlers, ok := a.byPattern[pattern]
+	if !ok {
+		handlers = make(map[string]http.Handler)
+		a.byPattern[pattern] = handlers
+	}
+	handlers[strings.ToUpper(verb)] = handler
+	a.mu.Unlock()
+	if !ok {
+		a.handle(pattern, a.dispatcher(pattern))
+	}
+}
+
+// HandleFunc registers handler for <verb, pattern>.
+func (a *Adapter) HandleFunc(verb, pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	a.Handle(verb, pattern, http.HandlerFunc(handler))
+}
+
+// Remove removes the handler registered for <verb, pattern>, if any. Routers
+// generally cannot unregister a pattern, so requests for pattern get 405 once
+// other verbs remain registered for it and 404 once none do.
+func (a *Adapter) Remove(verb, pattern string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.byPattern[pattern], strings.ToUpper(verb))
+}
+
+func (a *Adapter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	a.router.ServeHTTP(rw, req)
+}
+
+// dispatcher returns the handler registered with the router for pattern,
+// which serves requests with the handler for their verb, or else the one for
+// Wildcard, or else for HEAD the one for GET.
+func (a *Adapter) dispatcher(pattern string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		verb := strings.ToUpper(req.Method)
+		a.mu.RLock()
+		handlers := a.byPattern[pattern]
+		h := handlers[verb]
+		if h == nil {
+			h = handlers[Wildcard]
+		}
+		if h == nil && verb == "HEAD" && handlers["GET"] != nil {
+			h = headHandler{handlers["GET"]}
+		}
+		var allowed []string
+		for v := range handlers {
+			if v != Wildcard {
+				allowed = append(allowed, v)
+			}
+		}
+		a.mu.RUnlock()
+
+		if h == nil {
+			if len(allowed) == 0 {
+				http.NotFound(rw, req)
+				return
+			}
+			sort.Strings(allowed)
+			rw.Header().Set("Allow", strings.Join(allowed, ", "))
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := context.WithValue(req.Context(), patternKey{}, pattern)
+		if a.vars != nil {
+			if vars := a.vars(req); len(vars) > 0 {
+				ctx = context.WithValue(ctx, varsKey{}, vars)
+			}
+		}
+		h.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,67 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdapter(t *testing.T) {
+	// http.ServeMux routes by path alone, with the id of a message as the
+	// variable of the subtree of messages
+	sm := http.NewServeMux()
+	adapter := Adapt(sm, func(pattern string, h http.Handler) { sm.Handle(pattern, h) },
+		func(req *http.Request) map[string]string {
+			if id := strings.TrimPrefix(req.URL.Path, "/api/messages/"); id != req.URL.Path {
+				return map[string]string{"id": id}
+			}
+			return nil
+		})
+	echo := func(name string) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(rw, "%s %s %v", name, Pattern(req), Vars(req))
+		}
+	}
+	adapter.HandleFunc("GET", "/api/messages/", echo("get"))
+	adapter.HandleFunc("put", "/api/messages/", echo("put"))
+	adapter.HandleFunc("POST", "/api/messages", echo("post"))
+	adapter.HandleFunc(Wildcard, "/spy/messages", echo("any"))
+	serve := func(verb, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		adapter.ServeHTTP(rec, httptest.NewRequest(verb, path, nil))
+		return rec
+	}
+
+	for _, c := range []struct {
+		verb, path, body string
+	}{
+		{"GET", "/api/messages/42", "get /api/messages/ map[id:42]"},
+		{"PUT", "/api/messages/42", "put /api/messages/ map[id:42]"},
+		{"POST", "/api/messages", "post /api/messages map[]"},
+		{"DELETE", "/spy/messages", "any /spy/messages map[]"},
+		{"HEAD", "/api/messages/42", ""},
+	} {
+		t.Logf("Scenario: %s %s is dispatched by verb with the pattern and variables matched", c.verb, c.path)
+		if rec := serve(c.verb, c.path); rec.Code != http.StatusOK || rec.Body.String() != c.body {
+			t.Fatalf("got %d '%s'", rec.Code, rec.Body)
+		}
+	}
+
+	t.Logf("Scenario: Verbs not bound to a pattern get 405 with the verbs that are")
+	notAllowed(t, adapter, "DELETE", "/api/messages/42", "GET, PUT")
+
+	t.Logf("Scenario: Paths bound to nothing are left to the router")
+	if rec := serve("GET", "/nowhere"); rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d", rec.Code)
+	}
+
+	t.Logf("Scenario: Removed handlers get 405 while the pattern has others and 404 once it has none")
+	adapter.Remove("get", "/api/messages/")
+	notAllowed(t, adapter, "GET", "/api/messages/42", "PUT")
+	adapter.Remove("PUT", "/api/messages/")
+	if rec := serve("PUT", "/api/messages/42"); rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d", rec.Code)
+	}
+}
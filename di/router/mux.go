@@ -0,0 +1,514 @@
+// Package router provides implementations of di.Router: Mux, and Adapter for
+// routers of other packages.
+package router
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// verbMux dispatches requests for a pattern by verb.
+type verbMux struct {
+	mux      *Mux
+	pattern  string
+	handlers map[string]http.Handler
+	tmpl     *template   // set if pattern has variable segments
+	value    interface{} // pattern boxed once for the context of requests
+}
+
+// Wildcard is the verb that registers a handler for every verb of a pattern
+// that has no handler of its own.
+const Wildcard = "*"
+
+// handler returns the handler for verb or nil if there is none. They are looked
+// up in order:
+//
+//	- the handler registered for verb.
+//	- for HEAD, the GET handler unless Mux has DisableAutoHead set.
+//	- the handler registered for Wildcard.
+//	- for OPTIONS, Mux's response unless Mux has DisableAutoOptions set.
+func (m verbMux) handler(verb string) http.Handler {
+	if h := m.handlers[verb]; h != nil {
+		return h
+	}
+	if verb == "HEAD" && !m.mux.DisableAutoHead {
+		if h := m.handlers["GET"]; h != nil {
+			return headHandler{h}
+		}
+	}
+	if h := m.handlers[Wildcard]; h != nil {
+		return h
+	}
+	if verb == "OPTIONS" && !m.mux.DisableAutoOptions {
+		return http.HandlerFunc(m.options)
+	}
+	return nil
+}
+
+// allowed returns the verbs that can be served, sorted. Wildcard is left out.
+func (m verbMux) allowed() []string {
+	verbs := make([]string, 0, len(m.handlers)+2)
+	for _, verb := range []string{"HEAD", "OPTIONS"} {
+		if m.handlers[verb] == nil && m.handler(verb) != nil {
+			verbs = append(verbs, verb)
+		}
+	}
+	for verb := range m.handlers {
+		if verb != Wildcard {
+			verbs = append(verbs, verb)
+		}
+	}
+	sort.Strings(verbs)
+	return verbs
+}
+
+// options responds to an OPTIONS request with the verbs allowed and the CORS
+// headers configured on Mux.
+func (m verbMux) options(rw http.ResponseWriter, req *http.Request) {
+	m.writeOptions(rw, m.allowed())
+}
+
+// writeOptions writes the response to an OPTIONS request for a pattern that
+// allows verbs.
+func (m verbMux) writeOptions(rw http.ResponseWriter, verbs []string) {
+	allowed := strings.Join(verbs, ", ")
+	rw.Header().Set("Allow", allowed)
+	if cors := m.mux.CORS; cors != nil {
+		rw.Header().Set("Access-Control-Allow-Origin", cors.AllowOrigin)
+		rw.Header().Set("Access-Control-Allow-Methods", allowed)
+		headers := cors.AllowHeaders
+		if m.mux.MethodOverride {
+			headers = append(headers[:len(headers):len(headers)], MethodOverrideHeader)
+		}
+		if len(headers) > 0 {
+			rw.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		}
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (m verbMux) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	m.resolve(strings.ToUpper(req.Method)).ServeHTTP(rw, req)
+}
+
+// resolve returns the handler serving verb, which passes requests on with the
+// pattern in their context, or one responding with 405 and the verbs allowed
+// in the Allow header if there is none. It
+// reads the handlers of m, so Mux.mu must be held, but the handler returned
+// does not: Mux serves with it after releasing Mux.mu.
+func (m verbMux) resolve(verb string) http.Handler {
+	h := m.handler(verb)
+	if h == nil {
+		allowed := strings.Join(m.allowed(), ", ")
+		return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			rw.Header().Set("Allow", allowed)
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		})
+	}
+	if verb == "OPTIONS" && m.handlers[verb] == nil && m.handlers[Wildcard] == nil {
+		allowed := m.allowed()
+		h = http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			m.writeOptions(rw, allowed)
+		})
+	}
+	value := m.value
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), patternKey{}, value)))
+	})
+}
+
+type patternKey struct{}
+
+type varsKey struct{}
+
+// Vars returns the values of the variable segments of the pattern that matched
+// req, by name, when called from a handler registered with Mux or Adapter. It
+// returns nil if the pattern has none.
+func Vars(req *http.Request) map[string]string {
+	vars, _ := req.Context().Value(varsKey{}).(map[string]string)
+	return vars
+}
+
+// Pattern returns the pattern that matched req when called from a handler
+// registered with Mux or Adapter. It differs from req.URL.Path for subtree
+// patterns, like "/api/", which match every path below them. It returns "" if
+// req was not routed by either.
+func Pattern(req *http.Request) string {
+	pattern, _ := req.Context().Value(patternKey{}).(string)
+	return pattern
+}
+
+// headHandler serves HEAD requests with a GET handler, discarding the body it
+// writes.
+type headHandler struct {
+	get http.Handler
+}
+
+func (h headHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.get.ServeHTTP(bodyless{rw}, req)
+}
+
+// bodyless is an http.ResponseWriter that discards writes to the body.
+type bodyless struct {
+	http.ResponseWriter
+}
+
+func (w bodyless) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// CORS configures the headers sent in response to preflight OPTIONS requests.
+// Access-Control-Allow-Methods is always the list of verbs allowed.
+type CORS struct {
+	AllowOrigin  string   // Access-Control-Allow-Origin, e.g. "*"
+	AllowHeaders []string // Access-Control-Allow-Headers, omitted if empty
+}
+
+// MethodOverrideHeader names the method a POST request stands for when Mux has
+// MethodOverride set.
+const MethodOverrideHeader = "X-HTTP-Method-Override"
+
+// OverridableMethods are the methods MethodOverrideHeader may name.
+var OverridableMethods = map[string]bool{"PUT": true, "PATCH": true, "DELETE": true}
+
+// overrideMethod returns req with its method replaced by the one named in
+// MethodOverrideHeader if it may be.
+func overrideMethod(req *http.Request) *http.Request {
+	method := strings.ToUpper(req.Header.Get(MethodOverrideHeader))
+	if strings.ToUpper(req.Method) != "POST" || !OverridableMethods[method] {
+		return req
+	}
+	req = req.WithContext(req.Context()) // a shallow copy
+	req.Method = method
+	return req
+}
+
+// DefaultMaxPathLength is the longest request path Mux routes by default.
+const DefaultMaxPathLength = 8192
+
+// Mux implements di.Router on top of http.ServeMux. Its exported fields
+// configure optional behavior and should be set before Mux starts serving.
+type Mux struct {
+	// DisableAutoHead stops HEAD requests from being served by the GET handler
+	// registered for the pattern. A HEAD handler registered explicitly is
+	// always preferred.
+	DisableAutoHead bool
+
+	// DisableAutoOptions stops Mux from responding to OPTIONS requests with
+	// 204 and an Allow header listing the verbs registered for the pattern. An
+	// OPTIONS handler registered explicitly is always preferred.
+	DisableAutoOptions bool
+
+	// CORS, if set, adds CORS headers to the automatic OPTIONS response.
+	CORS *CORS
+
+	// RedirectTrailingSlash redirects requests for a path with a trailing
+	// slash, like "/api/messages/", to the path without it when only the latter
+	// is registered. GET and HEAD requests are redirected with 301 and the
+	// rest with 308 so that clients repeat the request with the same method.
+	//
+	// This is the reverse of http.ServeMux's built-in redirect: a request for
+	// "/api/messages" when only the subtree "/api/messages/" is registered is
+	// always redirected to "/api/messages/" with 301. A registered subtree is
+	// never redirected away from, while this redirect takes precedence over a
+	// broader subtree, like "/api/", that would otherwise match.
+	RedirectTrailingSlash bool
+
+	// MaxPathLength is the length beyond which request paths are rejected
+	// with 414 before routing. It defaults to DefaultMaxPathLength when zero
+	// and is unlimited when negative.
+	MaxPathLength int
+
+	// MethodOverride routes POST requests with a MethodOverrideHeader naming
+	// one of OverridableMethods as requests with that method, for clients
+	// that can only send GET and POST. The header is ignored on other
+	// requests. When CORS is set, the header is allowed in preflight requests.
+	MethodOverride bool
+
+	mu sync.RWMutex
+	// the request chain is Mux -> http.ServeMux -> verbMux
+	// patternMux handles pattern multiplexing and verbMux verbs
+	patternMux *http.ServeMux
+	byPattern  map[string]verbMux // keeps track of verbMux by pattern for registration
+	templates  []verbMux          // patterns with variable segments, in the order registered
+	fallback   http.Handler       // serves requests no pattern matches if set
+	notFound   http.Handler       // serves requests no pattern matches if set and there is no fallback
+}
+
+// New allocates and returns a new Mux.
+func New() *Mux {
+	return &Mux{patternMux: http.NewServeMux(), byPattern: make(map[string]verbMux)}
+}
+
+// Handle registers handler for request matching <verb, pattern>. Any existing
+// handler for those arguments will get overwritten. verb may be Wildcard to
+// handle the verbs of pattern that are not registered. Verbs are matched
+// case-insensitively.
+//
+// Besides the patterns of http.ServeMux, pattern may have variable segments
+// written {name}, matching any segment, or {name:regexp}, matching segments
+// that regexp matches in full, like "/api/messages/{id:[0-9]+}". Their values
+// are available to handlers from Vars. A path that a plain pattern matches
+// exactly is routed by it, otherwise patterns with variables are tried in the
+// order registered before subtree patterns. Handle panics if a variable
+// segment is malformed.
+//
+// Unlike with http.ServeMux, the pattern "/" matches only the path "/" rather
+// than every path no other pattern matches; Fallback handles those.
+func (m *Mux) Handle(verb, pattern string, handler http.Handler) {
+	var tmpl *template
+	if isTemplate(pattern) {
+		tmpl = parseTemplate(pattern)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handle(strings.ToUpper(verb), pattern, tmpl, handler)
+}
+
+// HandleBatch registers every handler register passes to handle as Handle
+// does, all at once: requests are routed by none of them until register has
+// returned, and then by all of them. This lets handlers be registered while
+// Mux is serving without requests seeing half of them. HandleBatch panics
+// before registering any handler if a pattern is malformed.
+func (m *Mux) HandleBatch(register func(handle func(verb, pattern string, handler http.Handler))) {
+	type route struct {
+		verb, pattern string
+		tmpl          *template
+		handler       http.Handler
+	}
+	var batch []route
+	register(func(verb, pattern string, handler http.Handler) {
+		r := route{verb: strings.ToUpper(verb), pattern: pattern, handler: handler}
+		if isTemplate(pattern) {
+			r.tmpl = parseTemplate(pattern)
+		}
+		batch = append(batch, r)
+	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range batch {
+		m.handle(r.verb, r.pattern, r.tmpl, r.handler)
+	}
+}
+
+// handle registers handler for <verb, pattern>. tmpl is pattern parsed if it
+// has variable segments. m.mu must be held.
+func (m *Mux) handle(verb, pattern string, tmpl *template, handler http.Handler) {
+	h, ok := m.byPattern[pattern]
+	if !ok { // pattern not seen before
+		h = verbMux{mux: m, pattern: pattern, handlers: make(map[string]http.Handler), value: pattern}
+		if tmpl != nil {
+			h.tmpl = tmpl
+			m.templates = append(m.templates, h)
+		} else {
+			m.patternMux.Handle(pattern, h) // register verbMux
+		}
+		m.byPattern[pattern] = h
+	}
+	h.handlers[verb] = handler
+}
+
+// HandleFunc registers handler for request matching <verb, pattern>.
+func (m *Mux) HandleFunc(verb, pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.Handle(verb, pattern, http.HandlerFunc(handler))
+}
+
+// Mount registers h for every verb of prefix and the paths below it. h is
+// passed requests with prefix stripped from their path, so that another Mux
+// mounted at "/v1" serves "/v1/api/messages" as "/api/messages" and its own
+// mounts compose. prefix is cleaned of slashes at its ends, so "v1/" is "/v1".
+// Mount panics if prefix is "/": use Fallback to serve every path with h.
+func (m *Mux) Mount(prefix string, h http.Handler) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		panic("router: cannot mount at /")
+	}
+	prefix = "/" + prefix
+	stripped := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		r := req.WithContext(req.Context()) // a shallow copy
+		u := *req.URL
+		u.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+		u.RawPath = ""
+		r.URL = &u
+		h.ServeHTTP(rw, r)
+	})
+	m.Handle(Wildcard, prefix, stripped)
+	m.Handle(Wildcard, prefix+"/", stripped)
+}
+
+// Remove removes the handler registered for <verb, pattern>, if any. Requests
+// for pattern get 405 once other verbs remain registered for it and 404 once
+// none do.
+func (m *Mux) Remove(verb, pattern string) {
+	verb = strings.ToUpper(verb)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// http.ServeMux cannot unregister a pattern, so its verbMux stays behind
+	// and is treated as unregistered when empty.
+	if h, ok := m.byPattern[pattern]; ok {
+		delete(h.handlers, verb)
+	}
+}
+
+// A Route is a verb and pattern a handler is registered for.
+type Route struct {
+	Verb    string // Wildcard for the verbs not registered otherwise
+	Pattern string
+	Handler http.Handler
+}
+
+// Routes returns the routes registered, sorted by pattern and then verb. Those
+// of a Mux mounted with Mount are not listed, only the Wildcard route of its
+// prefix. Handlers Mux serves may call it, as Mux does not hold its lock while
+// they serve.
+func (m *Mux) Routes() []Route {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var routes []Route
+	for pattern, h := range m.byPattern {
+		for verb, handler := range h.handlers {
+			routes = append(routes, Route{verb, pattern, handler})
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Pattern != routes[j].Pattern {
+			return routes[i].Pattern < routes[j].Pattern
+		}
+		return routes[i].Verb < routes[j].Verb
+	})
+	return routes
+}
+
+// registered reports whether any handler is registered for the plain pattern.
+func (m *Mux) registered(pattern string) bool {
+	h := m.byPattern[pattern]
+	return h.tmpl == nil && len(h.handlers) > 0
+}
+
+// SetNotFound sets the handler for requests that match no pattern when there is
+// no Fallback. If it is not set, or set to nil, http.ServeMux's plain text 404
+// is served.
+func (m *Mux) SetNotFound(handler http.Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notFound = handler
+}
+
+// Fallback sets the handler for requests that match no pattern, like a single
+// page application serving index.html for every path. Unlike the handler set
+// with SetNotFound, it is expected to serve content and may respond with any
+// status. Requests are served by the pattern that matches them first, then by
+// the fallback, and only without a fallback by the not found handler. Setting
+// it to nil removes it.
+func (m *Mux) Fallback(handler http.Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fallback = handler
+}
+
+// ServeHTTP dispatches the request to the handler whose verb equals the request
+// Method and whose pattern most closely matches the request URL.
+func (m *Mux) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if max := m.maxPathLength(); max >= 0 && len(req.URL.Path) > max {
+		http.Error(rw, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+		return
+	}
+	if m.MethodOverride {
+		req = overrideMethod(req)
+	}
+
+	h, req := m.resolve(req)
+	h.ServeHTTP(rw, req)
+}
+
+// resolve returns the handler for req and req as it is to be served, with the
+// values of variable segments in its context. It holds m.mu only while
+// resolving, not while the handler serves, so that handlers serving for long,
+// like those of WebSockets or streams, do not keep handlers from being
+// registered, nor requests, queued behind registration, from being served.
+func (m *Mux) resolve(req *http.Request) (http.Handler, *http.Request) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.RedirectTrailingSlash {
+		if h := m.redirectTrailingSlash(req); h != nil {
+			return h, req
+		}
+	}
+	verb := strings.ToUpper(req.Method)
+	if len(m.templates) > 0 && !m.registered(req.URL.Path) {
+		for _, h := range m.templates {
+			if len(h.handlers) == 0 {
+				continue
+			}
+			if vars := h.tmpl.match(req.URL.Path); vars != nil {
+				return h.resolve(verb), req.WithContext(context.WithValue(req.Context(), varsKey{}, vars))
+			}
+		}
+	}
+	if !m.routes(req) {
+		if m.fallback != nil {
+			return m.fallback, req
+		}
+		if m.notFound != nil {
+			return m.notFound, req
+		}
+		return http.NotFoundHandler(), req
+	}
+	h, _ := m.patternMux.Handler(req)
+	if vm, ok := h.(verbMux); ok {
+		return vm.resolve(verb), req
+	}
+	return h, req // a redirect of http.ServeMux
+}
+
+// routes reports whether a plain pattern matches req. A subtree pattern, like
+// "/api/", only matches paths below it, like "/api/unknown", for the verbs it
+// can serve, so that requests for them with other verbs are answered with 404
+// rather than 405. 405 is kept for paths a pattern matches exactly. The
+// pattern "/", which http.ServeMux selects for every path nothing else
+// matches, only matches "/".
+func (m *Mux) routes(req *http.Request) bool {
+	_, pattern := m.patternMux.Handler(req)
+	if pattern == "" || !m.registered(pattern) {
+		return false
+	}
+	if pattern == req.URL.Path {
+		return true
+	}
+	return pattern != "/" && m.byPattern[pattern].handler(strings.ToUpper(req.Method)) != nil
+}
+
+func (m *Mux) maxPathLength() int {
+	if m.MaxPathLength == 0 {
+		return DefaultMaxPathLength
+	}
+	return m.MaxPathLength
+}
+
+// redirectTrailingSlash returns the handler redirecting req to its path without
+// the trailing slash if only the latter is registered, and nil otherwise.
+func (m *Mux) redirectTrailingSlash(req *http.Request) http.Handler {
+	path := req.URL.Path
+	if len(path) < 2 || !strings.HasSuffix(path, "/") {
+		return nil
+	}
+	if m.registered(path) {
+		return nil
+	}
+	canonical := strings.TrimSuffix(path, "/")
+	if !m.registered(canonical) {
+		return nil
+	}
+
+	u := *req.URL
+	u.Path = canonical
+	status := http.StatusPermanentRedirect
+	if req.Method == "GET" || req.Method == "HEAD" {
+		status = http.StatusMovedPermanently
+	}
+	return http.RedirectHandler(u.String(), status)
+}
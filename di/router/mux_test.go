@@ -0,0 +1,389 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAutoHead(t *testing.T) {
+	handler := func(body string) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("X-Handler", body)
+			io.WriteString(rw, body)
+		}
+	}
+	serve := func(mux *Mux) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("HEAD", "/spy/messages", nil))
+		return rec
+	}
+
+	t.Logf("Scenario: HEAD is served by the GET handler without a body")
+	mux := New()
+	mux.Handle("GET", "/spy/messages", handler("get"))
+	rec := serve(mux)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Handler") != "get" || rec.Body.Len() != 0 {
+		t.Fatalf("got status %d, headers %v, body %q", rec.Code, rec.Header(), rec.Body)
+	}
+
+	t.Logf("Scenario: An explicitly registered HEAD handler takes precedence")
+	mux.Handle("HEAD", "/spy/messages", handler("head"))
+	if rec := serve(mux); rec.Header().Get("X-Handler") != "head" {
+		t.Fatalf("got headers %v", rec.Header())
+	}
+
+	t.Logf("Scenario: HEAD is not allowed when automatic HEAD is disabled")
+	mux = New()
+	mux.DisableAutoHead = true
+	mux.Handle("GET", "/spy/messages", handler("get"))
+	if rec := serve(mux); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("got status %d", rec.Code)
+	}
+}
+
+// notAllowed fails t unless verb on path is answered by h with 405 and the
+// verbs allow in the Allow header.
+func notAllowed(t *testing.T, h http.Handler, verb, path, allow string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(verb, path, nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != allow {
+		t.Fatalf("%s %s: got %d and Allow '%s' but expected 405 and '%s'", verb, path, rec.Code, rec.Header().Get("Allow"), allow)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	mux := New()
+	noop := func(http.ResponseWriter, *http.Request) {}
+	mux.HandleFunc("PUT", "/api/messages", noop)
+	mux.HandleFunc("GET", "/api/messages", noop)
+
+	t.Logf("Scenario: Verbs not bound to a pattern get 405 with the verbs that are, sorted")
+	notAllowed(t, mux, "DELETE", "/api/messages", "GET, HEAD, OPTIONS, PUT")
+
+	t.Logf("Scenario: Verbs served automatically are left out once disabled")
+	mux = New()
+	mux.DisableAutoHead, mux.DisableAutoOptions = true, true
+	mux.HandleFunc("PUT", "/api/messages", noop)
+	mux.HandleFunc("GET", "/api/messages", noop)
+	notAllowed(t, mux, "HEAD", "/api/messages", "GET, PUT")
+}
+
+func TestAutoOptions(t *testing.T) {
+	mux := New()
+	mux.CORS = &CORS{AllowOrigin: "*", AllowHeaders: []string{"Content-Type"}}
+	noop := func(http.ResponseWriter, *http.Request) {}
+	mux.HandleFunc("GET", "/api/messages", noop)
+	mux.HandleFunc("POST", "/api/messages", noop)
+
+	t.Logf("Scenario: OPTIONS on a registered path lists its verbs")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("OPTIONS", "/api/messages", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	for header, want := range map[string]string{
+		"Allow":                        "GET, HEAD, OPTIONS, POST",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS, POST",
+		"Access-Control-Allow-Headers": "Content-Type",
+	} {
+		t.Logf("\theader %s: %s", header, want)
+		if got := rec.Header().Get(header); got != want {
+			t.Fatalf("got %q", got)
+		}
+	}
+
+	t.Logf("Scenario: OPTIONS on an unregistered path is not found")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("OPTIONS", "/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d", rec.Code)
+	}
+}
+
+func TestPattern(t *testing.T) {
+	t.Logf("Scenario: A handler can read the pattern that matched the request")
+	var got string
+	mux := New()
+	mux.HandleFunc("GET", "/api/messages/", func(rw http.ResponseWriter, req *http.Request) {
+		got = Pattern(req)
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/messages/42", nil))
+	if got != "/api/messages/" {
+		t.Fatalf("got pattern %q but expected %q", got, "/api/messages/")
+	}
+
+	t.Logf("Scenario: Requests not routed by Mux have no pattern")
+	if got := Pattern(httptest.NewRequest("GET", "/api/messages/42", nil)); got != "" {
+		t.Fatalf("got pattern %q", got)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	mux := New()
+	mux.HandleFunc("GET", "/api/messages", func(http.ResponseWriter, *http.Request) {})
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	t.Logf("Scenario: Unknown paths get http.ServeMux's 404 by default")
+	if rec := serve("/unknown"); rec.Code != http.StatusNotFound || rec.Body.String() != "404 page not found\n" {
+		t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+	}
+
+	t.Logf("Scenario: Unknown paths are served by the handler set with SetNotFound")
+	mux.SetNotFound(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusNotFound)
+		io.WriteString(rw, `{"error": "no route for `+req.URL.Path+`"}`)
+	}))
+	if rec := serve("/unknown"); rec.Code != http.StatusNotFound || rec.Body.String() != `{"error": "no route for /unknown"}` {
+		t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+	}
+	if rec := serve("/api/messages"); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d for a registered path", rec.Code)
+	}
+
+	t.Logf("Scenario: Setting it to nil restores the default")
+	mux.SetNotFound(nil)
+	if rec := serve("/unknown"); rec.Body.String() != "404 page not found\n" {
+		t.Fatalf("got '%s'", rec.Body.String())
+	}
+}
+
+func TestRedirectTrailingSlash(t *testing.T) {
+	mux := New()
+	mux.RedirectTrailingSlash = true
+	noop := func(http.ResponseWriter, *http.Request) {}
+	mux.HandleFunc("GET", "/spy/messages", noop)
+	mux.HandleFunc("POST", "/api/messages", noop)
+
+	for _, c := range []struct {
+		verb, path string
+		status     int
+		location   string
+	}{
+		{"GET", "/spy/messages/?from=kkrs", http.StatusMovedPermanently, "/spy/messages?from=kkrs"},
+		{"POST", "/api/messages/", http.StatusPermanentRedirect, "/api/messages"},
+		{"GET", "/spy/messages", http.StatusOK, ""},
+		{"GET", "/unknown/", http.StatusNotFound, ""},
+	} {
+		t.Logf("Scenario: %s %s responds with %d", c.verb, c.path, c.status)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(c.verb, c.path, nil))
+		if rec.Code != c.status || rec.Header().Get("Location") != c.location {
+			t.Fatalf("got status %d, location %q", rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func TestMaxPathLength(t *testing.T) {
+	mux := New()
+	mux.MaxPathLength = len("/spy/messages")
+	mux.HandleFunc("GET", "/spy/messages", func(http.ResponseWriter, *http.Request) {})
+
+	for path, status := range map[string]int{
+		"/spy/messages":  http.StatusOK,
+		"/spy/messages/": http.StatusRequestURITooLong,
+	} {
+		t.Logf("Scenario: GET %s responds with %d", path, status)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != status {
+			t.Fatalf("got status %d", rec.Code)
+		}
+	}
+}
+
+func TestVerbCase(t *testing.T) {
+	mux := New()
+	mux.HandleFunc("get", "/api/messages", func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusAccepted)
+	})
+
+	t.Logf("Scenario: A handler registered for a lower case verb serves requests")
+	for _, verb := range []string{"GET", "get", "HEAD"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(verb, "/api/messages", nil))
+		t.Logf("\t%s responds with %d", verb, http.StatusAccepted)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("got status %d", rec.Code)
+		}
+	}
+
+	t.Logf("Scenario: Removing it with a lower case verb removes it")
+	mux.Remove("Get", "/api/messages")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/messages", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d", rec.Code)
+	}
+}
+
+func TestSubtreeNotFound(t *testing.T) {
+	mux := New()
+	noop := func(http.ResponseWriter, *http.Request) {}
+	mux.HandleFunc("GET", "/api/", noop)
+
+	for _, c := range []struct {
+		verb, path string
+		status     int
+	}{
+		{"GET", "/api/", http.StatusOK},
+		{"POST", "/api/", http.StatusMethodNotAllowed},
+		{"GET", "/api/unknown", http.StatusOK},
+		{"POST", "/api/unknown", http.StatusNotFound},
+		{"POST", "/elsewhere", http.StatusNotFound},
+	} {
+		t.Logf("Scenario: %s %s under the subtree /api/ responds with %d", c.verb, c.path, c.status)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(c.verb, c.path, nil))
+		if rec.Code != c.status {
+			t.Fatalf("got status %d", rec.Code)
+		}
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	mux := New()
+	mux.MethodOverride = true
+	mux.CORS = &CORS{AllowOrigin: "*"}
+	for _, verb := range []string{"GET", "POST", "DELETE"} {
+		verb := verb
+		mux.HandleFunc(verb, "/api/messages", func(rw http.ResponseWriter, req *http.Request) {
+			io.WriteString(rw, verb)
+		})
+	}
+
+	for _, c := range []struct {
+		verb, override, served string
+	}{
+		{"POST", "DELETE", "DELETE"},
+		{"POST", "delete", "DELETE"},
+		{"POST", "", "POST"},
+		{"POST", "GET", "POST"},
+		{"GET", "DELETE", "GET"},
+	} {
+		t.Logf("Scenario: %s with %s '%s' is served by the %s handler", c.verb, MethodOverrideHeader, c.override, c.served)
+		req := httptest.NewRequest(c.verb, "/api/messages", nil)
+		req.Header.Set(MethodOverrideHeader, c.override)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Body.String() != c.served {
+			t.Fatalf("got served by '%s'", rec.Body.String())
+		}
+	}
+
+	t.Logf("Scenario: Preflight requests allow %s", MethodOverrideHeader)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("OPTIONS", "/api/messages", nil))
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); got != MethodOverrideHeader {
+		t.Fatalf("got Access-Control-Allow-Headers '%s'", got)
+	}
+}
+
+func TestMount(t *testing.T) {
+	inner := New()
+	inner.HandleFunc("GET", "/messages", func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "inner "+req.URL.Path)
+	})
+	inner.HandleFunc("GET", "/", func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "inner root "+req.URL.Path)
+	})
+	mid := New()
+	mid.Mount("/api/", inner)
+	outer := New()
+	outer.Mount("v1", mid)
+
+	for _, c := range []struct {
+		verb, path string
+		status     int
+		body       string
+	}{
+		{"GET", "/v1/api/messages", http.StatusOK, "inner /messages"},
+		{"GET", "/v1/api", http.StatusOK, "inner root /"},
+		{"GET", "/v1/api/", http.StatusOK, "inner root /"},
+		{"POST", "/v1/api/messages", http.StatusMethodNotAllowed, ""},
+		{"GET", "/v1/other", http.StatusNotFound, ""},
+		{"GET", "/api/messages", http.StatusNotFound, ""},
+	} {
+		t.Logf("Scenario: %s %s through two mounts responds with %d", c.verb, c.path, c.status)
+		rec := httptest.NewRecorder()
+		outer.ServeHTTP(rec, httptest.NewRequest(c.verb, c.path, nil))
+		if rec.Code != c.status || c.body != "" && rec.Body.String() != c.body {
+			t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	mux := New()
+	mux.HandleFunc("GET", "/api/messages", func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "api")
+	})
+	mux.SetNotFound(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	index := "<html>app</html>"
+	mux.Fallback(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		io.WriteString(rw, index)
+	}))
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	t.Logf("Scenario: Registered patterns take precedence over the fallback")
+	if rec := serve("/api/messages"); rec.Body.String() != "api" {
+		t.Fatalf("got '%s'", rec.Body.String())
+	}
+
+	t.Logf("Scenario: The fallback serves paths that match no pattern")
+	if rec := serve("/app/settings"); rec.Code != http.StatusOK || rec.Body.String() != index {
+		t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+	}
+
+	t.Logf("Scenario: Without a fallback, the not found handler serves them")
+	mux.Fallback(nil)
+	if rec := serve("/app/settings"); rec.Code != http.StatusNotFound || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRootPattern(t *testing.T) {
+	mux := New()
+	mux.HandleFunc("GET", "/", func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "root")
+	})
+	mux.HandleFunc("GET", "/api/", func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "api")
+	})
+
+	for _, c := range []struct {
+		verb, path string
+		status     int
+		body       string
+	}{
+		{"GET", "/", http.StatusOK, "root"},
+		{"POST", "/", http.StatusMethodNotAllowed, ""},
+		{"GET", "/api/messages", http.StatusOK, "api"},
+		{"GET", "/unrelated", http.StatusNotFound, ""},
+		{"POST", "/unrelated", http.StatusNotFound, ""},
+	} {
+		t.Logf("Scenario: %s %s with a pattern registered at / responds with %d", c.verb, c.path, c.status)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(c.verb, c.path, nil))
+		if rec.Code != c.status || c.body != "" && rec.Body.String() != c.body {
+			t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+		}
+	}
+}
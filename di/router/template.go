@@ -0,0 +1,99 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// template is a pattern with variable segments, like "/api/messages/{id:[0-9]+}".
+type template struct {
+	segments []segment
+}
+
+// segment is a literal segment of a template path or, if name is set, a
+// variable one that re must match.
+type segment struct {
+	literal string
+	name    string
+	re      *regexp.Regexp
+}
+
+// isTemplate reports whether pattern has variable segments.
+func isTemplate(pattern string) bool {
+	return strings.Contains(pattern, "{")
+}
+
+// ValidatePattern reports why pattern cannot be registered with Mux, if it
+// cannot, because a variable segment is malformed. Handle panics with the
+// error; callers that would rather fail, like di.Dispatcher.Register, check
+// patterns first.
+func ValidatePattern(pattern string) error {
+	if !isTemplate(pattern) {
+		return nil
+	}
+	_, err := compileTemplate(pattern)
+	return err
+}
+
+// parseTemplate compiles pattern. It panics if a segment is not well formed
+// as http.ServeMux does for bad patterns.
+func parseTemplate(pattern string) *template {
+	t, err := compileTemplate(pattern)
+	if err != nil {
+		panic("router: " + err.Error())
+	}
+	return t
+}
+
+// compileTemplate compiles pattern, failing if a segment is not well formed.
+func compileTemplate(pattern string) (*template, error) {
+	var t template
+	for _, s := range strings.Split(pattern, "/") {
+		if !strings.HasPrefix(s, "{") {
+			if strings.ContainsAny(s, "{}") {
+				return nil, fmt.Errorf("bad segment %q in pattern %q", s, pattern)
+			}
+			t.segments = append(t.segments, segment{literal: s})
+			continue
+		}
+		if !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("unterminated variable %q in pattern %q", s, pattern)
+		}
+		name, expr := s[1:len(s)-1], ".+"
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, expr = name[:i], name[i+1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("unnamed variable %q in pattern %q", s, pattern)
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("variable %q in pattern %q: %s", s, pattern, err)
+		}
+		t.segments = append(t.segments, segment{name: name, re: re})
+	}
+	return &t, nil
+}
+
+// match returns the variables of path if it matches t and nil otherwise.
+func (t *template) match(path string) map[string]string {
+	parts := strings.Split(path, "/")
+	if len(parts) != len(t.segments) {
+		return nil
+	}
+	vars := make(map[string]string)
+	for i, s := range t.segments {
+		switch {
+		case s.name == "":
+			if parts[i] != s.literal {
+				return nil
+			}
+		case s.re.MatchString(parts[i]):
+			vars[s.name] = parts[i]
+		default:
+			return nil
+		}
+	}
+	return vars
+}
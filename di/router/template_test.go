@@ -0,0 +1,45 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPatternVars(t *testing.T) {
+	mux := New()
+	echo := func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "%s %v", Pattern(req), Vars(req))
+	}
+	mux.HandleFunc("GET", "/api/messages/{id:[0-9]+}", echo)
+	mux.HandleFunc("GET", "/api/messages/{from}/to/{to}", echo)
+	mux.HandleFunc("GET", "/api/messages/stats", echo)
+
+	for _, c := range []struct {
+		desc, path string
+		status     int
+		body       string
+	}{
+		{"a numeric id", "/api/messages/42", http.StatusOK, "/api/messages/{id:[0-9]+} map[id:42]"},
+		{"several variables", "/api/messages/kkrs/to/world", http.StatusOK, "/api/messages/{from}/to/{to} map[from:kkrs to:world]"},
+		{"a path matched exactly by a plain pattern", "/api/messages/stats", http.StatusOK, "/api/messages/stats map[]"},
+		{"an id that is not numeric", "/api/messages/abc", http.StatusNotFound, ""},
+		{"an empty variable segment", "/api/messages//to/world", http.StatusNotFound, ""},
+	} {
+		t.Logf("Scenario: Routing a path with %s", c.desc)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", c.path, nil))
+		if rec.Code != c.status || c.status == http.StatusOK && rec.Body.String() != c.body {
+			t.Fatalf("got status %d and body '%s'", rec.Code, rec.Body)
+		}
+	}
+
+	t.Logf("Scenario: Registering a malformed variable panics")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected a panic")
+		}
+	}()
+	mux.HandleFunc("GET", "/api/messages/{id:[0-9}", echo)
+}
@@ -1,122 +1,1849 @@
 package message
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/kkrs/di"
-	"github.com/kkrs/di/router"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack"
+
+	"golang.org/x/net/context"
+
+	"github.com/kkrs/godi-code/di"
+	"github.com/kkrs/godi-code/di/router"
 )
 
-func HTTPError(rw http.ResponseWriter, status int, err error) {
-	http.Error(rw, fmt.Sprintf(`{"error": "%s"}`, err.Error()), status)
+// HTTPError responds with status and err encoded by ErrorEncoder.
+func HTTPError(rw http.ResponseWriter, status int, err error) {
+	ErrorEncoder(rw, status, err)
+}
+
+// ErrorEncoder responds to requests that failed with err. Every error response
+// of the package goes through it. It defaults to PlainErrorEncoder and may be
+// replaced, like by JSONAPIErrorEncoder, before serving.
+var ErrorEncoder func(rw http.ResponseWriter, status int, err error) = PlainErrorEncoder
+
+// PlainErrorEncoder responds with status and a JSON body of the form
+// {"error": "<message of err>"}.
+func PlainErrorEncoder(rw http.ResponseWriter, status int, err error) {
+	data, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{err.Error()}) // cannot fail for a string
+	writeError(rw, "application/json", status, data)
+}
+
+// JSONAPIErrorEncoder responds with status and a JSON:API error document of the
+// form {"errors": [{"status": "<status>", "detail": "<message of err>"}]}.
+func JSONAPIErrorEncoder(rw http.ResponseWriter, status int, err error) {
+	type jsonAPIError struct {
+		Status string `json:"status"`
+		Detail string `json:"detail"`
+	}
+	data, _ := json.Marshal(struct {
+		Errors []jsonAPIError `json:"errors"`
+	}{[]jsonAPIError{{strconv.Itoa(status), err.Error()}}}) // cannot fail for strings
+	writeError(rw, "application/vnd.api+json", status, data)
+}
+
+// writeError writes the error response body data of contentType with status.
+func writeError(rw http.ResponseWriter, contentType string, status int, data []byte) {
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	rw.Write(data)
+}
+
+// wrap annotates err with what was being done when it occurred. err remains
+// visible to errors.Is and errors.As.
+func wrap(doing string, err error) error {
+	return fmt.Errorf("error %s: %w", doing, err)
+}
+
+// MaxBodySize is the largest request body, in bytes, that Unmarshal and
+// MessageController.Send read. Larger bodies fail with *http.MaxBytesError and
+// are answered with 413.
+var MaxBodySize int64 = 1 << 20
+
+// Unmarshal decodes the JSON in body into dst with Decoder, reading at most
+// MaxBodySize bytes.
+func Unmarshal(body io.Reader, dst interface{}) error {
+	payload, err := readBody(body)
+	if err != nil {
+		return err
+	}
+	return Decoder.Decode(bytes.NewReader(payload), dst)
+}
+
+// A JSONDecoder decodes the JSON value read from r into dst.
+type JSONDecoder interface {
+	Decode(r io.Reader, dst interface{}) error
+}
+
+// A JSONEncoder writes v to w as JSON.
+type JSONEncoder interface {
+	Encode(w io.Writer, v interface{}) error
+}
+
+// Decoder decodes the JSON read by Unmarshal, and so by JSONCodec. It may be
+// replaced, for instance with StdJSON{DisallowUnknownFields: true} for APIs
+// that answer requests with unexpected fields with 400, or with a faster
+// implementation.
+var Decoder JSONDecoder = StdJSON{}
+
+// Encoder encodes the JSON written by JSONCodec. It may be replaced as Decoder
+// can.
+var Encoder JSONEncoder = StdJSON{}
+
+// StdJSON implements JSONDecoder and JSONEncoder with encoding/json.
+type StdJSON struct {
+	// DisallowUnknownFields fails decoding objects with keys that match no
+	// field of dst.
+	DisallowUnknownFields bool
+}
+
+func (sj StdJSON) Decode(r io.Reader, dst interface{}) error {
+	dec := json.NewDecoder(r)
+	if sj.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(dst); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level value")
+	}
+	return nil
+}
+
+func (StdJSON) Encode(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readBody reads at most MaxBodySize bytes of body.
+func readBody(body io.Reader) ([]byte, error) {
+	limit := MaxBodySize
+	payload, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) > limit {
+		return nil, &http.MaxBytesError{Limit: limit}
+	}
+	return payload, nil
+}
+
+// A DecodeFunc decodes a request body into dst.
+type DecodeFunc func(body io.Reader, dst interface{}) error
+
+// Decoders maps the media types of request bodies accepted by Decode to the
+// functions that decode them. Entries may be added to accept more types.
+var Decoders = map[string]DecodeFunc{
+	"application/json":                  Unmarshal,
+	"application/x-www-form-urlencoded": UnmarshalForm,
+}
+
+// UnmarshalForm decodes the form-encoded body, as HTML forms submit, into dst,
+// reading at most MaxBodySize bytes. dst must be a *Message, whose From, To and
+// Message are set from the fields from, to and message. Other values fail with
+// ErrUnsupportedMediaType.
+func UnmarshalForm(body io.Reader, dst interface{}) error {
+	msg, ok := dst.(*Message)
+	if !ok {
+		return fmt.Errorf("%w for %T", ErrUnsupportedMediaType, dst)
+	}
+	payload, err := readBody(body)
+	if err != nil {
+		return err
+	}
+	form, err := url.ParseQuery(string(payload))
+	if err != nil {
+		return err
+	}
+	*msg = Message{From: form.Get("from"), To: form.Get("to"), Message: form.Get("message")}
+	return nil
+}
+
+// A Codec encodes and decodes values in a single media type.
+type Codec interface {
+	Encode(w io.Writer, v interface{}) error
+	Decode(body io.Reader, dst interface{}) error
+}
+
+// JSONCodec is the Codec for application/json. It uses Encoder and Decoder.
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(w io.Writer, v interface{}) error {
+	return Encoder.Encode(w, v)
+}
+
+func (JSONCodec) Decode(body io.Reader, dst interface{}) error {
+	return Unmarshal(body, dst)
+}
+
+// MsgpackCodec is the Codec for application/msgpack.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Encode(w io.Writer, v interface{}) error {
+	return msgpack.NewEncoder(w).Encode(v)
+}
+
+func (MsgpackCodec) Decode(body io.Reader, dst interface{}) error {
+	return msgpack.NewDecoder(body).Decode(dst)
+}
+
+// Codecs maps media types to the Codecs for them. Responses are encoded with
+// the Codec for the first media type in the request's Accept header that has
+// one, and request bodies whose Content-Type has no entry in Decoders are
+// decoded with it. Entries may be added to support more types.
+var Codecs = map[string]Codec{
+	"application/json":    JSONCodec{},
+	"application/msgpack": MsgpackCodec{},
+}
+
+// ErrUnsupportedMediaType is returned by Decode for requests whose Content-Type
+// has no entry in Decoders or Codecs.
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+// ErrEmptyBody is returned by Decode for requests without a body.
+var ErrEmptyBody = errors.New("request body required")
+
+// Decode decodes the body of req into dst using the DecodeFunc in Decoders, or
+// failing that the Codec in Codecs, for its Content-Type. A request without
+// Content-Type is decoded as JSON. A request known to have no body fails with
+// ErrEmptyBody before it is decoded.
+func Decode(req *http.Request, dst interface{}) error {
+	mediaType, err := bodyMediaType(req)
+	if err != nil {
+		return err
+	}
+	if decode, ok := Decoders[mediaType]; ok {
+		return decode(req.Body, dst)
+	}
+	if codec, ok := Codecs[mediaType]; ok {
+		return codec.Decode(req.Body, dst)
+	}
+	return fmt.Errorf("%w %q", ErrUnsupportedMediaType, mediaType)
+}
+
+// bodyMediaType returns the media type of the body of req, JSON if it has no
+// Content-Type, or fails with ErrEmptyBody if req is known to have no body.
+func bodyMediaType(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return "", ErrEmptyBody
+	}
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %s", ErrUnsupportedMediaType, contentType, err)
+	}
+	return mediaType, nil
+}
+
+// decodeBatch decodes the array of messages in the body of req, calling fn
+// with each in turn, and stops with the error fn returns, if any. A JSON array
+// is decoded a message at a time with Decoder, and fn is called for messages
+// longer than MaxItemSize with an error wrapping ErrTooLarge rather than the
+// message. Other media types are decoded whole with Decode.
+func decodeBatch(req *http.Request, fn func(msg Message, err error) error) error {
+	mediaType, err := bodyMediaType(req)
+	if err != nil {
+		return err
+	}
+	if mediaType != "application/json" {
+		var msgs []Message
+		if err := Decode(req, &msgs); err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if err := fn(msg, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(req.Body)
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('[') {
+		return errors.New("expected an array of messages")
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		var msg Message
+		var tooLarge error
+		if len(raw) > MaxItemSize {
+			tooLarge = fmt.Errorf("%w: message is %d bytes, longer than %d", ErrTooLarge, len(raw), MaxItemSize)
+		} else if err := Decoder.Decode(bytes.NewReader(raw), &msg); err != nil {
+			return err
+		}
+		if err := fn(msg, tooLarge); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil { // the closing ]
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level value")
+	}
+	return nil
+}
+
+// negotiate returns the first media type in the Accept header of req that has
+// an entry in Codecs along with its Codec. It falls back to JSON when there is
+// no such media type, including when Accept is missing or "*/*".
+func negotiate(req *http.Request) (string, Codec) {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err != nil {
+			continue
+		}
+		if codec, ok := Codecs[mediaType]; ok {
+			return mediaType, codec
+		}
+	}
+	return "application/json", JSONCodec{}
+}
+
+// respond writes v with status, encoded with the Codec negotiated for req.
+func respond(rw http.ResponseWriter, req *http.Request, status int, v interface{}) {
+	mediaType, data, err := encode(req, v)
+	if err != nil {
+		HTTPError(
+			rw,
+			http.StatusInternalServerError,
+			wrap("encoding response as "+mediaType, err),
+		)
+		return
+	}
+	rw.Header().Set("Content-Type", mediaType)
+	rw.WriteHeader(status)
+	rw.Write(data)
+}
+
+// encode encodes v with the Codec negotiated for req. It returns the media
+// type v is encoded in.
+func encode(req *http.Request, v interface{}) (string, []byte, error) {
+	mediaType, codec := negotiate(req)
+	var buf bytes.Buffer
+	err := codec.Encode(&buf, v)
+	return mediaType, buf.Bytes(), err
+}
+
+// etagMatches reports whether the If-None-Match header value ifNoneMatch
+// matches etag, comparing weakly.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	APIPath    = "/api/messages"
+	SpyPath    = "/spy/messages"
+	DebugPath  = "/debug/transport"
+	HealthPath = "/healthz"
+)
+
+type Message struct {
+	ID      string `datastore:"-"` // assigned by Transport on Send
+	From    string
+	To      string
+	Message string
+	Sent    time.Time // stamped by Send in UTC, to the microsecond
+	Version int       // incremented by every Update, see Updater
+}
+
+// TimeLayouts are the layouts, tried in order, that a Message's Sent time may be
+// decoded from. The defaults accept RFC 3339 with or without fractional
+// seconds, RFC 1123 with a zone name or numeric offset, "2006-01-02 15:04:05"
+// and "2006-01-02", the last two in UTC. Messages are always encoded with RFC
+// 3339.
+var TimeLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC1123,
+	time.RFC1123Z,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// UnmarshalJSON decodes msg from JSON with Decoder, parsing Sent with
+// TimeLayouts.
+func (msg *Message) UnmarshalJSON(data []byte) error {
+	type message Message // without methods to not recurse
+	aux := struct {
+		*message
+		Sent *string
+	}{message: (*message)(msg)}
+	if err := Decoder.Decode(bytes.NewReader(data), &aux); err != nil {
+		return err
+	}
+	if aux.Sent == nil {
+		return nil
+	}
+	for _, layout := range TimeLayouts {
+		if t, err := time.Parse(layout, *aux.Sent); err == nil {
+			msg.Sent = t
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse Sent %q as time", *aux.Sent)
+}
+
+// Clock tells the time. Code that timestamps messages or records reads it
+// through the package clock so that tests can control it with SetClock.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+var clock Clock = realClock{}
+
+// SetClock replaces the clock used by the package, or restores the real one if
+// c is nil. It is meant for tests and should not be called while serving.
+func SetClock(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+	clock = c
+}
+
+// sentNow returns the time to stamp messages sent now with, in UTC and to the
+// microsecond as Datastore keeps it, so that a message reads back as it was
+// returned by Send whichever Transport stores it.
+func sentNow() time.Time {
+	return clock.Now().UTC().Truncate(time.Microsecond)
+}
+
+// Transport represents the ability to send a Message.
+type Transport interface {
+	Send(Message) (string, error)          // Send returns the ID assigned to Message
+	List(MessageFilter) ([]Message, error) // List messages sent, newest first
+}
+
+// MaxAddressSize is the longest From and To, in bytes, that Validate accepts.
+const MaxAddressSize = 256
+
+// MaxMessageSize is the longest Message, in bytes, that Validate accepts. It
+// bounds single messages well below MaxBodySize, which bounds batches too.
+var MaxMessageSize = 64 << 10
+
+// MaxItemSize is the longest message of a JSON batch, in bytes as encoded,
+// that SendBatch and Import decode. It leaves room for a Message of
+// MaxMessageSize with a From and To of MaxAddressSize.
+var MaxItemSize = MaxMessageSize + 2*MaxAddressSize + 1024
+
+// Validate reports why msg cannot be sent, if it cannot, with an error that
+// wraps ErrInvalid and names the field at fault.
+func (msg Message) Validate() error {
+	switch {
+	case msg.From == "":
+		return fmt.Errorf("%w: message has no From", ErrInvalid)
+	case msg.To == "":
+		return fmt.Errorf("%w: message has no To", ErrInvalid)
+	case len(msg.From) > MaxAddressSize:
+		return fmt.Errorf("%w: From is %d bytes, longer than %d", ErrInvalid, len(msg.From), MaxAddressSize)
+	case len(msg.To) > MaxAddressSize:
+		return fmt.Errorf("%w: To is %d bytes, longer than %d", ErrInvalid, len(msg.To), MaxAddressSize)
+	case len(msg.Message) > MaxMessageSize:
+		return fmt.Errorf("%w: Message is %d bytes, longer than %d", ErrInvalid, len(msg.Message), MaxMessageSize)
+	}
+	return nil
+}
+
+// BatchSender is implemented by Transports that can send several messages at
+// once more efficiently than one at a time.
+type BatchSender interface {
+	// SendBatch returns the IDs assigned to msgs. If some of msgs are not
+	// sent, it returns a BatchError.
+	SendBatch(msgs []Message) ([]string, error)
+}
+
+// BatchError holds an error for each message of a batch, nil for those that
+// were sent.
+type BatchError []error
+
+func (e BatchError) Error() string {
+	var failed []string
+	for i, err := range e {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("message %d: %s", i, err))
+		}
+	}
+	return strings.Join(failed, "; ")
+}
+
+// sendBatch sends msgs with tr and returns the ID assigned to and error of
+// each.
+func sendBatch(tr Transport, msgs []Message) ([]string, []error) {
+	errs := make([]error, len(msgs))
+	if bs, ok := tr.(BatchSender); ok {
+		ids, err := bs.SendBatch(msgs)
+		var batchErr BatchError
+		switch {
+		case errors.As(err, &batchErr) && len(batchErr) == len(msgs):
+			copy(errs, batchErr)
+		case err != nil:
+			for i := range errs {
+				errs[i] = err
+			}
+		}
+		if len(ids) != len(msgs) {
+			ids = make([]string, len(msgs))
+		}
+		return ids, errs
+	}
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i], errs[i] = tr.Send(msg)
+	}
+	return ids, errs
+}
+
+// sendBatchError is sendBatch returning the errors of messages as a
+// BatchError, or nil if every message was sent, as BatchSenders do.
+func sendBatchError(tr Transport, msgs []Message) ([]string, error) {
+	ids, errs := sendBatch(tr, msgs)
+	for _, err := range errs {
+		if err != nil {
+			return ids, BatchError(errs)
+		}
+	}
+	return ids, nil
+}
+
+// update updates the message with id with tr if tr is an Updater and fails with
+// ErrUpdateUnsupported otherwise.
+func update(tr Transport, id string, msg Message, ifVersion int) error {
+	up, ok := tr.(Updater)
+	if !ok {
+		return ErrUpdateUnsupported
+	}
+	return up.Update(id, msg, ifVersion)
+}
+
+// Getter is implemented by Transports that can look up a message by ID without
+// listing every message.
+type Getter interface {
+	// Get returns the message with id, failing with ErrNotFound if there is
+	// none.
+	Get(id string) (Message, error)
+}
+
+// getMessage returns the message tr has with id with Get if tr is a Getter and
+// by listing messages otherwise.
+func getMessage(tr Transport, id string) (Message, error) {
+	if g, ok := tr.(Getter); ok {
+		return g.Get(id)
+	}
+	msgs, err := tr.List(MessageFilter{})
+	if err != nil {
+		return Message{}, err
+	}
+	for _, msg := range msgs {
+		if msg.ID == id {
+			return msg, nil
+		}
+	}
+	return Message{}, ErrNotFound
+}
+
+// A Searcher is a Transport that can search the text of messages itself, as
+// with an index, rather than have them all listed to be searched.
+type Searcher interface {
+	// Search returns the messages whose Message contains q, ignoring case,
+	// newest first.
+	Search(q string) ([]Message, error)
+}
+
+// search returns the messages tr has that filter selects and whose Message
+// contains q, ignoring case. It uses Search if tr is a Searcher and searches
+// the result of List otherwise.
+func search(tr Transport, q string, filter MessageFilter) ([]Message, error) {
+	var msgs []Message
+	var err error
+	if s, ok := tr.(Searcher); ok {
+		msgs, err = s.Search(q)
+	} else {
+		msgs, err = tr.List(filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	found := []Message{}
+	for _, msg := range msgs {
+		if filter.Match(msg) && matchesQuery(msg, q) {
+			found = append(found, msg)
+		}
+	}
+	return found, nil
+}
+
+// matchesQuery reports whether the Message of msg contains q, ignoring case, as
+// Searchers match messages.
+func matchesQuery(msg Message, q string) bool {
+	return strings.Contains(strings.ToLower(msg.Message), strings.ToLower(q))
+}
+
+// Streamer is implemented by Transports that can list messages one at a time
+// rather than hold them all in memory.
+type Streamer interface {
+	// ListStream passes the messages selected by filter to fn, newest first.
+	// It stops at and returns the first error fn returns.
+	ListStream(filter MessageFilter, fn func(Message) error) error
+}
+
+// listStream passes the messages tr lists to fn with ListStream if tr is a
+// Streamer and from the result of List otherwise.
+func listStream(tr Transport, filter MessageFilter, fn func(Message) error) error {
+	if s, ok := tr.(Streamer); ok {
+		return s.ListStream(filter, fn)
+	}
+	msgs, err := tr.List(filter)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscriber is implemented by Transports that can notify of messages as they
+// are sent.
+type Subscriber interface {
+	// Subscribe returns a channel receiving the messages sent from now on and
+	// a function ending the subscription, which closes the channel.
+	Subscribe() (<-chan Message, func())
+}
+
+// An Updater is a Transport whose messages can be edited.
+type Updater interface {
+	// Update replaces the From, To and Message of the message with id by
+	// those of msg, keeping its Sent time, if it is at Version ifVersion. It
+	// fails with ErrPreconditionFailed if the message is at another Version,
+	// and with ErrNotFound if there is none. The message updated is at
+	// Version ifVersion+1.
+	Update(id string, msg Message, ifVersion int) error
+}
+
+// ErrPreconditionFailed is returned, possibly wrapped, by Updaters asked to
+// update a message that was updated since the version the caller knows of.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrUpdateUnsupported is the error of updating messages sent through a
+// Transport that is not an Updater.
+var ErrUpdateUnsupported = errors.New("updating messages is not supported")
+
+// ErrNotFound is returned, possibly wrapped, by Transports asked for a message
+// they do not have.
+var ErrNotFound = errors.New("not found")
+
+// ErrInvalid is returned, possibly wrapped, by Transports for messages they
+// reject as invalid, and by Message.Validate.
+var ErrInvalid = errors.New("invalid")
+
+// ErrTooLarge is the error, wrapped, of the messages of a batch longer than
+// MaxItemSize.
+var ErrTooLarge = errors.New("too large")
+
+// ErrListUnsupported is returned by Transports that cannot list messages.
+var ErrListUnsupported = errors.New("listing messages is not supported")
+
+// ErrSubscribeUnsupported is the error of watching messages sent through a
+// Transport that is not a Subscriber.
+var ErrSubscribeUnsupported = errors.New("subscribing to messages is not supported")
+
+// ErrNoTenant is returned by the Transports of requests that do not name a
+// tenant when one is required.
+var ErrNoTenant = errors.New("no tenant in header " + TenantHeader)
+
+// TenantHeader names the tenant whose Transport serves a request.
+const TenantHeader = "X-Tenant-ID"
+
+// StatusClientClosedRequest is the status, not defined by HTTP, logged for
+// requests abandoned because the client went away before they were served.
+const StatusClientClosedRequest = 499
+
+// statusFor returns the status to respond with when a Transport fails with err,
+// classifying it by the sentinel errors of the package it wraps. Other errors
+// are the failure of the server.
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalid), errors.Is(err, ErrNoTenant):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrListUnsupported), errors.Is(err, ErrSubscribeUnsupported), errors.Is(err, ErrUpdateUnsupported):
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// MessageFilter selects the messages listed by Transport. Empty fields select
+// every message.
+type MessageFilter struct {
+	From  string
+	To    string
+	Since time.Time // selects messages Sent after it, for polling
+}
+
+// Match reports whether msg is selected by the filter.
+func (f MessageFilter) Match(msg Message) bool {
+	return (f.From == "" || f.From == msg.From) && (f.To == "" || f.To == msg.To) &&
+		(f.Since.IsZero() || msg.Sent.After(f.Since))
+}
+
+// NextSinceHeader holds, in responses to List, the since marker to poll with
+// for the messages sent after those listed.
+const NextSinceHeader = "X-Next-Since"
+
+// parseSince returns the time marker stands for: the Sent time of the message
+// tr has with ID marker, or else marker parsed as RFC 3339. It fails with
+// ErrInvalid if marker is neither.
+func parseSince(tr Transport, marker string) (time.Time, error) {
+	msg, err := getMessage(tr, marker)
+	if err == nil {
+		return msg.Sent, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return time.Time{}, err
+	}
+	t, perr := time.Parse(time.RFC3339Nano, marker)
+	if perr != nil {
+		return time.Time{}, fmt.Errorf("%w: since %q is neither the ID of a message nor an RFC 3339 time", ErrInvalid, marker)
+	}
+	return t, nil
+}
+
+// nextSince sets NextSinceHeader to the Sent time of newest, the first message
+// listed, or to since if no message was.
+func nextSince(rw http.ResponseWriter, newest *Message, since time.Time) {
+	next := since
+	if newest != nil {
+		next = newest.Sent
+	}
+	if !next.IsZero() {
+		rw.Header().Set(NextSinceHeader, next.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	transportKey
+)
+
+// RequestIDHeader carries the id of a request, echoed in the response, that
+// prefixes what is logged while serving it.
+const RequestIDHeader = "X-Request-ID"
+
+// WithRequestID returns a copy of ctx carrying the id of the request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestIDFromContext returns the id stored by WithRequestID or "" if there
+// is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithTransport returns a copy of ctx carrying tr, the Transport of the
+// request, so that Middleware having built it can share it with the factory
+// rather than have it built again.
+func WithTransport(ctx context.Context, tr Transport) context.Context {
+	return context.WithValue(ctx, transportKey, tr)
+}
+
+// TransportFromContext returns the Transport stored by WithTransport. It
+// reports false if there is none.
+func TransportFromContext(ctx context.Context) (Transport, bool) {
+	tr, ok := ctx.Value(transportKey).(Transport)
+	return tr, ok
+}
+
+// TransportStats describes the messages held by a Transport.
+type TransportStats struct {
+	Count    int       // messages stored
+	Capacity int       // messages that can be stored without growing
+	Oldest   time.Time // when the oldest message was sent
+	Newest   time.Time // when the newest message was sent
+}
+
+// Inspector is implemented by Transports that can report on their internal
+// state for debugging.
+type Inspector interface {
+	Stats() TransportStats
+}
+
+// A Wrapper is a Transport delegating to another, like RetryTransport. Unwrap
+// returns the Transport it delegates to. Wrappers implement the optional
+// interfaces whose methods can fail, like Getter and Updater, themselves, and
+// the Subscriber, Inspector or Pinger of a Transport are found through the
+// Wrappers of it, so that wrapping a Transport hides none of them.
+type Wrapper interface {
+	Transport
+	Unwrap() Transport
+}
+
+// unwrap returns tr, or the first Transport it wraps through Wrappers, that has
+// the capability is reports, and false if there is none.
+func unwrap(tr Transport, is func(Transport) bool) (Transport, bool) {
+	for {
+		if is(tr) {
+			return tr, true
+		}
+		w, ok := tr.(Wrapper)
+		if !ok {
+			return nil, false
+		}
+		tr = w.Unwrap()
+	}
+}
+
+// MessageController handles requests to send and list messages.
+type MessageController struct {
+	Transport   Transport        // dependency injected
+	Logger      *log.Logger      // dependency injected, logs nothing if nil
+	Idempotency IdempotencyStore // dependency injected, IdempotencyKeyHeader is ignored if nil
+}
+
+// logf logs through Logger if there is one.
+func (ct MessageController) logf(format string, args ...interface{}) {
+	if ct.Logger != nil {
+		ct.Logger.Printf(format, args...)
+	}
+}
+
+// MessageController specifies how its methods should be bound.
+func (MessageController) Bindings() []di.Binding {
+	return []di.Binding{
+		{Verb: "POST", Path: APIPath, Name: "Send"},                 // POST:/api/messages -> Send
+		{Verb: "POST", Path: APIPath + "/batch", Name: "SendBatch"}, // POST:/api/messages/batch -> SendBatch
+		{Verb: "POST", Path: APIPath + "/import", Name: "Import"},   // POST:/api/messages/import -> Import
+		{Verb: "GET", Path: APIPath + "/{id}", Name: "Get"},         // GET:/api/messages/{id} -> Get
+		{Verb: "PUT", Path: APIPath + "/{id}", Name: "Update"},      // PUT:/api/messages/{id} -> Update
+		{Verb: "GET", Path: SpyPath, Name: "List"},                  // GET:/spy/messages -> List
+		{Verb: "GET", Path: SpyPath + "/stream", Name: "Watch"},     // GET:/spy/messages/stream -> Watch
+	}
+}
+
+// Send processes the request and delegates the task of sending the message to
+// Transport. The message is sent from the Principal the request was
+// authenticated as, if any. It responds with 201, the URI of the message in
+// Location and the message as stored, including the ID and Sent time assigned
+// to it, encoded as negotiated with the Accept header. Messages that fail
+// Validate, like those without To or with a field longer than MaxAddressSize
+// or MaxMessageSize, are answered with 400 naming the field.
+//
+// A dry run, requested with the query parameter dryRun or the DryRunHeader set
+// to true, validates the message as a real one is without sending it and
+// responds with 200 and the message as it would have been stored, without an
+// ID.
+//
+// A request with an IdempotencyKeyHeader is sent once: requests with the same
+// key, from the same Principal, are answered with the response to the first
+// one until Idempotency forgets it, or with 409 while it is in progress. Those
+// sending another message than the first one are answered with 422, and keys
+// longer than MaxIdempotencyKeySize with 400.
+func (ct MessageController) Send(rw http.ResponseWriter, req *http.Request) {
+	var msg Message
+	req.Body = http.MaxBytesReader(rw, req.Body, MaxBodySize)
+	if err := Decode(req, &msg); err != nil {
+		HTTPError(
+			rw,
+			decodeStatus(err),
+			wrap("reading request", err),
+		)
+		return
+	}
+
+	msg.ID, msg.Sent = "", sentNow()
+	if name := principal(req); name != "" {
+		msg.From = name // rather than trust the client
+	}
+	if err := msg.Validate(); err != nil {
+		HTTPError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if dryRun(req) {
+		respond(rw, req, http.StatusOK, msg)
+		return
+	}
+	if key := req.Header.Get(IdempotencyKeyHeader); key != "" && ct.Idempotency != nil {
+		if len(key) > MaxIdempotencyKeySize {
+			err := fmt.Errorf("%s is %d bytes, longer than %d", IdempotencyKeyHeader, len(key), MaxIdempotencyKeySize)
+			HTTPError(rw, http.StatusBadRequest, err)
+			return
+		}
+		ct.sendOnce(rw, req, principal(req)+" "+key, msg)
+		return
+	}
+	ct.send(rw, req, msg)
 }
 
-func Unmarshal(body io.Reader, dst interface{}) error {
-	payload, err := ioutil.ReadAll(body)
+func (ct MessageController) send(rw http.ResponseWriter, req *http.Request, msg Message) {
+	id, err := ct.Transport.Send(msg)
 	if err != nil {
-		return err
+		err = wrap("sending message", err)
+		ct.logf("%s", err)
+		HTTPError(rw, statusFor(err), err)
+		return
 	}
-	if err := json.Unmarshal(payload, dst); err != nil {
-		return err
+	msg.ID = id
+	rw.Header().Set("Location", APIPath+"/"+url.PathEscape(id))
+	respond(rw, req, http.StatusCreated, msg)
+}
+
+// sendOnce sends msg unless a request with key was made before, in which case
+// it replays the response to it. Responses with 5xx are forgotten, as are
+// requests whose Transport panics, so that the request can be retried.
+func (ct MessageController) sendOnce(rw http.ResponseWriter, req *http.Request, key string, msg Message) {
+	unsent := msg
+	unsent.Sent = time.Time{} // which differs between retries
+	hash := contentHash(unsent)
+	claimed, err := ct.Idempotency.SetNX(key, IdempotentResponse{RequestHash: hash[:]})
+	if err != nil {
+		HTTPError(rw, http.StatusInternalServerError, wrap("claiming idempotency key", err))
+		return
 	}
-	return nil
+	if !claimed {
+		stored, ok, err := ct.Idempotency.Get(key)
+		switch {
+		case err != nil:
+			HTTPError(rw, http.StatusInternalServerError, wrap("getting idempotent response", err))
+		case ok && len(stored.RequestHash) > 0 && !bytes.Equal(stored.RequestHash, hash[:]):
+			HTTPError(rw, http.StatusUnprocessableEntity, errors.New("a request with the same "+IdempotencyKeyHeader+" sent another message"))
+		case !ok || stored.Status == 0:
+			HTTPError(rw, http.StatusConflict, errors.New("a request with the same "+IdempotencyKeyHeader+" is in progress"))
+		default:
+			stored.replay(rw)
+		}
+		return
+	}
+
+	stored := false
+	defer func() {
+		// release the claim unless the response was stored, even if send
+		// panics, or retries would get 409 until the claim expires
+		if stored {
+			return
+		}
+		if err := ct.Idempotency.Delete(key); err != nil {
+			ct.logf("%s", wrap("releasing idempotency key", err))
+		}
+	}()
+	rec := newBodyRecorder(rw)
+	ct.send(rec, req, msg)
+	if rec.Status() >= http.StatusInternalServerError {
+		return
+	}
+	err = ct.Idempotency.Set(key, IdempotentResponse{
+		Status:      rec.Status(),
+		Location:    rw.Header().Get("Location"),
+		ContentType: rw.Header().Get("Content-Type"),
+		Body:        rec.body.Bytes(),
+		RequestHash: hash[:],
+	})
+	if err != nil {
+		ct.logf("%s", wrap("storing idempotent response", err))
+		return
+	}
+	stored = true
 }
 
-var (
-	APIPath = "/api/messages"
-	SpyPath = "/spy/messages"
-)
+// IdempotencyKeyHeader carries the key identifying a request to send a message
+// and its retries.
+const IdempotencyKeyHeader = "Idempotency-Key"
 
-type Message struct {
-	From    string
-	To      string
-	Message string
+// MaxIdempotencyKeySize is the longest IdempotencyKeyHeader, in bytes, that Send
+// accepts.
+const MaxIdempotencyKeySize = 255
+
+// IdempotentReplayHeader is set to true on responses replayed for a request
+// with an IdempotencyKeyHeader seen before.
+const IdempotentReplayHeader = "Idempotent-Replayed"
+
+// IdempotentResponse is the response to a request with an IdempotencyKeyHeader.
+// One without Status marks a request still in progress.
+type IdempotentResponse struct {
+	Status      int
+	Location    string
+	ContentType string
+	Body        []byte
+	RequestHash []byte // identifies the message the request sent
 }
 
-// Transport represents the ability to send a Message.
-type Transport interface {
-	Send(Message) error
-	List() ([]Message, error) // List messages sent
+func (r IdempotentResponse) replay(rw http.ResponseWriter) {
+	if r.Location != "" {
+		rw.Header().Set("Location", r.Location)
+	}
+	rw.Header().Set("Content-Type", r.ContentType)
+	rw.Header().Set(IdempotentReplayHeader, "true")
+	rw.WriteHeader(r.Status)
+	rw.Write(r.Body)
 }
 
-// MessageController handles requests to send and list messages.
-type MessageController struct {
-	Transport Transport // dependency injected
+// An IdempotencyStore remembers IdempotentResponses by key for as long as it is
+// configured to. Stores must be safe for concurrent use.
+type IdempotencyStore interface {
+	// Get returns the response stored for key and whether there is one.
+	Get(key string) (IdempotentResponse, bool, error)
+	// SetNX stores resp for key unless there is a response for it already,
+	// atomically, and reports whether it did.
+	SetNX(key string, resp IdempotentResponse) (bool, error)
+	// Set stores resp for key, replacing any response there is.
+	Set(key string, resp IdempotentResponse) error
+	// Delete forgets the response for key.
+	Delete(key string) error
 }
 
-// MessageController specifies how its methods should be bound.
-func (MessageController) Bindings() []di.Binding {
-	return []di.Binding{
-		{"POST", APIPath, "Send"}, // POST:/api/messages -> Send
-		{"GET", SpyPath, "List"},  // GET:/spy/messages -> List
+// DryRunHeader requests a dry run of Send when set to true.
+const DryRunHeader = "X-Dry-Run"
+
+// dryRun reports whether req asks for a dry run.
+func dryRun(req *http.Request) bool {
+	for _, v := range []string{req.URL.Query().Get("dryRun"), req.Header.Get(DryRunHeader)} {
+		if ok, _ := strconv.ParseBool(v); ok {
+			return true
+		}
 	}
+	return false
 }
 
-// Send processes the request and delegates the task of sending the message to
-// Transport.
-func (ct MessageController) Send(rw http.ResponseWriter, req *http.Request) {
+// principal returns the name of the Principal req was authenticated as, or ""
+// if it was not.
+func principal(req *http.Request) string {
+	p, _ := di.PrincipalFromContext(req)
+	return p.Name
+}
+
+// decodeStatus returns the status to respond with when Decode fails with err.
+func decodeStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	case errors.As(err, &tooLarge), errors.Is(err, ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// MaxBatchSize is the most messages SendBatch accepts in a request.
+var MaxBatchSize = 500
+
+// BatchResult reports the outcome of sending one message of a batch.
+type BatchResult struct {
+	Status int    // as if the message had been sent alone
+	ID     string `json:",omitempty"` // assigned to the message if it was sent
+	Error  string `json:",omitempty"` // why the message was not sent
+}
+
+// ProcessedHeader holds, in the 413 responses to SendBatch and Import for JSON
+// batches longer than MaxBodySize, how many messages were processed: those
+// read before the limit, which the response reports on as it would otherwise.
+// The rest of the body is not read and the connection is closed.
+const ProcessedHeader = "X-Processed-Count"
+
+// truncated reports whether decoding a batch failed with err because its body
+// is longer than MaxBodySize after n messages were decoded, in which case they
+// are processed and the response is 413 with ProcessedHeader.
+func truncated(err error, n int) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge) && n > 0
+}
+
+// SendBatch sends the array of messages in the request body, with the
+// Transport's SendBatch if it is a BatchSender and one at a time otherwise.
+// Messages are sent from the authenticated Principal as by Send, and those
+// without From or To are not sent, nor are JSON ones longer than MaxItemSize,
+// which are not even decoded. It responds with a BatchResult per message, in
+// the order sent, with 201 if every message was sent and 207 otherwise, or 413
+// if the batch was cut short at MaxBodySize, as ProcessedHeader tells.
+func (ct MessageController) SendBatch(rw http.ResponseWriter, req *http.Request) {
+	var msgs []Message
+	var decodeErrs []error // of msgs
+	req.Body = http.MaxBytesReader(rw, req.Body, MaxBodySize)
+	err := decodeBatch(req, func(msg Message, err error) error {
+		msgs, decodeErrs = append(msgs, msg), append(decodeErrs, err)
+		return nil
+	})
+	partial := truncated(err, len(msgs))
+	if err != nil && !partial {
+		HTTPError(
+			rw,
+			decodeStatus(err),
+			wrap("reading request", err),
+		)
+		return
+	}
+	if len(msgs) == 0 || len(msgs) > MaxBatchSize {
+		HTTPError(
+			rw,
+			http.StatusBadRequest,
+			fmt.Errorf("batch of %d messages, expected 1 to %d", len(msgs), MaxBatchSize),
+		)
+		return
+	}
+
+	results := make([]BatchResult, len(msgs))
+	var valid []Message
+	var indexes []int // of valid in msgs
+	now, from := sentNow(), principal(req)
+	for i, msg := range msgs {
+		if err := decodeErrs[i]; err != nil {
+			results[i] = BatchResult{Status: statusFor(err), Error: err.Error()}
+			continue
+		}
+		if from != "" {
+			msg.From = from
+		}
+		if err := msg.Validate(); err != nil {
+			results[i] = BatchResult{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		msg.ID, msg.Sent = "", now
+		valid = append(valid, msg)
+		indexes = append(indexes, i)
+	}
+	ids, errs := sendBatch(ct.Transport, valid)
+	for j, i := range indexes {
+		if errs[j] != nil {
+			results[i] = BatchResult{Status: statusFor(errs[j]), Error: wrap("sending message", errs[j]).Error()}
+			continue
+		}
+		results[i] = BatchResult{Status: http.StatusCreated, ID: ids[j]}
+	}
+
+	status := http.StatusCreated
+	for _, result := range results {
+		if result.Status != http.StatusCreated {
+			status = http.StatusMultiStatus
+		}
+	}
+	if partial {
+		rw.Header().Set(ProcessedHeader, strconv.Itoa(len(msgs)))
+		status = http.StatusRequestEntityTooLarge
+	}
+	respond(rw, req, status, results)
+}
+
+// ImportSummary is the response to MessageController.Import.
+type ImportSummary struct {
+	Imported int      // messages stored
+	Skipped  int      // messages already stored, with onConflict=skip
+	Failed   int      // messages the Transport failed to store
+	Errors   []string `json:",omitempty"` // why messages failed, in order
+}
+
+// Import stores the array of messages in the request body, as exported by
+// List, for seeding environments and restoring backups. Unlike SendBatch,
+// messages keep their From and Sent, the time of the import if they have none,
+// and are sent with the Transport's SendBatch if it is a BatchSender. Like
+// every Binding, it requires authentication when the Dispatcher has an
+// Authenticator.
+//
+// Every message must be valid or none is imported and it responds with 400,
+// or with 413 if a JSON one is longer than MaxItemSize. A JSON batch longer
+// than MaxBodySize has the messages before the limit imported, and the
+// ImportSummary of them with 413 and ProcessedHeader.
+// A message conflicts if it has the ID of a message the Transport lists, or
+// the same From, To, Message and Sent as one it lists or as an earlier message
+// of the request. With the query parameter onConflict=error, the default, a
+// conflict fails the import with 409; with onConflict=skip, conflicting
+// messages are skipped. It responds with an ImportSummary, with 200 if no
+// message failed and 207 otherwise.
+func (ct MessageController) Import(rw http.ResponseWriter, req *http.Request) {
+	onConflict := req.URL.Query().Get("onConflict")
+	if onConflict == "" {
+		onConflict = "error"
+	}
+	if onConflict != "error" && onConflict != "skip" {
+		HTTPError(rw, http.StatusBadRequest, fmt.Errorf("onConflict %q, expected error or skip", onConflict))
+		return
+	}
+	var msgs []Message
+	req.Body = http.MaxBytesReader(rw, req.Body, MaxBodySize)
+	err := decodeBatch(req, func(msg Message, err error) error {
+		if err != nil {
+			return fmt.Errorf("message %d: %w", len(msgs), err)
+		}
+		msgs = append(msgs, msg)
+		return nil
+	})
+	partial := truncated(err, len(msgs))
+	if err != nil && !partial {
+		HTTPError(
+			rw,
+			decodeStatus(err),
+			wrap("reading request", err),
+		)
+		return
+	}
+	for i, msg := range msgs {
+		if err := msg.Validate(); err != nil {
+			HTTPError(rw, http.StatusBadRequest, wrap(fmt.Sprintf("validating message %d", i), err))
+			return
+		}
+	}
+
+	stored, err := ct.Transport.List(MessageFilter{})
+	if err != nil {
+		HTTPError(
+			rw,
+			statusFor(err),
+			wrap("getting messages", err),
+		)
+		return
+	}
+	ids := make(map[string]bool, len(stored))
+	seen := make(map[[sha256.Size]byte]bool, len(stored)+len(msgs))
+	for _, msg := range stored {
+		ids[msg.ID] = true
+		seen[contentHash(msg)] = true
+	}
+	var summary ImportSummary
+	var imports []Message
+	now := sentNow()
+	for i, msg := range msgs {
+		if msg.Sent.IsZero() {
+			msg.Sent = now
+		}
+		hash := contentHash(msg)
+		if msg.ID != "" && ids[msg.ID] || seen[hash] {
+			if onConflict == "error" {
+				HTTPError(rw, http.StatusConflict, fmt.Errorf("message %d is already stored", i))
+				return
+			}
+			summary.Skipped++
+			continue
+		}
+		seen[hash] = true
+		msg.ID = ""
+		imports = append(imports, msg)
+	}
+
+	status := http.StatusOK
+	var errs []error
+	if len(imports) > 0 {
+		_, errs = sendBatch(ct.Transport, imports)
+	}
+	for _, err := range errs {
+		if err != nil {
+			summary.Failed++
+			summary.Errors = append(summary.Errors, wrap("sending message", err).Error())
+			status = http.StatusMultiStatus
+			continue
+		}
+		summary.Imported++
+	}
+	if partial {
+		rw.Header().Set(ProcessedHeader, strconv.Itoa(len(msgs)))
+		status = http.StatusRequestEntityTooLarge
+	}
+	respond(rw, req, status, summary)
+}
+
+// contentHash identifies msg by its From, To, Message and Sent, to the
+// microsecond as Datastore keeps it.
+func contentHash(msg Message) [sha256.Size]byte {
+	sent := msg.Sent.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)
+	return sha256.Sum256([]byte(strings.Join([]string{msg.From, msg.To, msg.Message, sent}, "\x00")))
+}
+
+// Get responds with the message whose ID is the last segment of the path, the
+// URI Send responds with in Location, or with 404 if there is none. The ETag of
+// the response identifies the Version of the message, for Update.
+func (ct MessageController) Get(rw http.ResponseWriter, req *http.Request) {
+	id := router.Vars(req)["id"]
+	msg, err := getMessage(ct.Transport, id)
+	if err != nil {
+		HTTPError(
+			rw,
+			statusFor(err),
+			wrap(fmt.Sprintf("getting message %q", id), err),
+		)
+		return
+	}
+	rw.Header().Set("ETag", versionETag(msg.Version))
+	respond(rw, req, http.StatusOK, msg)
+}
+
+// Update replaces the From, To and Message of the message whose ID is the last
+// segment of the path with those of the message in the request body, if the
+// Transport is an Updater. The request must carry in If-Match the ETag Get
+// responded with, so that concurrent edits are not lost: it is answered with
+// 428 without If-Match and with 412 if the message was updated since. It
+// responds with 200 and the message as updated, with its new ETag.
+func (ct MessageController) Update(rw http.ResponseWriter, req *http.Request) {
+	id := router.Vars(req)["id"]
+	up, ok := ct.Transport.(Updater)
+	if !ok {
+		HTTPError(rw, statusFor(ErrUpdateUnsupported), ErrUpdateUnsupported)
+		return
+	}
+	ifMatch := req.Header.Get("If-Match")
+	if ifMatch == "" {
+		HTTPError(rw, http.StatusPreconditionRequired, errors.New("updating a message requires If-Match"))
+		return
+	}
+	version, ok := parseVersionETag(ifMatch)
+	if !ok {
+		err := fmt.Errorf("%w: If-Match %s is not the ETag of a message", ErrPreconditionFailed, ifMatch)
+		HTTPError(rw, statusFor(err), err)
+		return
+	}
+
 	var msg Message
-	if err := Unmarshal(req.Body, &msg); err != nil {
+	req.Body = http.MaxBytesReader(rw, req.Body, MaxBodySize)
+	if err := Decode(req, &msg); err != nil {
 		HTTPError(
 			rw,
-			http.StatusInternalServerError,
-			fmt.Errorf("error reading request: %s", err),
+			decodeStatus(err),
+			wrap("reading request", err),
 		)
+		return
+	}
+	if name := principal(req); name != "" {
+		msg.From = name // rather than trust the client
+	}
+	if err := msg.Validate(); err != nil {
+		HTTPError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if err := up.Update(id, msg, version); err != nil {
+		err = wrap(fmt.Sprintf("updating message %q", id), err)
+		ct.logf("%s", err)
+		HTTPError(rw, statusFor(err), err)
+		return
 	}
 
-	if err := ct.Transport.Send(msg); err != nil {
+	msg, err := getMessage(ct.Transport, id)
+	if err != nil {
 		HTTPError(
 			rw,
-			http.StatusInternalServerError,
-			fmt.Errorf("error sending message: %s", err),
+			statusFor(err),
+			wrap(fmt.Sprintf("getting message %q", id), err),
 		)
+		return
 	}
-	rw.WriteHeader(http.StatusOK)
+	rw.Header().Set("ETag", versionETag(msg.Version))
+	respond(rw, req, http.StatusOK, msg)
+}
+
+// versionETag returns the ETag of a message at version.
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// parseVersionETag returns the version of a message whose ETag is etag. It
+// reports false for anything else, including weak ETags, which never match
+// If-Match.
+func parseVersionETag(etag string) (int, bool) {
+	etag = strings.TrimSpace(etag)
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.Atoi(etag[1 : len(etag)-1])
+	return version, err == nil && version >= 0
 }
 
+// NDJSON is the media type of newline-delimited JSON, in which List streams
+// messages.
+const NDJSON = "application/x-ndjson"
+
+// CSV is the media type of comma-separated values, in which List exports
+// messages for spreadsheets.
+const CSV = "text/csv"
+
+// csvHeader is the header row of messages exported as CSV.
+var csvHeader = []string{"From", "To", "Message", "Sent"}
+
+// StreamFlushEvery is how many messages List streams between flushes of the
+// response.
+var StreamFlushEvery = 100
+
+// StreamWriteTimeout is how long List waits, when streaming, for the client to
+// take each StreamFlushEvery messages before dropping it, so that clients that
+// stop reading do not hold the stream open. There is none if it is zero.
+var StreamWriteTimeout = 30 * time.Second
+
 // List processes the request and delegates the task of listing messages to
-// Transport.
+// Transport. The query parameters from and to filter the messages listed, and
+// q restricts them to those whose text contains it, ignoring case, searched
+// with Search if the Transport is a Searcher. The response has a weak ETag
+// derived from its body, and is 304 without a body when If-None-Match has that
+// ETag. If the request accepts NDJSON, messages are streamed instead. If it
+// accepts CSV, they are exported as an attachment with a header row. The
+// response is encoded in full before any of it is written, so that messages
+// failing to encode are answered with a clean 500.
+//
+// The query parameter since, the ID of a message or an RFC 3339 time, lists
+// only the messages sent after it. Responses carry the since of the next poll
+// in NextSinceHeader.
 func (ct MessageController) List(rw http.ResponseWriter, req *http.Request) {
-	msgs, err := ct.Transport.List()
+	query := req.URL.Query()
+	filter := MessageFilter{From: query.Get("from"), To: query.Get("to")}
+	if marker := query.Get("since"); marker != "" {
+		since, err := parseSince(ct.Transport, marker)
+		if err != nil {
+			HTTPError(rw, statusFor(err), wrap("getting messages", err))
+			return
+		}
+		filter.Since = since
+	}
+	q := query.Get("q")
+	if accepts(req, NDJSON) {
+		ct.stream(rw, req, filter, q)
+		return
+	}
+	var msgs []Message
+	var err error
+	if q != "" {
+		msgs, err = search(ct.Transport, q, filter)
+	} else {
+		msgs, err = ct.Transport.List(filter)
+	}
 	if err != nil {
 		HTTPError(
 			rw,
-			http.StatusInternalServerError,
-			fmt.Errorf("error getting messages: %s", err),
+			statusFor(err),
+			wrap("getting messages", err),
 		)
 		return
 	}
+	var newest *Message
+	if len(msgs) > 0 {
+		newest = &msgs[0]
+	}
+	nextSince(rw, newest, filter.Since)
 
-	data, err := json.Marshal(msgs)
+	var mediaType string
+	var data []byte
+	if accepts(req, CSV) {
+		mediaType = CSV
+		data, err = encodeCSV(msgs)
+	} else {
+		mediaType, data, err = encode(req, msgs)
+	}
 	if err != nil {
 		HTTPError(
 			rw,
 			http.StatusInternalServerError,
-			fmt.Errorf("error marshalling results: %s", err),
+			wrap("encoding response as "+mediaType, err),
 		)
 		return
 	}
+	sum := sha256.Sum256(data)
+	etag := fmt.Sprintf(`W/"%x"`, sum[:8])
+	rw.Header().Set("ETag", etag)
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.Header().Set("Content-Type", mediaType)
+	if mediaType == CSV {
+		rw.Header().Set("Content-Disposition", "attachment; filename=messages.csv")
+	}
 	rw.WriteHeader(http.StatusOK)
 	rw.Write(data)
 }
 
+// encodeCSV encodes msgs as CSV, quoted as RFC 4180 requires, after a header
+// row. Sent is written in RFC 3339.
+func encodeCSV(msgs []Message) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(csvHeader)
+	for _, msg := range msgs {
+		w.Write([]string{msg.From, msg.To, msg.Message, msg.Sent.Format(time.RFC3339Nano)})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// stream writes the messages selected by filter as NDJSON, one JSON object per
+// line, with the Transport's ListStream if it is a Streamer. Only messages
+// containing q are written if it is set. The response is
+// flushed every StreamFlushEvery messages. A Transport failing, or a message
+// failing to encode, before the first message is written is answered as by
+// List; once messages have been written, failures can only cut the response
+// short, after the last whole line, and are logged.
+//
+// Messages are written as the client takes them, so that a slow client slows
+// the Transport down rather than have messages buffered. The stream stops once
+// the request is canceled, as when the client disconnects, or once the client
+// takes longer than StreamWriteTimeout to take a flush.
+func (ct MessageController) stream(rw http.ResponseWriter, req *http.Request, filter MessageFilter, q string) {
+	rc := http.NewResponseController(rw)
+	deadline := func() {
+		if StreamWriteTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+		}
+	}
+	if StreamWriteTimeout > 0 {
+		defer rc.SetWriteDeadline(time.Time{}) // for the next request on the connection
+	}
+	n := 0
+	var buf bytes.Buffer
+	var encodeErr error
+	err := listStream(ct.Transport, filter, func(msg Message) error {
+		if err := req.Context().Err(); err != nil {
+			return err
+		}
+		if q != "" && !matchesQuery(msg, q) {
+			return nil
+		}
+		// encoded before anything is written so that a message failing to
+		// encode neither commits the status nor leaves half a line
+		buf.Reset()
+		if encodeErr = Encoder.Encode(&buf, msg); encodeErr != nil {
+			return encodeErr
+		}
+		buf.WriteByte('\n')
+		if n == 0 {
+			nextSince(rw, &msg, filter.Since)
+			rw.Header().Set("Content-Type", NDJSON)
+			rw.WriteHeader(http.StatusOK)
+			deadline()
+		}
+		if _, err := rw.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		if n++; n%StreamFlushEvery == 0 {
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+			deadline()
+		}
+		return nil
+	})
+	switch {
+	case encodeErr != nil && n == 0:
+		HTTPError(rw, http.StatusInternalServerError, wrap("encoding response as "+NDJSON, encodeErr))
+	case err != nil && n == 0:
+		HTTPError(rw, statusFor(err), wrap("getting messages", err))
+	case err != nil:
+		ct.logf("%s", wrap("streaming messages", err))
+	case n == 0:
+		nextSince(rw, nil, filter.Since)
+		rw.Header().Set("Content-Type", NDJSON)
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// upgrader upgrades requests to watch messages to WebSockets.
+var upgrader = websocket.Upgrader{}
+
+// Watch upgrades the request to a WebSocket and pushes every message sent
+// through the Transport from then on to it as a JSON text message, until the
+// client disconnects or the request is done. The Transport must be a
+// Subscriber, or wrap one; the request fails with 501 otherwise.
+func (ct MessageController) Watch(rw http.ResponseWriter, req *http.Request) {
+	found, ok := unwrap(ct.Transport, func(tr Transport) bool {
+		_, ok := tr.(Subscriber)
+		return ok
+	})
+	if !ok {
+		HTTPError(
+			rw,
+			statusFor(ErrSubscribeUnsupported),
+			wrap("watching messages", ErrSubscribeUnsupported),
+		)
+		return
+	}
+	// subscribed before the upgrade so that no message sent once the client
+	// is connected is missed
+	msgs, cancel := found.(Subscriber).Subscribe()
+	defer cancel()
+	conn, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		return // Upgrade responded
+	}
+	defer conn.Close()
+
+	// the client is gone once reading from it fails, which it does once the
+	// connection is closed too
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			if err := writeMessage(conn, msg); err != nil {
+				ct.logf("%s", wrap("watching messages", err))
+				return
+			}
+		case <-gone:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// writeMessage writes msg to conn as a JSON text message.
+func writeMessage(conn *websocket.Conn, msg Message) error {
+	w, err := conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	if err := Encoder.Encode(w, msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// accepts reports whether the Accept header of req lists mediaType.
+func accepts(req *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(accept); err == nil && mt == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// DebugController serves diagnostics about the Transport. It responds with
+// 404 unless Enabled so that it can be registered unconditionally.
+type DebugController struct {
+	Transport Transport // dependency injected
+	Enabled   bool
+}
+
+// DebugController specifies how its methods should be bound.
+func (DebugController) Bindings() []di.Binding {
+	return []di.Binding{
+		{Verb: "GET", Path: DebugPath, Name: "Stats"}, // GET:/debug/transport -> Stats
+	}
+}
+
+// Stats reports TransportStats if the Transport is, or wraps, an Inspector.
+func (ct DebugController) Stats(rw http.ResponseWriter, req *http.Request) {
+	if !ct.Enabled {
+		http.NotFound(rw, req)
+		return
+	}
+	in, ok := unwrap(ct.Transport, func(tr Transport) bool {
+		_, ok := tr.(Inspector)
+		return ok
+	})
+	if !ok {
+		HTTPError(
+			rw,
+			http.StatusNotImplemented,
+			fmt.Errorf("transport %T does not report stats", ct.Transport),
+		)
+		return
+	}
+
+	respond(rw, req, http.StatusOK, in.(Inspector).Stats())
+}
+
+// Pinger is implemented by Transports that can check that their backend is
+// reachable.
+type Pinger interface {
+	Ping() error
+}
+
+// Health is reported by HealthController.
+type Health struct {
+	Env       string // the environment the service runs in
+	Transport string // "ok", "unreachable" or "unchecked" if it is not a Pinger
+	Error     string `json:",omitempty"` // why Transport is unreachable
+}
+
+// HealthController serves probes from load balancers.
+type HealthController struct {
+	Env       string
+	Transport Transport // dependency injected
+}
+
+// HealthController specifies how its methods should be bound.
+func (HealthController) Bindings() []di.Binding {
+	return []di.Binding{
+		{Verb: "GET", Path: HealthPath, Name: "Check", Auth: di.Anonymous}, // GET:/healthz -> Check
+	}
+}
+
+// Check responds with 200 and Health if the Transport is reachable and with
+// 503 if it is not. A Transport that neither is nor wraps a Pinger is assumed
+// reachable and reported as unchecked, so the probe only establishes that the
+// service is live.
+func (ct HealthController) Check(rw http.ResponseWriter, req *http.Request) {
+	health, status := Health{Env: ct.Env, Transport: "unchecked"}, http.StatusOK
+	if p, ok := unwrap(ct.Transport, func(tr Transport) bool {
+		_, ok := tr.(Pinger)
+		return ok
+	}); ok {
+		health.Transport = "ok"
+		if err := p.(Pinger).Ping(); err != nil {
+			health.Transport, health.Error = "unreachable", err.Error()
+			status = http.StatusServiceUnavailable
+		}
+	}
+	respond(rw, req, status, health)
+}
+
 // Registration is used to pass arguments to Setup
 type Registration struct {
 	Ctrl  di.Controller
 	Label string
 }
 
+// NotFound responds with 404 through HTTPError.
+func NotFound(rw http.ResponseWriter, req *http.Request) {
+	HTTPError(rw, http.StatusNotFound, fmt.Errorf("no route for %s", req.URL.Path))
+}
+
+// Setup creates a router and registers the Controllers in regs with a
+// Dispatcher that uses af. It panics if any registration fails, including when
+// two Controllers bind the same <Verb, Path>. Every call creates its own router
+// so concurrent calls share nothing.
+//
+// If af has a method
+//
+//	Middleware() []di.Middleware
+//
+// as AppFactory does, the Middleware it returns is applied to every Binding.
+// Likewise, if af has a method
+//
+//	Authenticator() di.Authenticator
+//
+// requests for Bindings without an Authenticator of their own are
+// authenticated with the one it returns.
 func Setup(af di.ApplicationFactory, regs []Registration) di.Router {
-	router := router.New()
-	dispatcher := di.New("messageService", router, af)
+	return SetupRouter(nil, af, regs)
+}
+
+// SetupE is Setup returning the error of the first registration that fails
+// rather than panicking, for callers that report bad configuration themselves.
+func SetupE(af di.ApplicationFactory, regs []Registration) (di.Router, error) {
+	dispatcher, err := setup(nil, af, regs)
+	if err != nil {
+		return nil, err
+	}
+	return dispatcher.Router(), nil
+}
+
+// SetupRouter is Setup registering the Controllers with r, which defaults to
+// the Mux of package router if nil. Routers of other packages, like
+// gorilla/mux or chi, can be used through a router.Adapter. NotFound serves
+// the requests r routes nowhere if r has a method
+//
+//	SetNotFound(http.Handler)
+//
+// as router.Mux does.
+func SetupRouter(r di.Router, af di.ApplicationFactory, regs []Registration) di.Router {
+	return mustSetup(r, af, regs).Router()
+}
+
+// SetupDispatcher is Setup returning the Dispatcher, whose Router other
+// handlers, like those of metrics, can be registered with.
+func SetupDispatcher(af di.ApplicationFactory, regs []Registration) di.Dispatcher {
+	return mustSetup(nil, af, regs)
+}
+
+// mustSetup is setup panicking if a registration fails.
+func mustSetup(r di.Router, af di.ApplicationFactory, regs []Registration) di.Dispatcher {
+	dispatcher, err := setup(r, af, regs)
+	if err != nil {
+		panic(err)
+	}
+	return dispatcher
+}
+
+// setup registers regs with a Dispatcher routing requests with r, failing with
+// the error of the first registration that fails.
+func setup(r di.Router, af di.ApplicationFactory, regs []Registration) (di.Dispatcher, error) {
+	if r == nil {
+		r = router.New()
+	}
+	if nf, ok := r.(interface {
+		SetNotFound(http.Handler)
+	}); ok {
+		nf.SetNotFound(http.HandlerFunc(NotFound))
+	}
+	dispatcher := di.New("messageService", r, af)
+	dispatcher.SetErrorHandler(func(rw http.ResponseWriter, req *http.Request, status int, err error) {
+		// err may name the types of Controllers and other internals, so it
+		// is logged and clients only get the status
+		log.Printf("%s %s: %s", req.Method, req.URL.Path, err)
+		HTTPError(rw, status, errors.New(http.StatusText(status)))
+	})
+	if m, ok := af.(interface {
+		Middleware() []di.Middleware
+	}); ok {
+		dispatcher.Use(m.Middleware()...)
+	}
+	if a, ok := af.(interface {
+		Authenticator() di.Authenticator
+	}); ok {
+		dispatcher.SetAuthenticator(a.Authenticator())
+	}
 	for _, r := range regs {
 		if err := dispatcher.Register(r.Ctrl, r.Label); err != nil {
-			panic(err)
+			return di.Dispatcher{}, err
 		}
 	}
-	return router
+	return dispatcher, nil
 }
@@ -0,0 +1,18 @@
+package message
+
+// Wrap exposes wrap to tests.
+var Wrap = wrap
+
+// Buckets returns the number of buckets kept by rl.
+func (rl *RateLimiter) Buckets() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.buckets)
+}
+
+// Subscribers returns the number of subscriptions to tr that have not ended.
+func (tr *ListTransport) Subscribers() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return len(tr.subs)
+}
@@ -1,57 +1,1900 @@
 package message
 
 import (
+	"bufio"
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/kkrs/di"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/kkrs/godi-code/di"
+)
+
+// DSTransport implements Transport by backing messages to Datastore. It has
+// request lifetime because the field Context needs to be created for every
+// request. The errors it returns carry RequestID, if set, so that they can be
+// told apart in logs.
+//
+// Messages are stored as entities of Kind under the key Ancestor returns. All
+// messages under one ancestor form an entity group, which Datastore writes
+// about once a second, but that List queries with strong consistency. With
+// NoAncestor, messages are root entities that can be written without that
+// limit, but List is eventually consistent and may miss recent messages.
+//
+// Operations fail with the error of Ctx, without calling datastore, once Ctx
+// is done.
+type DSTransport struct {
+	Ctx       context.Context
+	RequestID string // id of the request served, as from RequestIDFromContext
+
+	Kind     string                               // kind of messages, "message" if empty
+	Ancestor func(context.Context) *datastore.Key // RootAncestor if nil
+}
+
+// RootAncestor stores every message under the key of kind "root" named "root".
+func RootAncestor(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, "root", "root", 0, nil)
+}
+
+// NoAncestor stores messages as root entities.
+func NoAncestor(context.Context) *datastore.Key {
+	return nil
+}
+
+// done returns the error of tr.Ctx if it is done, as when the client that made
+// the request served has gone away.
+func (tr DSTransport) done() error {
+	return withRequestID(tr.RequestID, tr.Ctx.Err())
+}
+
+func (tr DSTransport) kind() string {
+	if tr.Kind == "" {
+		return "message"
+	}
+	return tr.Kind
+}
+
+// ancestor returns the key messages are stored under, nil if none.
+func (tr DSTransport) ancestor() *datastore.Key {
+	if tr.Ancestor == nil {
+		return RootAncestor(tr.Ctx)
+	}
+	return tr.Ancestor(tr.Ctx)
+}
+
+// newQuery returns a query for messages, under the ancestor if there is one.
+func (tr DSTransport) newQuery() *datastore.Query {
+	q := datastore.NewQuery(tr.kind())
+	if ancestor := tr.ancestor(); ancestor != nil {
+		q = q.Ancestor(ancestor)
+	}
+	return q
+}
+
+// withRequestID returns err prefixed with the request id if there is one.
+func withRequestID(id string, err error) error {
+	if err == nil || id == "" {
+		return err
+	}
+	return fmt.Errorf("request %s: %w", id, err)
+}
+
+// Send persists the message to datastore. The ID of the message is the encoded
+// form of the key it is stored under.
+func (tr DSTransport) Send(msg Message) (string, error) {
+	if err := tr.done(); err != nil {
+		return "", err
+	}
+	key := datastore.NewIncompleteKey(tr.Ctx, tr.kind(), tr.ancestor())
+	key, err := datastore.Put(tr.Ctx, key, &msg)
+	if err != nil {
+		return "", withRequestID(tr.RequestID, err)
+	}
+	return key.Encode(), nil
+}
+
+// SendBatch persists msgs to datastore with a single call. Errors of
+// individual messages are returned as a BatchError.
+func (tr DSTransport) SendBatch(msgs []Message) ([]string, error) {
+	if err := tr.done(); err != nil {
+		return nil, err
+	}
+	kind, ancestor := tr.kind(), tr.ancestor()
+	keys := make([]*datastore.Key, len(msgs))
+	for i := range keys {
+		keys[i] = datastore.NewIncompleteKey(tr.Ctx, kind, ancestor)
+	}
+	keys, err := datastore.PutMulti(tr.Ctx, keys, msgs)
+	if multi, ok := err.(appengine.MultiError); ok {
+		err = BatchError(multi)
+	}
+	ids := make([]string, len(msgs))
+	for i, key := range keys {
+		if key != nil && !key.Incomplete() {
+			ids[i] = key.Encode()
+		}
+	}
+	return ids, withRequestID(tr.RequestID, err)
+}
+
+// List retrieves messages selected by filter from datastore, newest first. It
+// is strongly consistent only if messages have an ancestor.
+func (tr DSTransport) List(filter MessageFilter) ([]Message, error) {
+	if err := tr.done(); err != nil {
+		return nil, err
+	}
+	msgs := make([]Message, 0, 10)
+	keys, err := tr.query(filter).GetAll(tr.Ctx, &msgs)
+	for i, key := range keys {
+		msgs[i].ID = key.Encode()
+	}
+	return msgs, withRequestID(tr.RequestID, err)
+}
+
+// ListStream iterates over the messages selected by filter in datastore,
+// newest first, without retrieving them all at once.
+func (tr DSTransport) ListStream(filter MessageFilter, fn func(Message) error) error {
+	if err := tr.done(); err != nil {
+		return err
+	}
+	it := tr.query(filter).Run(tr.Ctx)
+	for {
+		var msg Message
+		key, err := it.Next(&msg)
+		if err == datastore.Done {
+			return nil
+		}
+		if err != nil {
+			return withRequestID(tr.RequestID, err)
+		}
+		msg.ID = key.Encode()
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// query returns the query for the messages selected by filter, newest first.
+func (tr DSTransport) query(filter MessageFilter) *datastore.Query {
+	q := tr.newQuery()
+	if filter.From != "" {
+		q = q.Filter("From =", filter.From)
+	}
+	if filter.To != "" {
+		q = q.Filter("To =", filter.To)
+	}
+	if !filter.Since.IsZero() {
+		q = q.Filter("Sent >", filter.Since)
+	}
+	return q.Order("-Sent")
+}
+
+// Get retrieves the message with id, the encoding of its key, from datastore.
+// It fails with ErrNotFound for IDs that are not those of messages stored.
+func (tr DSTransport) Get(id string) (Message, error) {
+	if err := tr.done(); err != nil {
+		return Message{}, err
+	}
+	key, err := datastore.DecodeKey(id)
+	if err != nil || key.Kind() != tr.kind() {
+		return Message{}, withRequestID(tr.RequestID, ErrNotFound) // not an ID assigned by Send
+	}
+	var msg Message
+	switch err := datastore.Get(tr.Ctx, key, &msg); err {
+	case nil:
+		msg.ID = id
+		return msg, nil
+	case datastore.ErrNoSuchEntity:
+		return Message{}, withRequestID(tr.RequestID, ErrNotFound)
+	default:
+		return Message{}, withRequestID(tr.RequestID, err)
+	}
+}
+
+// Update replaces the message with id in a transaction, so that it fails with
+// ErrPreconditionFailed rather than overwrite an update made concurrently.
+func (tr DSTransport) Update(id string, msg Message, ifVersion int) error {
+	if err := tr.done(); err != nil {
+		return err
+	}
+	key, err := datastore.DecodeKey(id)
+	if err != nil || key.Kind() != tr.kind() {
+		return withRequestID(tr.RequestID, ErrNotFound) // not an ID assigned by Send
+	}
+	err = datastore.RunInTransaction(tr.Ctx, func(ctx context.Context) error {
+		var stored Message
+		switch err := datastore.Get(ctx, key, &stored); err {
+		case nil:
+		case datastore.ErrNoSuchEntity:
+			return ErrNotFound
+		default:
+			return err
+		}
+		if stored.Version != ifVersion {
+			return fmt.Errorf("%w: message is at version %d, not %d", ErrPreconditionFailed, stored.Version, ifVersion)
+		}
+		stored.From, stored.To, stored.Message = msg.From, msg.To, msg.Message
+		stored.Version++
+		_, err := datastore.Put(ctx, key, &stored)
+		return err
+	}, nil)
+	return withRequestID(tr.RequestID, err)
+}
+
+// Ping checks that datastore can be queried.
+func (tr DSTransport) Ping() error {
+	if err := tr.done(); err != nil {
+		return err
+	}
+	_, err := tr.newQuery().KeysOnly().Limit(1).GetAll(tr.Ctx, nil)
+	return withRequestID(tr.RequestID, err)
+}
+
+// ListTransport implements Transport and stores messages in a slice. It is
+// required to be a singleton so that the messages stored in it are not
+// lost.
+type ListTransport struct {
+	mu     sync.Mutex
+	msgs   []Message
+	lastID int                   // IDs are assigned in increasing order
+	subs   map[chan Message]bool // channels of subscribers, see Subscribe
+}
+
+func (tr *ListTransport) Send(msg Message) (string, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.lastID++
+	msg.ID = strconv.Itoa(tr.lastID)
+	tr.msgs = append(tr.msgs, msg)
+	for ch := range tr.subs {
+		select {
+		case ch <- msg:
+		default: // the subscriber fell behind
+		}
+	}
+	return msg.ID, nil
+}
+
+// SubscriberBuffer is how many messages a subscriber of ListTransport may fall
+// behind by before it misses messages.
+var SubscriberBuffer = 16
+
+// Subscribe returns a channel receiving the messages sent from now on and a
+// function ending the subscription. Send does not wait for subscribers: those
+// SubscriberBuffer messages behind miss the messages sent until they catch up.
+func (tr *ListTransport) Subscribe() (<-chan Message, func()) {
+	ch := make(chan Message, SubscriberBuffer)
+	tr.mu.Lock()
+	if tr.subs == nil {
+		tr.subs = make(map[chan Message]bool)
+	}
+	tr.subs[ch] = true
+	tr.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			tr.mu.Lock()
+			delete(tr.subs, ch)
+			tr.mu.Unlock()
+			close(ch) // Send no longer sees ch
+		})
+	}
+}
+
+func (tr *ListTransport) List(filter MessageFilter) ([]Message, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var msgs []Message
+	for _, msg := range tr.msgs {
+		if filter.Match(msg) {
+			msgs = append(msgs, msg)
+		}
+	}
+	return newestFirst(msgs), nil
+}
+
+// Search returns the messages containing q, ignoring case, newest first.
+func (tr *ListTransport) Search(q string) ([]Message, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var msgs []Message
+	for _, msg := range tr.msgs {
+		if matchesQuery(msg, q) {
+			msgs = append(msgs, msg)
+		}
+	}
+	return newestFirst(msgs), nil
+}
+
+func (tr *ListTransport) Get(id string) (Message, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, msg := range tr.msgs {
+		if msg.ID == id {
+			return msg, nil
+		}
+	}
+	return Message{}, ErrNotFound
+}
+
+// Update replaces the message with id under the lock, so that it fails with
+// ErrPreconditionFailed rather than overwrite an update made concurrently.
+func (tr *ListTransport) Update(id string, msg Message, ifVersion int) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for i := range tr.msgs {
+		stored := &tr.msgs[i]
+		if stored.ID != id {
+			continue
+		}
+		if stored.Version != ifVersion {
+			return fmt.Errorf("%w: message is at version %d, not %d", ErrPreconditionFailed, stored.Version, ifVersion)
+		}
+		stored.From, stored.To, stored.Message = msg.From, msg.To, msg.Message
+		stored.Version++
+		return nil
+	}
+	return ErrNotFound
+}
+
+// WithRequestID returns a Transport sharing the messages of tr whose errors
+// carry id, the id of the request it serves, like those of DSTransport.
+func (tr *ListTransport) WithRequestID(id string) Transport {
+	return requestListTransport{tr, id}
+}
+
+// requestListTransport is a ListTransport serving the request with requestID.
+type requestListTransport struct {
+	*ListTransport
+	requestID string
+}
+
+func (tr requestListTransport) Get(id string) (Message, error) {
+	msg, err := tr.ListTransport.Get(id)
+	return msg, withRequestID(tr.requestID, err)
+}
+
+func (tr requestListTransport) Update(id string, msg Message, ifVersion int) error {
+	return withRequestID(tr.requestID, tr.ListTransport.Update(id, msg, ifVersion))
+}
+
+// Stats reports on the messages held without modifying them.
+func (tr *ListTransport) Stats() TransportStats {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return statsOf(tr.msgs, cap(tr.msgs))
+}
+
+// statsOf reports on msgs held by a Transport that can store capacity
+// messages without growing.
+func statsOf(msgs []Message, capacity int) TransportStats {
+	stats := TransportStats{Count: len(msgs), Capacity: capacity}
+	for i, msg := range msgs {
+		if i == 0 || msg.Sent.Before(stats.Oldest) {
+			stats.Oldest = msg.Sent
+		}
+		if i == 0 || msg.Sent.After(stats.Newest) {
+			stats.Newest = msg.Sent
+		}
+	}
+	return stats
+}
+
+// RingTransport implements Transport and keeps only the most recent messages
+// sent, dropping the oldest once it is full. It is a bounded alternative to
+// ListTransport for long running debugging. It is constructed with
+// NewRingTransport and is required to be a singleton.
+type RingTransport struct {
+	mu     sync.Mutex
+	msgs   []Message // used as a ring buffer
+	next   int       // where the next message is stored
+	count  int       // messages stored
+	lastID int       // IDs are assigned in increasing order
+}
+
+// NewRingTransport returns a RingTransport holding at most n messages. It
+// panics if n is not positive.
+func NewRingTransport(n int) *RingTransport {
+	if n <= 0 {
+		panic(fmt.Sprintf("ring of %d messages", n))
+	}
+	return &RingTransport{msgs: make([]Message, n)}
+}
+
+func (tr *RingTransport) Send(msg Message) (string, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.lastID++
+	msg.ID = strconv.Itoa(tr.lastID)
+	tr.msgs[tr.next] = msg
+	tr.next = (tr.next + 1) % len(tr.msgs)
+	if tr.count < len(tr.msgs) {
+		tr.count++
+	}
+	return msg.ID, nil
+}
+
+func (tr *RingTransport) List(filter MessageFilter) ([]Message, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var msgs []Message
+	for _, msg := range tr.sent() {
+		if filter.Match(msg) {
+			msgs = append(msgs, msg)
+		}
+	}
+	return newestFirst(msgs), nil
+}
+
+// Stats reports on the messages held without modifying them.
+func (tr *RingTransport) Stats() TransportStats {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return statsOf(tr.sent(), len(tr.msgs))
+}
+
+// sent returns the messages held in the order they were sent.
+func (tr *RingTransport) sent() []Message {
+	start := (tr.next - tr.count + len(tr.msgs)) % len(tr.msgs)
+	msgs := make([]Message, 0, tr.count)
+	for i := 0; i < tr.count; i++ {
+		msgs = append(msgs, tr.msgs[(start+i)%len(tr.msgs)])
+	}
+	return msgs
+}
+
+// newestFirst returns a copy of msgs, which are in the order they were sent,
+// sorted by Sent descending. Messages sent at the same time are listed in
+// reverse order of arrival.
+func newestFirst(msgs []Message) []Message {
+	sorted := make([]Message, len(msgs))
+	for i, msg := range msgs {
+		sorted[len(msgs)-1-i] = msg
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Sent.After(sorted[j].Sent)
+	})
+	return sorted
+}
+
+// ReadStrategy decides which backend of a ReplicaTransport serves a read.
+type ReadStrategy int
+
+const (
+	PrimaryOnly ReadStrategy = iota // always read from the primary
+	RoundRobin                      // take turns, starting with the primary
+	Random                          // pick a backend at random
+)
+
+// ReplicaTransport implements Transport by sending to Primary and listing from
+// either Primary or one of Replicas as decided by Strategy. Replicas are
+// expected to eventually hold what is sent to Primary. It keeps track of turns
+// for RoundRobin and so is required to be a singleton.
+type ReplicaTransport struct {
+	Primary  Transport
+	Replicas []Transport
+	Strategy ReadStrategy
+
+	turn uint32 // incremented for every List with RoundRobin
+}
+
+// Send sends the message to Primary.
+func (tr *ReplicaTransport) Send(msg Message) (string, error) {
+	return tr.Primary.Send(msg)
+}
+
+// List lists messages from the backend picked by Strategy.
+func (tr *ReplicaTransport) List(filter MessageFilter) ([]Message, error) {
+	return tr.reader().List(filter)
+}
+
+// SendBatch sends msgs to Primary.
+func (tr *ReplicaTransport) SendBatch(msgs []Message) ([]string, error) {
+	return sendBatchError(tr.Primary, msgs)
+}
+
+// Update updates the message in Primary.
+func (tr *ReplicaTransport) Update(id string, msg Message, ifVersion int) error {
+	return update(tr.Primary, id, msg, ifVersion)
+}
+
+// Get gets the message from the backend picked by Strategy.
+func (tr *ReplicaTransport) Get(id string) (Message, error) {
+	return getMessage(tr.reader(), id)
+}
+
+// ListStream lists messages from the backend picked by Strategy.
+func (tr *ReplicaTransport) ListStream(filter MessageFilter, fn func(Message) error) error {
+	return listStream(tr.reader(), filter, fn)
+}
+
+// Search searches messages in the backend picked by Strategy.
+func (tr *ReplicaTransport) Search(q string) ([]Message, error) {
+	return search(tr.reader(), q, MessageFilter{})
+}
+
+// Unwrap returns Primary, which is subscribed to, inspected and pinged.
+func (tr *ReplicaTransport) Unwrap() Transport {
+	return tr.Primary
+}
+
+func (tr *ReplicaTransport) reader() Transport {
+	n := len(tr.Replicas) + 1
+	var i int
+	switch tr.Strategy {
+	case PrimaryOnly:
+		return tr.Primary
+	case RoundRobin:
+		i = int((atomic.AddUint32(&tr.turn, 1) - 1) % uint32(n))
+	case Random:
+		i = rand.Intn(n)
+	default:
+		panic(fmt.Sprintf("unknown read strategy %d", tr.Strategy))
+	}
+	if i == 0 {
+		return tr.Primary
+	}
+	return tr.Replicas[i-1]
+}
+
+// MultiTransport implements Transport by sending to Primary and every one of
+// Others, such as when migrating between backends, and listing from Primary.
+// It is constructed with NewMultiTransport.
+type MultiTransport struct {
+	Primary Transport
+	Others  []Transport
+
+	// BestEffort makes Send succeed when at least one backend does. Otherwise
+	// it fails if any backend does.
+	BestEffort bool
+}
+
+// NewMultiTransport returns a MultiTransport sending to primary and others.
+func NewMultiTransport(primary Transport, others ...Transport) MultiTransport {
+	return MultiTransport{Primary: primary, Others: others}
+}
+
+// Send sends the message to every backend. It returns the ID assigned by
+// Primary, or by the first of Others to succeed if Primary failed, and the
+// errors of the backends that failed joined together.
+func (tr MultiTransport) Send(msg Message) (string, error) {
+	var id string
+	var errs []error
+	for i, backend := range tr.backends() {
+		sent, err := backend.Send(msg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("backend %d: %w", i, err))
+			continue
+		}
+		if id == "" {
+			id = sent
+		}
+	}
+	if !tr.failed(errs) {
+		return id, nil
+	}
+	return "", errors.Join(errs...)
+}
+
+// SendBatch sends msgs to every backend, each message as Send would.
+func (tr MultiTransport) SendBatch(msgs []Message) ([]string, error) {
+	ids := make([]string, len(msgs))
+	errs := make([][]error, len(msgs)) // of each message
+	for i, backend := range tr.backends() {
+		sent, failed := sendBatch(backend, msgs)
+		for j, err := range failed {
+			if err != nil {
+				errs[j] = append(errs[j], fmt.Errorf("backend %d: %w", i, err))
+			} else if ids[j] == "" {
+				ids[j] = sent[j]
+			}
+		}
+	}
+	batchErr := make(BatchError, len(msgs))
+	var failed bool
+	for j := range msgs {
+		if tr.failed(errs[j]) {
+			ids[j], batchErr[j], failed = "", errors.Join(errs[j]...), true
+		}
+	}
+	if !failed {
+		return ids, nil
+	}
+	return ids, batchErr
+}
+
+// backends returns Primary followed by Others.
+func (tr MultiTransport) backends() []Transport {
+	return append([]Transport{tr.Primary}, tr.Others...)
+}
+
+// failed reports whether sending a message failed with errs from backends.
+func (tr MultiTransport) failed(errs []error) bool {
+	return len(errs) > 0 && !(tr.BestEffort && len(errs) <= len(tr.Others))
+}
+
+// List lists messages from Primary.
+func (tr MultiTransport) List(filter MessageFilter) ([]Message, error) {
+	return tr.Primary.List(filter)
+}
+
+// Get gets the message from Primary.
+func (tr MultiTransport) Get(id string) (Message, error) {
+	return getMessage(tr.Primary, id)
+}
+
+// ListStream lists messages from Primary.
+func (tr MultiTransport) ListStream(filter MessageFilter, fn func(Message) error) error {
+	return listStream(tr.Primary, filter, fn)
+}
+
+// Search searches messages in Primary.
+func (tr MultiTransport) Search(q string) ([]Message, error) {
+	return search(tr.Primary, q, MessageFilter{})
+}
+
+// Update updates the message in Primary if there are no Others. Messages have
+// an ID of their own in each backend, so that the copies in Others cannot be
+// found to be updated too, and updating fails with ErrUpdateUnsupported rather
+// than leave them behind.
+func (tr MultiTransport) Update(id string, msg Message, ifVersion int) error {
+	if len(tr.Others) > 0 {
+		return fmt.Errorf("%w while sending to several backends", ErrUpdateUnsupported)
+	}
+	return update(tr.Primary, id, msg, ifVersion)
+}
+
+// Unwrap returns Primary, which is subscribed to, inspected and pinged.
+func (tr MultiTransport) Unwrap() Transport {
+	return tr.Primary
+}
+
+// AuditRecord describes an operation on a Transport.
+type AuditRecord struct {
+	User string    // the Principal the request was authenticated as, "" if none
+	Time time.Time // when the operation was attempted
+	Op   string    // "send", "get", "list", "search" or "update"
+	What string    // the message or filter, by sender and recipient
+}
+
+// AuditSink stores AuditRecords.
+type AuditSink interface {
+	Audit(AuditRecord) error
+}
+
+// AuditFunc adapts a function to an AuditSink.
+type AuditFunc func(AuditRecord) error
+
+func (f AuditFunc) Audit(rec AuditRecord) error {
+	return f(rec)
+}
+
+// AuditTransport implements Transport by writing an AuditRecord to Sink before
+// delegating each operation to Inner. An operation that cannot be audited
+// fails without reaching Inner unless BestEffort is set. It has request
+// lifetime because the user is the di.Principal the request was authenticated
+// as, read from Ctx, the context of the request.
+type AuditTransport struct {
+	Inner      Transport
+	Sink       AuditSink
+	Ctx        context.Context
+	BestEffort bool
+}
+
+func (tr AuditTransport) audit(op, what string) error {
+	p, _ := tr.Ctx.Value(di.PrincipalContextKey).(di.Principal)
+	rec := AuditRecord{p.Name, clock.Now(), op, what}
+	if err := tr.Sink.Audit(rec); err != nil && !tr.BestEffort {
+		return fmt.Errorf("error auditing %s: %w", op, err)
+	}
+	return nil
+}
+
+// Send audits and sends the message.
+func (tr AuditTransport) Send(msg Message) (string, error) {
+	if err := tr.audit("send", fmt.Sprintf("from %q to %q", msg.From, msg.To)); err != nil {
+		return "", err
+	}
+	return tr.Inner.Send(msg)
+}
+
+// List audits and lists messages.
+func (tr AuditTransport) List(filter MessageFilter) ([]Message, error) {
+	if err := tr.audit("list", fmt.Sprintf("from %q to %q", filter.From, filter.To)); err != nil {
+		return nil, err
+	}
+	return tr.Inner.List(filter)
+}
+
+// Update audits and updates the message if Inner is an Updater.
+func (tr AuditTransport) Update(id string, msg Message, ifVersion int) error {
+	if _, ok := tr.Inner.(Updater); !ok {
+		return ErrUpdateUnsupported
+	}
+	if err := tr.audit("update", fmt.Sprintf("%q from %q to %q", id, msg.From, msg.To)); err != nil {
+		return err
+	}
+	return update(tr.Inner, id, msg, ifVersion)
+}
+
+// SendBatch audits every message and then sends them all. Nothing is sent if
+// a message cannot be audited.
+func (tr AuditTransport) SendBatch(msgs []Message) ([]string, error) {
+	for _, msg := range msgs {
+		if err := tr.audit("send", fmt.Sprintf("from %q to %q", msg.From, msg.To)); err != nil {
+			return nil, err
+		}
+	}
+	return sendBatchError(tr.Inner, msgs)
+}
+
+// Get audits and gets the message.
+func (tr AuditTransport) Get(id string) (Message, error) {
+	if err := tr.audit("get", fmt.Sprintf("%q", id)); err != nil {
+		return Message{}, err
+	}
+	return getMessage(tr.Inner, id)
+}
+
+// ListStream audits and lists messages.
+func (tr AuditTransport) ListStream(filter MessageFilter, fn func(Message) error) error {
+	if err := tr.audit("list", fmt.Sprintf("from %q to %q", filter.From, filter.To)); err != nil {
+		return err
+	}
+	return listStream(tr.Inner, filter, fn)
+}
+
+// Search audits and searches messages.
+func (tr AuditTransport) Search(q string) ([]Message, error) {
+	if err := tr.audit("search", fmt.Sprintf("%q", q)); err != nil {
+		return nil, err
+	}
+	return search(tr.Inner, q, MessageFilter{})
+}
+
+// Unwrap returns Inner, which is subscribed to, inspected and pinged without
+// being audited.
+func (tr AuditTransport) Unwrap() Transport {
+	return tr.Inner
+}
+
+// IsTemporary reports whether err is likely to go away if the operation that
+// caused it is retried. It recognizes App Engine timeouts, datastore
+// transaction conflicts and errors that report themselves as Temporary, even
+// when wrapped.
+func IsTemporary(err error) bool {
+	var t interface {
+		Temporary() bool
+	}
+	if errors.As(err, &t) {
+		return t.Temporary()
+	}
+	for ; err != nil; err = errors.Unwrap(err) { // like errors wrapped withRequestID
+		if appengine.IsTimeoutError(err) || err == datastore.ErrConcurrentTransaction {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSafeToResend reports whether an operation that is not idempotent, like
+// Send, may be retried after failing with err: err IsTemporary but is not a
+// timeout, after which the operation may have succeeded unbeknownst to its
+// caller, so that retrying it would repeat it.
+func IsSafeToResend(err error) bool {
+	if !IsTemporary(err) {
+		return false
+	}
+	var t interface {
+		Timeout() bool
+	}
+	if errors.As(err, &t) && t.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	for ; err != nil; err = errors.Unwrap(err) {
+		if appengine.IsTimeoutError(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// RetryTransport implements Transport by retrying the operations of Inner that
+// fail with retryable errors, waiting exponentially longer between attempts.
+// Send, SendBatch and Update, which are not idempotent, are only retried after
+// errors that are safe to resend after. It is constructed with
+// NewRetryTransport.
+type RetryTransport struct {
+	Inner Transport
+
+	attempts   int
+	backoff    time.Duration
+	retryable  func(error) bool
+	resendable func(error) bool
+	ctx        context.Context
+}
+
+// A RetryOption configures a RetryTransport.
+type RetryOption func(*RetryTransport)
+
+// RetryAttempts sets the number of times an operation is attempted, including
+// the first. It defaults to 3.
+func RetryAttempts(n int) RetryOption {
+	return func(tr *RetryTransport) { tr.attempts = n }
+}
+
+// RetryBackoff sets how long to wait before the first retry. The wait doubles
+// for every retry after it. It defaults to 100ms.
+func RetryBackoff(d time.Duration) RetryOption {
+	return func(tr *RetryTransport) { tr.backoff = d }
+}
+
+// RetryIf sets the predicate deciding whether an error of an idempotent
+// operation, like List, is retried. It defaults to IsTemporary.
+func RetryIf(retryable func(error) bool) RetryOption {
+	return func(tr *RetryTransport) { tr.retryable = retryable }
+}
+
+// RetrySendIf sets the predicate deciding whether an error of Send, SendBatch
+// or Update is retried. It defaults to IsSafeToResend.
+func RetrySendIf(resendable func(error) bool) RetryOption {
+	return func(tr *RetryTransport) { tr.resendable = resendable }
+}
+
+// RetryContext stops retries once ctx is done or when its deadline would pass
+// before the next attempt, usually ctx is that of the request.
+func RetryContext(ctx context.Context) RetryOption {
+	return func(tr *RetryTransport) { tr.ctx = ctx }
+}
+
+// NewRetryTransport returns a RetryTransport wrapping inner configured by opts.
+func NewRetryTransport(inner Transport, opts ...RetryOption) RetryTransport {
+	tr := RetryTransport{
+		Inner:      inner,
+		attempts:   3,
+		backoff:    100 * time.Millisecond,
+		retryable:  IsTemporary,
+		resendable: IsSafeToResend,
+		ctx:        context.Background(),
+	}
+	for _, opt := range opts {
+		opt(&tr)
+	}
+	return tr
+}
+
+// retry calls op until it succeeds, fails with an error that is not retryable
+// or runs out of attempts or time. It returns the last error from op.
+func (tr RetryTransport) retry(op func() error) error {
+	return tr.retryIf(tr.retryable, op)
+}
+
+// retryIf is retry with the errors retryable reports retried.
+func (tr RetryTransport) retryIf(retryable func(error) bool, op func() error) error {
+	wait := tr.backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= tr.attempts || !retryable(err) {
+			return err
+		}
+		// deadlines of contexts are in real time, not that of the package clock
+		if deadline, ok := tr.ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		select {
+		case <-tr.ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// Send sends the message, retrying if it fails safely to resend.
+func (tr RetryTransport) Send(msg Message) (string, error) {
+	var id string
+	err := tr.retryIf(tr.resendable, func() (err error) {
+		id, err = tr.Inner.Send(msg)
+		return err
+	})
+	return id, err
+}
+
+// SendBatch sends msgs, retrying them all if the batch fails as a whole and
+// safely to resend. Batches that fail for some messages are not retried.
+func (tr RetryTransport) SendBatch(msgs []Message) ([]string, error) {
+	var ids []string
+	err := tr.retryIf(func(err error) bool {
+		var batchErr BatchError
+		return !errors.As(err, &batchErr) && tr.resendable(err)
+	}, func() (err error) {
+		ids, err = sendBatchError(tr.Inner, msgs)
+		return err
+	})
+	return ids, err
+}
+
+// Update updates the message, retrying if it fails safely to resend.
+func (tr RetryTransport) Update(id string, msg Message, ifVersion int) error {
+	return tr.retryIf(tr.resendable, func() error {
+		return update(tr.Inner, id, msg, ifVersion)
+	})
+}
+
+// List lists messages, retrying if it fails.
+func (tr RetryTransport) List(filter MessageFilter) ([]Message, error) {
+	var msgs []Message
+	err := tr.retry(func() (err error) {
+		msgs, err = tr.Inner.List(filter)
+		return err
+	})
+	return msgs, err
+}
+
+// Get gets the message, retrying if it fails.
+func (tr RetryTransport) Get(id string) (Message, error) {
+	var msg Message
+	err := tr.retry(func() (err error) {
+		msg, err = getMessage(tr.Inner, id)
+		return err
+	})
+	return msg, err
+}
+
+// ListStream lists messages, retrying if it fails before passing any to fn,
+// which would otherwise be passed them again.
+func (tr RetryTransport) ListStream(filter MessageFilter, fn func(Message) error) error {
+	var passed bool
+	return tr.retryIf(func(err error) bool {
+		return !passed && tr.retryable(err)
+	}, func() error {
+		return listStream(tr.Inner, filter, func(msg Message) error {
+			passed = true
+			return fn(msg)
+		})
+	})
+}
+
+// Search searches messages, retrying if it fails.
+func (tr RetryTransport) Search(q string) ([]Message, error) {
+	var msgs []Message
+	err := tr.retry(func() (err error) {
+		msgs, err = search(tr.Inner, q, MessageFilter{})
+		return err
+	})
+	return msgs, err
+}
+
+// Unwrap returns Inner, which is subscribed to, inspected and pinged without
+// retries.
+func (tr RetryTransport) Unwrap() Transport {
+	return tr.Inner
+}
+
+// A Publisher publishes data as a message to a Google Cloud Pub/Sub topic and
+// returns the ID Pub/Sub assigned to it. RESTPublisher is one; a
+// *pubsub.Topic of cloud.google.com/go/pubsub, where it can be used, is
+// adapted with PublisherFunc:
+//
+//	PublisherFunc(func(ctx context.Context, data []byte) (string, error) {
+//		return topic.Publish(ctx, &pubsub.Message{Data: data}).Get(ctx)
+//	})
+type Publisher interface {
+	Publish(ctx context.Context, data []byte) (string, error)
+}
+
+// PublisherFunc adapts a function to Publisher.
+type PublisherFunc func(ctx context.Context, data []byte) (string, error)
+
+func (f PublisherFunc) Publish(ctx context.Context, data []byte) (string, error) {
+	return f(ctx, data)
+}
+
+// PubSubEndpoint is the base URL of the Google Cloud Pub/Sub REST API.
+const PubSubEndpoint = "https://pubsub.googleapis.com/v1"
+
+// RESTPublisher implements Publisher with the Pub/Sub REST API. Client is
+// expected to authorize requests, for instance with OAuth2 credentials.
+//
+// It is the Publisher of the app rather than cloud.google.com/go/pubsub
+// because that client needs gRPC and background goroutines, which the App
+// Engine standard environment this app runs in does not allow, and because a
+// single publish per request needs none of its batching. Client can be one
+// that App Engine URL Fetch allows, and Endpoint that of the Pub/Sub emulator
+// in tests.
+type RESTPublisher struct {
+	Client   *http.Client
+	Endpoint string // defaults to PubSubEndpoint
+	Project  string
+	Topic    string
+}
+
+func (p RESTPublisher) Publish(ctx context.Context, data []byte) (string, error) {
+	body, err := json.Marshal(map[string][]map[string][]byte{
+		"messages": {{"data": data}}, // []byte is encoded as base64 as required
+	})
+	if err != nil {
+		return "", err
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = PubSubEndpoint
+	}
+	req, err := http.NewRequest("POST",
+		fmt.Sprintf("%s/projects/%s/topics/%s:publish", endpoint, url.PathEscape(p.Project), url.PathEscape(p.Topic)),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		payload, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("publishing to topic %q: %s: %s", p.Topic, resp.Status, bytes.TrimSpace(payload))
+	}
+	var published struct {
+		MessageIDs []string `json:"messageIds"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&published); err != nil {
+		return "", err
+	}
+	if len(published.MessageIDs) != 1 {
+		return "", fmt.Errorf("publishing to topic %q: got %d message IDs", p.Topic, len(published.MessageIDs))
+	}
+	return published.MessageIDs[0], nil
+}
 
-	"golang.org/x/net/context"
+// PubSubTransport implements Transport by publishing messages as JSON to a
+// Google Cloud Pub/Sub topic with Publisher, for downstream services to react
+// to. It cannot list messages. It has request lifetime because of Ctx.
+type PubSubTransport struct {
+	Publisher Publisher
+	Ctx       context.Context
+}
 
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
-)
+// Send publishes the message. The ID of the message is the one assigned by
+// Pub/Sub.
+func (tr PubSubTransport) Send(msg Message) (string, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	return tr.Publisher.Publish(tr.Ctx, data)
+}
 
-// DSTransport implements Transport by backing messages to Datastore. It has
-// request lifetime because the field Context needs to be created for every
-// request.
-type DSTransport struct {
+// List fails with ErrListUnsupported as published messages are only
+// available to subscribers.
+func (tr PubSubTransport) List(MessageFilter) ([]Message, error) {
+	return nil, ErrListUnsupported
+}
+
+// DefaultIdempotencyTTL is how long IdempotencyStores remember responses when
+// their TTL is zero.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// MemoryIdempotencyStore implements IdempotencyStore in memory. It is required
+// to be a singleton, and only dedupes requests served by the same instance.
+type MemoryIdempotencyStore struct {
+	TTL time.Duration // how long responses are remembered
+
+	mu      sync.Mutex
+	entries map[string]idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	resp    IdempotentResponse
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore returns a MemoryIdempotencyStore remembering
+// responses for DefaultIdempotencyTTL.
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{TTL: DefaultIdempotencyTTL}
+}
+
+func (s *MemoryIdempotencyStore) Get(key string) (IdempotentResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || !clock.Now().Before(e.expires) {
+		return IdempotentResponse{}, false, nil
+	}
+	return e.resp, true, nil
+}
+
+func (s *MemoryIdempotencyStore) SetNX(key string, resp IdempotentResponse) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && clock.Now().Before(e.expires) {
+		return false, nil
+	}
+	s.set(key, resp)
+	return true, nil
+}
+
+func (s *MemoryIdempotencyStore) Set(key string, resp IdempotentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, resp)
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// set stores resp for key, dropping expired entries as it grows the map.
+func (s *MemoryIdempotencyStore) set(key string, resp IdempotentResponse) {
+	now := clock.Now()
+	if s.entries == nil {
+		s.entries = make(map[string]idempotencyEntry)
+	}
+	if _, ok := s.entries[key]; !ok {
+		for k, e := range s.entries {
+			if !now.Before(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	s.entries[key] = idempotencyEntry{resp, now.Add(idempotencyTTL(s.TTL))}
+}
+
+func idempotencyTTL(ttl time.Duration) time.Duration {
+	if ttl == 0 {
+		return DefaultIdempotencyTTL
+	}
+	return ttl
+}
+
+// DSIdempotencyStore implements IdempotencyStore by backing responses to
+// Datastore, so that requests are deduped across instances. Like DSTransport
+// it lives for the lifetime of a request.
+type DSIdempotencyStore struct {
 	Ctx context.Context
+	TTL time.Duration // how long responses are remembered
 }
 
-// Send persists the message to datastore.
-func (tr DSTransport) Send(msg Message) error {
-	key := datastore.NewIncompleteKey(tr.Ctx, "message",
-		datastore.NewKey(tr.Ctx, "root", "root", 0, nil),
-	)
-	_, err := datastore.Put(tr.Ctx, key, &msg)
+// dsIdempotentResponse is how IdempotentResponses are stored in Datastore.
+type dsIdempotentResponse struct {
+	Status      int    `datastore:",noindex"`
+	Location    string `datastore:",noindex"`
+	ContentType string `datastore:",noindex"`
+	Body        []byte `datastore:",noindex"`
+	RequestHash []byte `datastore:",noindex"`
+	Expires     time.Time
+}
+
+// key returns the Datastore key for key, named by its hash since key names are
+// bounded and key holds the name of the Principal along with the header.
+func (s DSIdempotencyStore) key(key string) *datastore.Key {
+	sum := sha256.Sum256([]byte(key))
+	return datastore.NewKey(s.Ctx, "idempotency", hex.EncodeToString(sum[:]), 0, nil)
+}
+
+func (s DSIdempotencyStore) Get(key string) (IdempotentResponse, bool, error) {
+	return s.get(s.Ctx, key)
+}
+
+func (s DSIdempotencyStore) get(ctx context.Context, key string) (IdempotentResponse, bool, error) {
+	var stored dsIdempotentResponse
+	err := datastore.Get(ctx, s.key(key), &stored)
+	if err == datastore.ErrNoSuchEntity || err == nil && !clock.Now().Before(stored.Expires) {
+		return IdempotentResponse{}, false, nil
+	}
+	if err != nil {
+		return IdempotentResponse{}, false, err
+	}
+	return IdempotentResponse{stored.Status, stored.Location, stored.ContentType, stored.Body, stored.RequestHash}, true, nil
+}
+
+func (s DSIdempotencyStore) SetNX(key string, resp IdempotentResponse) (bool, error) {
+	claimed := false
+	err := datastore.RunInTransaction(s.Ctx, func(tc context.Context) error {
+		_, ok, err := s.get(tc, key)
+		if err != nil || ok {
+			return err
+		}
+		claimed = true
+		return s.set(tc, key, resp)
+	}, nil)
+	return claimed && err == nil, err
+}
+
+func (s DSIdempotencyStore) Set(key string, resp IdempotentResponse) error {
+	return s.set(s.Ctx, key, resp)
+}
+
+func (s DSIdempotencyStore) set(ctx context.Context, key string, resp IdempotentResponse) error {
+	_, err := datastore.Put(ctx, s.key(key), &dsIdempotentResponse{
+		resp.Status, resp.Location, resp.ContentType, resp.Body, resp.RequestHash,
+		clock.Now().Add(idempotencyTTL(s.TTL)),
+	})
 	return err
 }
 
-// List retrieves the first 10 messages from datastore.
-func (tr DSTransport) List() ([]Message, error) {
-	msgs := make([]Message, 0, 10)
-	q := datastore.NewQuery("message").Ancestor(
-		datastore.NewKey(tr.Ctx, "root", "root", 0, nil),
-	)
-	_, err := q.GetAll(tr.Ctx, &msgs)
-	return msgs, err
+func (s DSIdempotencyStore) Delete(key string) error {
+	return datastore.Delete(s.Ctx, s.key(key))
 }
 
-// ListTransport implements Transport and stores messages in a slice. It is
-// required to be a singleton so that the messages stored in it are not
-// lost.
-type ListTransport struct {
-	msgs []Message
+// BodyLog logs the JSON request and response bodies of requests, so that the
+// payloads causing failures can be seen when debugging. It must not be used in
+// production as bodies hold what users send.
+type BodyLog struct {
+	Paths  []string                                 // Binding Paths to log, every one if empty
+	Redact []string                                 // fields whose values are not logged, like "Message"
+	Logf   func(format string, args ...interface{}) // defaults to log.Printf
 }
 
-func (tr *ListTransport) Send(msg Message) error {
-	tr.msgs = append(tr.msgs, msg)
-	return nil
+// Redacted replaces the values of redacted fields.
+const Redacted = "[redacted]"
+
+// Middleware returns Middleware that logs the bodies of requests dispatched
+// for Paths. The request body is read as Unmarshal does and restored for the
+// handler. Requests to upgrade the connection are not logged, as what follows
+// is not a response.
+func (bl BodyLog) Middleware() di.Middleware {
+	logf := bl.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if _, path, _ := di.RouteFromContext(req); !bl.logs(path) || di.IsUpgrade(req) {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			var reqBody []byte
+			if req.Body != nil {
+				var err error
+				if reqBody, err = readBody(req.Body); err != nil {
+					status := http.StatusBadRequest
+					var tooLarge *http.MaxBytesError
+					if errors.As(err, &tooLarge) {
+						status = http.StatusRequestEntityTooLarge
+					}
+					HTTPError(rw, status, wrap("reading request", err))
+					return
+				}
+				req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+			}
+			rec := newBodyRecorder(rw)
+			next.ServeHTTP(rec, req)
+			logf("%s %s request %s response %d %s", req.Method, req.URL.Path,
+				bl.redact(reqBody), rec.Status(), bl.redact(rec.body.Bytes()))
+		})
+	}
+}
+
+func (bl BodyLog) logs(path string) bool {
+	if len(bl.Paths) == 0 {
+		return true
+	}
+	for _, p := range bl.Paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// redact returns body with the values of Redact replaced, or a description of
+// it if it is not JSON.
+func (bl BodyLog) redact(body []byte) string {
+	if len(body) == 0 {
+		return "<empty>"
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Sprintf("<%d bytes, not JSON>", len(body))
+	}
+	v = bl.redactValue(v)
+	data, _ := json.Marshal(v) // cannot fail for what was unmarshalled
+	return string(data)
+}
+
+func (bl BodyLog) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			v[key] = bl.redactValue(field)
+			for _, redact := range bl.Redact {
+				if strings.EqualFold(key, redact) {
+					v[key] = Redacted
+				}
+			}
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = bl.redactValue(elem)
+		}
+	}
+	return v
+}
+
+// bodyRecorder is an http.ResponseWriter that keeps a copy of the body
+// written. It is built on di.RecordingWriter for the status and so that
+// Flush and Hijack reach the http.ResponseWriter it wraps.
+type bodyRecorder struct {
+	*di.RecordingWriter
+	body bytes.Buffer
+}
+
+func newBodyRecorder(rw http.ResponseWriter) *bodyRecorder {
+	return &bodyRecorder{RecordingWriter: di.WrapResponseWriter(rw)}
+}
+
+func (w *bodyRecorder) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.RecordingWriter.Write(p)
+}
+
+func (w *bodyRecorder) ReadFrom(r io.Reader) (int64, error) {
+	return w.RecordingWriter.ReadFrom(io.TeeReader(r, &w.body))
+}
+
+// Timeout responds with 503 to requests whose handler takes longer than their
+// timeout to serve them. The context of the request is done once the timeout
+// passes, so that Transports made for it give up.
+type Timeout struct {
+	Duration time.Duration            // the timeout of requests, none if zero
+	Paths    map[string]time.Duration // timeouts by Binding Path, overriding Duration
+}
+
+// Middleware returns Middleware enforcing the timeout of requests. The response
+// is buffered until the handler returns, so that what it writes once the
+// timeout has passed is discarded rather than mixed into the 503 response.
+// Handlers that flush or hijack the response, to stream it, have it written
+// from then on, and once the timeout passes their writes fail without a 503.
+// Requests to upgrade the connection, as to a WebSocket, have no timeout.
+func (to Timeout) Middleware() di.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			d := to.Duration
+			if _, path, ok := di.RouteFromContext(req); ok {
+				if pd, ok := to.Paths[path]; ok {
+					d = pd
+				}
+			}
+			if d <= 0 || di.IsUpgrade(req) {
+				next.ServeHTTP(rw, req)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(req.Context(), d)
+			defer cancel()
+			tw := &timeoutWriter{rw: rw, header: make(http.Header)}
+			done, panicked := make(chan struct{}), make(chan interface{}, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+				}()
+				next.ServeHTTP(tw, req.WithContext(ctx))
+				close(done)
+			}()
+			select {
+			case p := <-panicked:
+				panic(p)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.commit()
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				if !tw.committed {
+					HTTPError(rw, http.StatusServiceUnavailable, wrap("serving request", ctx.Err()))
+				}
+			}
+		})
+	}
+}
+
+// timeoutWriter is an http.ResponseWriter that buffers the response until
+// Timeout writes it, or the handler flushes or hijacks it, and fails writes
+// once the timeout has passed.
+type timeoutWriter struct {
+	rw     http.ResponseWriter
+	header http.Header
+
+	mu        sync.Mutex
+	body      bytes.Buffer
+	status    int
+	timedOut  bool
+	committed bool // the buffered response was written to rw, or rw hijacked
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) WriteHeader(status int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status == 0 && !w.timedOut {
+		w.status = status
+	}
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.committed {
+		return w.rw.Write(p)
+	}
+	return w.body.Write(p)
+}
+
+// Flush writes what was buffered and sends it to the client, and has later
+// writes go straight to the client.
+func (w *timeoutWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return
+	}
+	w.commit()
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection if nothing was written yet and the wrapped
+// http.ResponseWriter allows it.
+func (w *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.timedOut:
+		return nil, nil, http.ErrHandlerTimeout
+	case w.status != 0:
+		return nil, nil, errors.New("hijacking a response already written")
+	}
+	h, ok := w.rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.ResponseWriter cannot be hijacked")
+	}
+	conn, buf, err := h.Hijack()
+	if err == nil {
+		w.committed = true
+	}
+	return conn, buf, err
+}
+
+// commit writes the header and what was buffered to rw, once. It is called
+// with mu held.
+func (w *timeoutWriter) commit() {
+	if w.committed {
+		return
+	}
+	w.committed = true
+	for k, v := range w.header {
+		w.rw.Header()[k] = v
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.rw.WriteHeader(w.status)
+	w.rw.Write(w.body.Bytes())
+	w.body.Reset()
+}
+
+// ConcurrencyLimiter limits the number of requests served at once, rejecting
+// those beyond the limit rather than queueing them. It is constructed with
+// NewConcurrencyLimiter and is required to be a singleton.
+type ConcurrencyLimiter struct {
+	slots      chan struct{} // holds a value for every request in flight
+	retryAfter time.Duration
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter serving at most max
+// requests at once and telling the clients of the others to retry after
+// retryAfter, a second if it is not positive. It panics if max is not
+// positive, as no request would ever be served.
+func NewConcurrencyLimiter(max int, retryAfter time.Duration) *ConcurrencyLimiter {
+	if max < 1 {
+		panic(fmt.Sprintf("concurrency limit of %d requests", max))
+	}
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	return &ConcurrencyLimiter{slots: make(chan struct{}, max), retryAfter: retryAfter}
+}
+
+// InFlight returns the number of requests being served, as for metrics.
+func (cl *ConcurrencyLimiter) InFlight() int {
+	return len(cl.slots)
+}
+
+// Middleware returns Middleware responding with 503 and Retry-After to
+// requests beyond the limit. The slot of a request is released once its
+// handler returns or panics.
+func (cl *ConcurrencyLimiter) Middleware() di.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			select {
+			case cl.slots <- struct{}{}:
+			default:
+				rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(cl.retryAfter.Seconds()))))
+				HTTPError(rw, http.StatusServiceUnavailable, errors.New("too many requests in flight"))
+				return
+			}
+			defer func() { <-cl.slots }()
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// RateLimiter limits the rate of requests from each client with a token bucket
+// per client. Buckets that have been idle for long are evicted so that the
+// number kept does not grow without bound. It is constructed with
+// NewRateLimiter and is required to be a singleton.
+type RateLimiter struct {
+	rate       float64 // tokens added per second
+	burst      float64 // tokens a bucket holds at most
+	key        func(*http.Request) string
+	evictAfter time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastEvict time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time // when tokens was last updated
+}
+
+// A RateLimitOption configures a RateLimiter.
+type RateLimitOption func(*RateLimiter)
+
+// RateLimitKey sets the function identifying the client of a request. It
+// defaults to ClientIP.
+func RateLimitKey(key func(*http.Request) string) RateLimitOption {
+	return func(rl *RateLimiter) { rl.key = key }
+}
+
+// RateLimitTrustProxies identifies clients by ForwardedClientIP with proxies,
+// for apps served behind proxies or load balancers that connect on behalf of
+// their clients.
+func RateLimitTrustProxies(proxies ...string) RateLimitOption {
+	return RateLimitKey(ForwardedClientIP(proxies...))
+}
+
+// RateLimitEvictAfter sets how long a bucket may be idle before it is evicted.
+// It defaults to 10 minutes.
+func RateLimitEvictAfter(d time.Duration) RateLimitOption {
+	return func(rl *RateLimiter) { rl.evictAfter = d }
+}
+
+// NewRateLimiter returns a RateLimiter allowing each client rate requests per
+// second on average and burst requests at once, configured by opts. It panics
+// if rate or burst is not positive.
+func NewRateLimiter(rate float64, burst int, opts ...RateLimitOption) *RateLimiter {
+	if !(rate > 0) || burst <= 0 {
+		panic(fmt.Sprintf("rate limit of %v requests per second, %d at once", rate, burst))
+	}
+	rl := &RateLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		key:        ClientIP,
+		evictAfter: 10 * time.Minute,
+		buckets:    make(map[string]*bucket),
+	}
+	for _, opt := range opts {
+		opt(rl)
+	}
+	return rl
+}
+
+// ClientIP returns the IP address of the client making req, the host of
+// RemoteAddr. Headers like X-Forwarded-For are ignored, as any client can set
+// them; see ForwardedClientIP for apps behind proxies.
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// ForwardedClientIP returns a function returning the IP address of the client
+// making a request through proxies, given as IP addresses or CIDR ranges. It
+// walks back from RemoteAddr through X-Forwarded-For and returns the first
+// address that is not of a proxy, since only proxies are trusted to have
+// appended to the header. It panics if a proxy cannot be parsed.
+func ForwardedClientIP(proxies ...string) func(*http.Request) string {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(proxy)
+		if err != nil {
+			panic(err.Error())
+		}
+		nets = append(nets, n)
+	}
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		for _, n := range nets {
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(req *http.Request) string {
+		client := ClientIP(req)
+		hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0 && trusted(client); i-- {
+			if hop := strings.TrimSpace(hops[i]); hop != "" {
+				client = hop
+			}
+		}
+		return client
+	}
+}
+
+// Middleware returns Middleware responding with 429 and Retry-After to
+// requests from clients that have run out of tokens.
+func (rl *RateLimiter) Middleware() di.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if wait := rl.take(rl.key(req)); wait > 0 {
+				rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				HTTPError(rw, http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// take takes a token from the bucket of client. It returns how long until a
+// token is available if there is none, and 0 otherwise.
+func (rl *RateLimiter) take(client string) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := clock.Now()
+	rl.evict(now)
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// evict removes buckets idle for longer than evictAfter, at most once every
+// evictAfter.
+func (rl *RateLimiter) evict(now time.Time) {
+	if now.Sub(rl.lastEvict) < rl.evictAfter {
+		return
+	}
+	rl.lastEvict = now
+	for client, b := range rl.buckets {
+		if now.Sub(b.last) > rl.evictAfter {
+			delete(rl.buckets, client)
+		}
+	}
+}
+
+// BasicAuth protects routes with HTTP Basic Auth, for instance the spy and
+// admin endpoints of environments that are not open.
+type BasicAuth struct {
+	Realm       string            // the realm clients are challenged for
+	Credentials map[string]string // passwords by user name
+
+	// Paths are the Binding Paths protected, along with the Paths under
+	// them. Every route is protected if it is empty.
+	Paths []string
+}
+
+// Middleware returns Middleware responding with 401 and WWW-Authenticate to
+// requests for protected routes without valid credentials.
+func (ba BasicAuth) Middleware() di.Middleware {
+	challenge := fmt.Sprintf("Basic realm=%q", ba.Realm)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if !ba.protects(req) {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			user, password, ok := req.BasicAuth()
+			if !ok {
+				rw.Header().Set("WWW-Authenticate", challenge)
+				HTTPError(rw, http.StatusUnauthorized, errors.New("no credentials"))
+				return
+			}
+			if !ba.valid(user, password) {
+				rw.Header().Set("WWW-Authenticate", challenge)
+				HTTPError(rw, http.StatusUnauthorized, errors.New("bad credentials"))
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// protects reports whether the route of req is protected.
+func (ba BasicAuth) protects(req *http.Request) bool {
+	return routedUnder(req, ba.Paths)
+}
+
+// routedUnder reports whether the route of req is one of paths or under one,
+// or whether paths is empty.
+func routedUnder(req *http.Request, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	_, path, ok := di.RouteFromContext(req)
+	if !ok {
+		path = req.URL.Path
+	}
+	for _, p := range paths {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// valid reports whether user and password are among the Credentials. Every
+// pair is compared in constant time not to leak how much of one matched.
+func (ba BasicAuth) valid(user, password string) bool {
+	found := 0
+	for u, p := range ba.Credentials {
+		found |= subtle.ConstantTimeCompare([]byte(user), []byte(u)) &
+			subtle.ConstantTimeCompare([]byte(password), []byte(p))
+	}
+	return found == 1
+}
+
+// ContentTypes restricts the media types of the bodies written to routes, for
+// instance to keep clients of a JSON-only endpoint from sending forms.
+type ContentTypes struct {
+	Allowed []string // media types accepted, without parameters
+	Methods []string // methods restricted, POST, PUT and PATCH if empty
+
+	// Paths are the Binding Paths restricted, along with the Paths under
+	// them. Every route is restricted if it is empty.
+	Paths []string
+}
+
+// Middleware returns Middleware responding with 415 to requests with a
+// restricted method and route whose Content-Type, ignoring parameters like
+// charset, is not Allowed. Requests without Content-Type are taken to be JSON,
+// as by Decode.
+func (ct ContentTypes) Middleware() di.Middleware {
+	methods := ct.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodPost, http.MethodPut, http.MethodPatch}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if !ct.restricts(methods, req) {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			contentType := req.Header.Get("Content-Type")
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			mediaType, _, err := mime.ParseMediaType(contentType)
+			if err != nil {
+				HTTPError(rw, http.StatusUnsupportedMediaType, fmt.Errorf("%w %q: %s", ErrUnsupportedMediaType, contentType, err))
+				return
+			}
+			for _, allowed := range ct.Allowed {
+				if strings.EqualFold(mediaType, allowed) {
+					next.ServeHTTP(rw, req)
+					return
+				}
+			}
+			HTTPError(rw, http.StatusUnsupportedMediaType, fmt.Errorf("%w %q", ErrUnsupportedMediaType, mediaType))
+		})
+	}
+}
+
+// restricts reports whether req has one of methods and a restricted route.
+func (ct ContentTypes) restricts(methods []string, req *http.Request) bool {
+	for _, m := range methods {
+		if req.Method == m {
+			return routedUnder(req, ct.Paths)
+		}
+	}
+	return false
+}
+
+// MaxRequestIDLength is the longest RequestIDHeader accepted from clients.
+// Longer ids, or ids with other than ASCII letters, digits, '-' and '_', are
+// replaced.
+const MaxRequestIDLength = 128
+
+// requestID is Middleware that gives the request an id, the RequestIDHeader
+// sent by the client if it is valid and a random one otherwise, and echoes it
+// in the response.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		rw.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(rw, req.WithContext(WithRequestID(req.Context(), id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
 }
 
-func (tr *ListTransport) List() ([]Message, error) {
-	return tr.msgs, nil
+// newRequestID returns 16 random hex digits.
+func newRequestID() string {
+	b := make([]byte, 8)
+	crand.Read(b) // never fails on supported platforms
+	return hex.EncodeToString(b)
 }
 
 // ReqFactory knows how to create Controllers and its dependencies.
@@ -60,23 +1903,144 @@ type ReqFactory struct {
 	req *http.Request
 }
 
-func (fa ReqFactory) newTransport() Transport {
+// newTransport returns the Transport stored in the context of the request with
+// WithTransport if there is one, that of the tenant of the request if there is
+// one and that of the environment otherwise. This selection of a dependency by
+// request is what RequestFactory allows. Operations are audited whichever it
+// is.
+func (fa ReqFactory) newTransport() (Transport, error) {
+	tr, ok := TransportFromContext(fa.req.Context())
+	if !ok {
+		tr, ok = fa.tenantTransport()
+	}
+	if !ok {
+		var err error
+		if tr, err = fa.envTransport(); err != nil {
+			return nil, err
+		}
+	}
+	if fa.af.Audit != nil {
+		tr = AuditTransport{tr, fa.af.Audit, fa.req.Context(), fa.af.AuditBestEffort}
+	}
+	return tr, nil
+}
+
+// tenantTransport returns the Transport in Tenants for the tenant named by the
+// TenantHeader of the request, and whether there is one. Without the header,
+// it returns a Transport failing with ErrNoTenant if TenantRequired is set.
+func (fa ReqFactory) tenantTransport() (Transport, bool) {
+	tenant := fa.req.Header.Get(TenantHeader)
+	if tenant == "" && fa.af.TenantRequired {
+		return errTransport{ErrNoTenant}, true
+	}
+	tr, ok := fa.af.Tenants[tenant]
+	return tr, ok
+}
+
+func (fa ReqFactory) envTransport() (Transport, error) {
+	var tr Transport
 	switch fa.af.Env {
 	case "e2e":
-		return DSTransport{appengine.NewContext(fa.req)}
+		// Derived from the request context, so that datastore calls are
+		// abandoned once the client goes away.
+		ctx := appengine.WithContext(fa.req.Context(), fa.req)
+		tr = DSTransport{
+			Ctx:       ctx,
+			RequestID: RequestIDFromContext(fa.req.Context()),
+			Kind:      fa.af.Datastore.Kind,
+			Ancestor:  fa.af.Datastore.Ancestor,
+		}
+		if fa.af.RetryAttempts > 1 {
+			tr = NewRetryTransport(tr, RetryAttempts(fa.af.RetryAttempts), RetryContext(ctx))
+		}
 	case "int":
-		return fa.af.ListTr
+		tr = fa.af.ListTr.WithRequestID(RequestIDFromContext(fa.req.Context()))
+	case "pubsub":
+		pub := fa.af.PubSub.Publisher
+		if pub == nil {
+			pub = RESTPublisher{
+				Client:   fa.af.PubSub.Client,
+				Endpoint: fa.af.PubSub.Endpoint,
+				Project:  fa.af.PubSub.Project,
+				Topic:    fa.af.PubSub.Topic,
+			}
+		}
+		tr = PubSubTransport{Publisher: pub, Ctx: fa.req.Context()}
 	default:
-		panic(fmt.Sprintf("do not know how to make Transport for env %q", fa.af.Env))
+		return nil, fmt.Errorf("do not know how to make Transport for env %q", fa.af.Env)
+	}
+	return tr, nil
+}
+
+// errTransport implements Transport by failing every operation with err.
+type errTransport struct {
+	err error
+}
+
+func (tr errTransport) Send(Message) (string, error) {
+	return "", tr.err
+}
+
+func (tr errTransport) List(MessageFilter) ([]Message, error) {
+	return nil, tr.err
+}
+
+// newIdempotencyStore returns a DSIdempotencyStore in env "e2e" if
+// IdempotencyInDatastore is set, and Idempotency otherwise.
+func (fa ReqFactory) newIdempotencyStore() IdempotencyStore {
+	if fa.af.IdempotencyInDatastore && fa.af.Env == "e2e" {
+		return DSIdempotencyStore{appengine.WithContext(fa.req.Context(), fa.req), fa.af.IdempotencyTTL}
+	}
+	return fa.af.Idempotency
+}
+
+// newLogger returns a Logger for the request that prefixes what it logs with
+// the id of the request.
+func (fa ReqFactory) newLogger() *log.Logger {
+	id := RequestIDFromContext(fa.req.Context())
+	if id == "" {
+		id = "-"
+	}
+	out := fa.af.LogOutput
+	if out == nil {
+		out = os.Stderr
 	}
+	return log.New(out, "["+id+"] ", log.LstdFlags)
 }
 
+// NewController is NewControllerErr panicking on errors.
 func (fa ReqFactory) NewController(label string) di.Controller {
+	ctrl, err := fa.NewControllerErr(label)
+	if err != nil {
+		panic(err.Error())
+	}
+	return ctrl
+}
+
+// NewControllerErr returns the Controller registered as label, failing if it
+// or its Transport is unknown, as for a misconfigured Env, so that the
+// Dispatcher responds with 500 rather than panic.
+func (fa ReqFactory) NewControllerErr(label string) (di.Controller, error) {
+	switch label {
+	case "message", "debug", "health":
+	default:
+		return nil, fmt.Errorf("do not know how to make %q", label)
+	}
+	tr, err := fa.newTransport()
+	if err != nil {
+		return nil, err
+	}
 	switch label {
 	case "message":
-		return MessageController{fa.newTransport()}
+		return MessageController{
+			Transport:   tr,
+			Logger:      fa.newLogger(),
+			Idempotency: fa.newIdempotencyStore(),
+		}, nil
+	case "debug":
+		return DebugController{tr, fa.af.Debug}, nil
 	default:
-		panic(fmt.Sprintf("do not know how to make %q", label))
+		return HealthController{fa.af.Env, tr}, nil
 	}
 }
 
@@ -84,6 +2048,92 @@ func (fa ReqFactory) NewController(label string) di.Controller {
 type AppFactory struct {
 	Env    string
 	ListTr *ListTransport
+	Debug  bool // serve diagnostics from DebugController
+
+	RetryAttempts int // retry datastore operations if greater than 1
+
+	Audit           AuditSink // audit every Transport operation if set
+	AuditBestEffort bool      // do not fail operations that cannot be audited
+
+	PubSub    PubSubConfig    // where messages are published for env "pubsub"
+	Datastore DatastoreConfig // how messages are stored for env "e2e"
+
+	BodyLog     *BodyLog            // log request and response bodies, never in production
+	Concurrency *ConcurrencyLimiter // limit the number of requests in flight if set
+	RateLimit   *RateLimiter        // limit the rate of requests per client if set
+	BasicAuth   *BasicAuth          // require HTTP Basic Auth for the routes it protects if set
+	ContentType *ContentTypes       // reject bodies of media types not allowed with 415 if set
+	Timeout     *Timeout            // respond with 503 to requests served too slowly if set
+	Gzip        bool                // compress responses for clients accepting gzip
+
+	// Tenants holds the Transports of tenants, selected by the TenantHeader
+	// of requests. Requests for other tenants use the Transport for Env.
+	Tenants map[string]Transport
+	// TenantRequired fails requests without TenantHeader with 400.
+	TenantRequired bool
+
+	LogOutput io.Writer // where Controllers log, defaults to os.Stderr
+
+	// Auth authenticates requests for every Binding that has no Authenticator
+	// of its own if set, like di.BearerTokens.
+	Auth di.Authenticator
+
+	// Idempotency remembers the responses to Sends with an
+	// IdempotencyKeyHeader if set, like a MemoryIdempotencyStore.
+	// IdempotencyInDatastore remembers them in Datastore instead, for
+	// IdempotencyTTL, in env "e2e".
+	Idempotency            IdempotencyStore
+	IdempotencyInDatastore bool
+	IdempotencyTTL         time.Duration
+}
+
+// Authenticator returns the Authenticator Setup applies to every Binding.
+func (fa AppFactory) Authenticator() di.Authenticator {
+	return fa.Auth
+}
+
+// Middleware returns the Middleware Setup applies to every Binding.
+func (fa AppFactory) Middleware() []di.Middleware {
+	mws := []di.Middleware{requestID}
+	if fa.Concurrency != nil {
+		mws = append(mws, fa.Concurrency.Middleware())
+	}
+	if fa.RateLimit != nil {
+		mws = append(mws, fa.RateLimit.Middleware())
+	}
+	if fa.BasicAuth != nil {
+		mws = append(mws, fa.BasicAuth.Middleware())
+	}
+	if fa.ContentType != nil {
+		mws = append(mws, fa.ContentType.Middleware())
+	}
+	if fa.Gzip {
+		mws = append(mws, di.GzipMiddleware(0))
+	}
+	if fa.BodyLog != nil {
+		mws = append(mws, fa.BodyLog.Middleware())
+	}
+	if fa.Timeout != nil {
+		mws = append(mws, fa.Timeout.Middleware())
+	}
+	return mws
+}
+
+// DatastoreConfig configures the DSTransport made for every request. Its zero
+// value stores messages as kind "message" under RootAncestor.
+type DatastoreConfig struct {
+	Kind     string
+	Ancestor func(context.Context) *datastore.Key
+}
+
+// PubSubConfig configures the PubSubTransport made for every request. It
+// publishes with Publisher if set, or else with a RESTPublisher of the rest.
+type PubSubConfig struct {
+	Publisher Publisher
+	Client    *http.Client // authorizes requests to Pub/Sub
+	Endpoint  string       // defaults to PubSubEndpoint
+	Project   string
+	Topic     string
 }
 
 func (fa AppFactory) With(req *http.Request) di.RequestFactory {
@@ -3,18 +3,2930 @@
 package message_test
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 
 	. "github.com/kkrs/godi-code"
+	"github.com/kkrs/godi-code/di"
+	"github.com/kkrs/godi-code/di/router"
+	"github.com/kkrs/godi-code/messagetest"
 )
 
 func TestSend(t *testing.T) {
 	transport := Setup(
-		AppFactory{"int", &ListTransport{}}, []Registration{
+		AppFactory{Env: "int", ListTr: &ListTransport{}}, []Registration{
 			{MessageController{}, "message"},
 		})
 
 	server := httptest.NewServer(transport)
 	testSend(t, server.URL)
 }
+
+func TestNotFound(t *testing.T) {
+	server, _ := messagetest.NewServer()
+	defer server.Close()
+
+	t.Logf("Scenario: An unknown path is not found with a JSON error")
+	t.Log()
+	req, _ := http.NewRequest("GET", server.URL+"/unknown", nil)
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, "Request GET, /unknown", resp, err, http.StatusNotFound,
+		map[string]string{"error": "no route for /unknown"},
+	)
+}
+
+func TestTimeLayouts(t *testing.T) {
+	t.Logf("Scenario: Sent times are decoded from any of TimeLayouts")
+	want := time.Date(2016, 10, 2, 15, 4, 5, 0, time.UTC)
+	for _, sent := range []string{"2016-10-02T15:04:05Z", "Sun, 02 Oct 2016 15:04:05 UTC", "2016-10-02 15:04:05"} {
+		t.Logf("\t%q", sent)
+		var msg Message
+		if err := Unmarshal(strings.NewReader(`{"From": "kkrs", "Sent": "`+sent+`"}`), &msg); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		if msg.From != "kkrs" || !msg.Sent.Equal(want) {
+			t.Fatalf("got %+v", msg)
+		}
+	}
+
+	t.Logf("Scenario: Sending a message with an unknown time layout is a bad request")
+	server, _ := messagetest.NewServer()
+	defer server.Close()
+	body := bytes.NewBufferString(`{"From": "kkrs", "Sent": "02/10/2016"}`)
+	resp, err := http.Post(server.URL+APIPath, "application/json", body)
+	verify(t, "Request POST, "+APIPath, resp, err, http.StatusBadRequest, nil)
+}
+
+func TestListNewestFirst(t *testing.T) {
+	server, _ := messagetest.NewServer()
+	defer server.Close()
+
+	t.Logf("Scenario: Messages are listed newest first with increasing IDs")
+	t.Log()
+	var sent []Message
+	for _, text := range []string{"first", "second", "third"} {
+		req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world", Message: text})
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc, resp, err, http.StatusCreated, nil)
+		var msg Message
+		if err := Unmarshal(resp.Body, &msg); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		sent = append([]Message{msg}, sent...)
+	}
+	if sent[0].ID != "3" || sent[2].ID != "1" {
+		t.Fatalf("got IDs %q, %q, %q", sent[2].ID, sent[1].ID, sent[0].ID)
+	}
+
+	req, desc := listRequest(server.URL)
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusOK, sent)
+}
+
+func TestTransportStats(t *testing.T) {
+	newServer := func(debug bool) *httptest.Server {
+		return httptest.NewServer(Setup(
+			AppFactory{Env: "int", ListTr: &ListTransport{}, Debug: debug}, []Registration{
+				{MessageController{}, "message"},
+				{DebugController{}, "debug"},
+			}))
+	}
+
+	t.Logf("Scenario: Transport stats reflect the messages stored")
+	t.Log()
+	server := newServer(true)
+	defer server.Close()
+	for _, msg := range []Message{
+		{From: "kkrs", To: "world", Message: "hello"},
+		{From: "world", To: "kkrs", Message: "hi"},
+	} {
+		req, desc := sendRequest(server.URL, msg)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc, resp, err, http.StatusCreated, nil)
+	}
+
+	req, desc := statsRequest(server.URL)
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusOK, nil)
+	var stats TransportStats
+	if err := Unmarshal(resp.Body, &stats); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	t.Logf("\tcount 2 and oldest no later than newest")
+	if stats.Count != 2 || stats.Capacity < stats.Count {
+		t.Fatalf("got %+v", stats)
+	}
+	if stats.Oldest.IsZero() || stats.Newest.Before(stats.Oldest) {
+		t.Fatalf("got %+v", stats)
+	}
+
+	t.Logf("Scenario: Transport stats are not served unless enabled")
+	t.Log()
+	server = newServer(false)
+	defer server.Close()
+	req, desc = statsRequest(server.URL)
+	resp, err = http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusNotFound, nil)
+}
+
+func TestReplicaRoundRobin(t *testing.T) {
+	t.Logf("Scenario: Round robin reads alternate between backends")
+	primary, replica := &ListTransport{}, &ListTransport{}
+	replica.Send(Message{From: "replica"})
+	tr := &ReplicaTransport{Primary: primary, Replicas: []Transport{replica}, Strategy: RoundRobin}
+
+	if _, err := tr.Send(Message{From: "primary"}); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	for i, want := range []string{"primary", "replica", "primary", "replica"} {
+		msgs, err := tr.List(MessageFilter{})
+		if err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		if len(msgs) != 1 || msgs[0].From != want {
+			t.Fatalf("List %d: got %+v but expected a message from %s", i, msgs, want)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	var recs []AuditRecord
+	sink := AuditFunc(func(rec AuditRecord) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: &ListTransport{}, Audit: sink}, []Registration{
+			{MessageController{}, "message"},
+		}))
+	defer server.Close()
+
+	t.Logf("Scenario: Sending and listing messages are audited")
+	testSend(t, server.URL)
+	if len(recs) != 2 || recs[0].Op != "send" || recs[1].Op != "list" {
+		t.Fatalf("got audit records %+v", recs)
+	}
+	if recs[0].What != `from "kkrs" to "world"` || recs[0].Time.IsZero() {
+		t.Fatalf("got audit record %+v", recs[0])
+	}
+
+	if recs[0].User != "" {
+		t.Fatalf("got audit record %+v of an unauthenticated request", recs[0])
+	}
+
+	t.Logf("Scenario: Audit records name the user the request was authenticated as")
+	recs = nil
+	authed := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: &ListTransport{}, Audit: sink, Auth: di.BearerTokens{"s3cret": {Name: "alice"}}},
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer authed.Close()
+	req, desc := listRequest(authed.URL)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusOK, nil)
+	if len(recs) != 1 || recs[0].User != "alice" {
+		t.Fatalf("got audit records %+v", recs)
+	}
+
+	t.Logf("Scenario: Operations that cannot be audited fail unless best effort")
+	list := &ListTransport{}
+	tr := AuditTransport{
+		Inner: list,
+		Sink:  AuditFunc(func(AuditRecord) error { return errors.New("sink down") }),
+		Ctx:   context.Background(),
+	}
+	if _, err := tr.Send(Message{From: "kkrs"}); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if msgs, _ := list.List(MessageFilter{}); len(msgs) != 0 {
+		t.Fatalf("got %+v sent", msgs)
+	}
+	tr.BestEffort = true
+	if _, err := tr.Send(Message{From: "kkrs"}); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+}
+
+func TestWrongController(t *testing.T) {
+	for _, c := range []struct {
+		desc string
+		ctrl di.Controller
+	}{
+		{"of the wrong type", DebugController{}},
+		{"that is nil", nil},
+	} {
+		t.Logf("Scenario: A factory returning a controller %s fails the request", c.desc)
+		t.Log()
+		ctrl := c.ctrl
+		server := httptest.NewServer(Setup(
+			factoryFunc(func(string) di.Controller { return ctrl }), []Registration{
+				{MessageController{}, "message"},
+			}))
+		req, desc := listRequest(server.URL)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc, resp, err, http.StatusInternalServerError, map[string]string{"error": "Internal Server Error"})
+		server.Close()
+	}
+}
+
+// pathController binds List to path.
+type pathController struct {
+	path string
+}
+
+func (ct pathController) Bindings() []di.Binding {
+	return []di.Binding{{Verb: "GET", Path: ct.path, Name: "List"}}
+}
+
+func (pathController) List(http.ResponseWriter, *http.Request) {}
+
+// flakyTransport fails with errs, in order, before delegating to ListTransport.
+type flakyTransport struct {
+	ListTransport
+	errs  []error
+	calls int
+}
+
+func (tr *flakyTransport) Send(msg Message) (string, error) {
+	tr.calls++
+	if len(tr.errs) > 0 {
+		err := tr.errs[0]
+		tr.errs = tr.errs[1:]
+		return "", err
+	}
+	return tr.ListTransport.Send(msg)
+}
+
+// temporary is an error that IsTemporary recognizes.
+type temporary string
+
+func (err temporary) Error() string   { return string(err) }
+func (err temporary) Temporary() bool { return true }
+
+// timeout is a temporary error that is a timeout, after which the operation
+// that failed may have succeeded.
+type timeout string
+
+func (err timeout) Error() string   { return string(err) }
+func (err timeout) Temporary() bool { return true }
+func (err timeout) Timeout() bool   { return true }
+
+// flakyListTransport fails List with errs, in order, before delegating to
+// ListTransport.
+type flakyListTransport struct {
+	flakyTransport
+}
+
+func (tr *flakyListTransport) List(filter MessageFilter) ([]Message, error) {
+	tr.calls++
+	if len(tr.errs) > 0 {
+		err := tr.errs[0]
+		tr.errs = tr.errs[1:]
+		return nil, err
+	}
+	return tr.ListTransport.List(filter)
+}
+
+func TestRetryTransport(t *testing.T) {
+	t.Logf("Scenario: Temporary errors are retried until the send succeeds")
+	inner := &flakyTransport{errs: []error{temporary("timeout"), temporary("timeout")}}
+	tr := NewRetryTransport(inner, RetryBackoff(time.Millisecond))
+	if _, err := tr.Send(Message{From: "kkrs"}); err != nil || inner.calls != 3 {
+		t.Fatalf("got error '%v' after %d calls", err, inner.calls)
+	}
+
+	t.Logf("Scenario: Errors that are not retryable are returned at once")
+	inner = &flakyTransport{errs: []error{errors.New("bad message")}}
+	tr = NewRetryTransport(inner, RetryBackoff(time.Millisecond))
+	if _, err := tr.Send(Message{From: "kkrs"}); err == nil || inner.calls != 1 {
+		t.Fatalf("got error '%v' after %d calls", err, inner.calls)
+	}
+
+	t.Logf("Scenario: Attempts are limited")
+	inner = &flakyTransport{errs: []error{temporary("1"), temporary("2"), temporary("3")}}
+	tr = NewRetryTransport(inner, RetryBackoff(time.Millisecond), RetryAttempts(2))
+	if _, err := tr.Send(Message{From: "kkrs"}); err == nil || err.Error() != "2" {
+		t.Fatalf("got error '%v' after %d calls", err, inner.calls)
+	}
+
+	t.Logf("Scenario: Retries stop at the context deadline")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	inner = &flakyTransport{errs: []error{temporary("1"), temporary("2")}}
+	tr = NewRetryTransport(inner, RetryBackoff(time.Second), RetryContext(ctx))
+	if _, err := tr.Send(Message{From: "kkrs"}); err == nil || inner.calls != 1 {
+		t.Fatalf("got error '%v' after %d calls", err, inner.calls)
+	}
+
+	t.Logf("Scenario: Sends timing out are not retried, as they may have succeeded")
+	inner = &flakyTransport{errs: []error{timeout("timeout")}}
+	tr = NewRetryTransport(inner, RetryBackoff(time.Millisecond))
+	if _, err := tr.Send(Message{From: "kkrs"}); err == nil || inner.calls != 1 {
+		t.Fatalf("got error '%v' after %d calls", err, inner.calls)
+	}
+
+	t.Logf("Scenario: Lists timing out are retried")
+	lister := &flakyListTransport{flakyTransport{errs: []error{timeout("timeout")}}}
+	tr = NewRetryTransport(lister, RetryBackoff(time.Millisecond))
+	if _, err := tr.List(MessageFilter{}); err != nil || lister.calls != 2 {
+		t.Fatalf("got error '%v' after %d calls", err, lister.calls)
+	}
+}
+
+func TestWrappersKeepCapabilities(t *testing.T) {
+	nop := AuditFunc(func(AuditRecord) error { return nil })
+	for name, wrap := range map[string]func(Transport) Transport{
+		"RetryTransport":   func(tr Transport) Transport { return NewRetryTransport(tr) },
+		"AuditTransport":   func(tr Transport) Transport { return AuditTransport{Inner: tr, Sink: nop, Ctx: context.Background()} },
+		"MultiTransport":   func(tr Transport) Transport { return NewMultiTransport(tr) },
+		"ReplicaTransport": func(tr Transport) Transport { return &ReplicaTransport{Primary: tr} },
+	} {
+		tr := wrap(&pingTransport{})
+
+		t.Logf("Scenario: %s sends batches and gets, updates, streams and searches messages", name)
+		ids, err := tr.(BatchSender).SendBatch([]Message{{From: "kkrs", To: "world", Message: "hello"}})
+		if err != nil || len(ids) != 1 {
+			t.Fatalf("got IDs %v and error '%v'", ids, err)
+		}
+		if err := tr.(Updater).Update(ids[0], Message{From: "kkrs", To: "world", Message: "bye"}, 0); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		if msg, err := tr.(Getter).Get(ids[0]); err != nil || msg.Version != 1 {
+			t.Fatalf("got %+v and error '%v'", msg, err)
+		}
+		var streamed int
+		if err := tr.(Streamer).ListStream(MessageFilter{}, func(Message) error { streamed++; return nil }); err != nil || streamed != 1 {
+			t.Fatalf("got %d messages and error '%v'", streamed, err)
+		}
+		if msgs, err := tr.(Searcher).Search("bye"); err != nil || len(msgs) != 1 {
+			t.Fatalf("got %+v and error '%v'", msgs, err)
+		}
+
+		t.Logf("Scenario: %s is pinged, inspected and watched through", name)
+		rec := httptest.NewRecorder()
+		HealthController{"test", tr}.Check(rec, httptest.NewRequest("GET", HealthPath, nil))
+		if !strings.Contains(rec.Body.String(), `"Transport":"ok"`) {
+			t.Fatalf("got health %s", rec.Body)
+		}
+		rec = httptest.NewRecorder()
+		DebugController{Enabled: true, Transport: tr}.Stats(rec, httptest.NewRequest("GET", "/debug/stats", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d", rec.Code)
+		}
+		server := httptest.NewServer(http.HandlerFunc(MessageController{Transport: tr}.Watch))
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		tr.Send(Message{From: "kkrs", To: "world"})
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestWrapKeepsCause(t *testing.T) {
+	t.Logf("Scenario: Errors reported by the controller wrap their cause")
+	errDown := errors.New("transport down")
+	if err := Wrap("sending message", errDown); !errors.Is(err, errDown) {
+		t.Fatalf("errors.Is(%q, %q) is false", err, errDown)
+	}
+}
+
+func TestDecoders(t *testing.T) {
+	Decoders["application/xml"] = func(body io.Reader, dst interface{}) error {
+		return xml.NewDecoder(body).Decode(dst)
+	}
+	defer delete(Decoders, "application/xml")
+	server, _ := messagetest.NewServer()
+	defer server.Close()
+
+	for _, c := range []struct {
+		contentType, body string
+		status            int
+	}{
+		{"application/json", `{"From": "kkrs", "To": "world", "Message": "hello"}`, http.StatusCreated},
+		{"application/json; charset=utf-8", `{"From": "kkrs", "To": "world", "Message": "hello"}`, http.StatusCreated},
+		{"application/xml", `<Message><From>kkrs</From><To>world</To><Message>hello</Message></Message>`, http.StatusCreated},
+		{"application/x-www-form-urlencoded", `from=kkrs&to=world&message=hello`, http.StatusCreated},
+		{"text/plain", `kkrs to world: hello`, http.StatusUnsupportedMediaType},
+	} {
+		t.Logf("Scenario: Sending a message as %s", c.contentType)
+		resp, err := http.Post(server.URL+APIPath, c.contentType, strings.NewReader(c.body))
+		verify(t, "Request POST, "+APIPath, resp, err, c.status, nil)
+		if c.status != http.StatusCreated {
+			continue
+		}
+		var msg Message
+		if err := Unmarshal(resp.Body, &msg); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		if msg.From != "kkrs" || msg.To != "world" || msg.Message != "hello" {
+			t.Fatalf("got %+v", msg)
+		}
+	}
+
+	t.Logf("Scenario: Sending a batch of messages as a form is unsupported")
+	resp, err := http.Post(server.URL+APIPath+"/batch", "application/x-www-form-urlencoded", strings.NewReader("from=kkrs"))
+	verify(t, "Request POST, "+APIPath+"/batch", resp, err, http.StatusUnsupportedMediaType, nil)
+}
+
+func TestListFilter(t *testing.T) {
+	server, _ := messagetest.NewServer()
+	defer server.Close()
+
+	var sent []Message // newest first
+	for _, msg := range []Message{
+		{From: "kkrs", To: "world", Message: "hello"},
+		{From: "world", To: "kkrs", Message: "hi"},
+		{From: "kkrs", To: "moon", Message: "hey"},
+	} {
+		req, desc := sendRequest(server.URL, msg)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc, resp, err, http.StatusCreated, nil)
+		if err := Unmarshal(resp.Body, &msg); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		sent = append([]Message{msg}, sent...)
+	}
+
+	for _, c := range []struct {
+		query string
+		msgs  []Message
+	}{
+		{"", sent},
+		{"?from=kkrs", []Message{sent[0], sent[2]}},
+		{"?from=kkrs&to=world", []Message{sent[2]}},
+	} {
+		t.Logf("Scenario: Listing messages with query %q", c.query)
+		req, _ := http.NewRequest("GET", server.URL+SpyPath+c.query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, "Request GET, "+SpyPath+c.query, resp, err, http.StatusOK, c.msgs)
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+	server, _ := messagetest.NewServer()
+	defer server.Close()
+
+	// do sends req asking for msgpack and decodes the msgpack response into dst
+	do := func(req *http.Request, desc string, status int, dst interface{}) {
+		req.Header.Set("Accept", "application/msgpack")
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc, resp, err, status, nil)
+		t.Logf("\tContent-Type 'application/msgpack'")
+		if got := resp.Header.Get("Content-Type"); got != "application/msgpack" {
+			t.Fatalf("got Content-Type '%s'", got)
+		}
+		if err := msgpack.NewDecoder(resp.Body).Decode(dst); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+	}
+
+	t.Logf("Scenario: A message sent as msgpack is echoed as msgpack")
+	msg := Message{From: "kkrs", To: "world", Message: "hello"}
+	body, err := msgpack.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", server.URL+APIPath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/msgpack")
+	var sent Message
+	do(req, "Request POST, "+APIPath+" with a msgpack body", http.StatusCreated, &sent)
+	if sent.ID == "" || sent.Sent.IsZero() || sent.From != msg.From || sent.To != msg.To || sent.Message != msg.Message {
+		t.Fatalf("got %+v", sent)
+	}
+
+	t.Logf("Scenario: Messages are listed as msgpack")
+	req, desc := listRequest(server.URL)
+	var msgs []Message
+	do(req, desc, http.StatusOK, &msgs)
+	// msgpack does not keep the location of times, so compare instants
+	if len(msgs) != 1 || !msgs[0].Sent.Equal(sent.Sent) {
+		t.Fatalf("got %+v", msgs)
+	}
+	msgs[0].Sent = sent.Sent
+	if msgs[0] != sent {
+		t.Fatalf("got %+v but expected %+v", msgs[0], sent)
+	}
+}
+
+func TestHTTPErrorEscapes(t *testing.T) {
+	t.Logf("Scenario: An error with quotes, backslashes and newlines is valid JSON")
+	msg := "error reading request: invalid character '\"' in \\path\\\nand more"
+	rec := httptest.NewRecorder()
+	HTTPError(rec, http.StatusBadRequest, errors.New(msg))
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("got Content-Type '%s'", got)
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("got error '%s' for body %s", err, rec.Body)
+	}
+	if rec.Code != http.StatusBadRequest || body.Error != msg {
+		t.Fatalf("got status %d and error %q", rec.Code, body.Error)
+	}
+}
+
+// pingTransport is a ListTransport that is a Pinger failing with err.
+type pingTransport struct {
+	ListTransport
+	err error
+}
+
+func (tr *pingTransport) Ping() error {
+	return tr.err
+}
+
+func TestHealth(t *testing.T) {
+	t.Logf("Scenario: A Transport that is not a Pinger is reported unchecked")
+	server, _ := messagetest.NewServer(Registration{MessageController{}, "message"}, Registration{HealthController{}, "health"})
+	defer server.Close()
+	resp, err := http.Get(server.URL + HealthPath)
+	verify(t, "Request GET, "+HealthPath, resp, err, http.StatusOK, Health{Env: "int", Transport: "unchecked"})
+
+	for _, c := range []struct {
+		err    error
+		status int
+		health Health
+	}{
+		{nil, http.StatusOK, Health{Env: "test", Transport: "ok"}},
+		{errors.New("no backend"), http.StatusServiceUnavailable, Health{Env: "test", Transport: "unreachable", Error: "no backend"}},
+	} {
+		t.Logf("Scenario: A Pinger failing with %v is reported %s", c.err, c.health.Transport)
+		tr := &pingTransport{err: c.err}
+		server := httptest.NewServer(Setup(
+			factoryFunc(func(string) di.Controller { return HealthController{"test", tr} }),
+			[]Registration{{HealthController{}, "health"}},
+		))
+		resp, err := http.Get(server.URL + HealthPath)
+		verify(t, "Request GET, "+HealthPath, resp, err, c.status, c.health)
+		server.Close()
+	}
+}
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestClock(t *testing.T) {
+	clk := &fakeClock{time.Date(2016, 2, 10, 12, 0, 0, 0, time.UTC)}
+	SetClock(clk)
+	defer SetClock(nil)
+
+	var recs []AuditRecord
+	list := &ListTransport{}
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: list, Audit: AuditFunc(func(rec AuditRecord) error {
+			recs = append(recs, rec)
+			return nil
+		})}, []Registration{
+			{MessageController{}, "message"},
+		}))
+	defer server.Close()
+
+	t.Logf("Scenario: Messages and audit records are timestamped by the clock")
+	var sent []Message
+	for _, msg := range []Message{{From: "kkrs", To: "world", Message: "first"}, {From: "kkrs", To: "world", Message: "second"}} {
+		req, desc := sendRequest(server.URL, msg)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc, resp, err, http.StatusCreated, nil)
+		if err := Unmarshal(resp.Body, &msg); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		if !msg.Sent.Equal(clk.Now()) || !recs[len(recs)-1].Time.Equal(clk.Now()) {
+			t.Fatalf("got message %+v and audit record %+v at %s", msg, recs[len(recs)-1], clk.Now())
+		}
+		sent = append(sent, msg)
+		clk.Advance(time.Hour)
+	}
+
+	t.Logf("Scenario: Stats report the times from the clock")
+	stats := list.Stats()
+	if !stats.Oldest.Equal(sent[0].Sent) || stats.Newest.Sub(stats.Oldest) != time.Hour {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+func TestSentPrecision(t *testing.T) {
+	zone := time.FixedZone("CET", 3600)
+	clk := &fakeClock{time.Date(2016, 2, 10, 13, 0, 0, 123456789, zone)}
+	SetClock(clk)
+	defer SetClock(nil)
+	server, list := messagetest.NewServer()
+	defer server.Close()
+
+	t.Logf("Scenario: Messages are stamped in UTC to the microsecond, as Datastore keeps them")
+	want := Message{From: "kkrs", To: "world", Message: "hello", Sent: time.Date(2016, 2, 10, 12, 0, 0, 123456000, time.UTC)}
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world", Message: "hello"})
+	resp, err := http.DefaultClient.Do(req)
+	var got Message
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+	if err := Unmarshal(resp.Body, &got); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	want.ID = got.ID
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v but expected %+v", got, want)
+	}
+	if msgs, _ := list.List(MessageFilter{}); len(msgs) != 1 || !reflect.DeepEqual(msgs[0], want) {
+		t.Fatalf("got stored %+v", msgs)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	defer func(size int64) { MaxBodySize = size }(MaxBodySize)
+	MaxBodySize = 64
+	server, list := messagetest.NewServer()
+	defer server.Close()
+
+	t.Logf("Scenario: A body just over MaxBodySize is rejected without sending")
+	prefix, suffix := `{"From": "kkrs", "Message": "`, `"}`
+	body := prefix + strings.Repeat("x", int(MaxBodySize)+1-len(prefix)-len(suffix)) + suffix
+	resp, err := http.Post(server.URL+APIPath, "application/json", strings.NewReader(body))
+	verify(t, "Request POST, "+APIPath+" with a body over the limit", resp, err, http.StatusRequestEntityTooLarge, nil)
+	if msgs, _ := list.List(MessageFilter{}); len(msgs) != 0 {
+		t.Fatalf("got %+v sent", msgs)
+	}
+
+	t.Logf("Scenario: Unmarshal rejects a body over MaxBodySize")
+	var msg Message
+	var tooLarge *http.MaxBytesError
+	if err := Unmarshal(strings.NewReader(body), &msg); !errors.As(err, &tooLarge) {
+		t.Fatalf("got error '%v'", err)
+	}
+}
+
+// panicController panics serving requests.
+type panicController struct{}
+
+func (panicController) Bindings() []di.Binding {
+	return []di.Binding{{Verb: "GET", Path: "/panic", Name: "Panic"}}
+}
+
+func (panicController) Panic(http.ResponseWriter, *http.Request) {
+	panic("controller panicked")
+}
+
+func TestSpyTransport(t *testing.T) {
+	spy := &messagetest.SpyTransport{}
+	ctrl := MessageController{Transport: spy}
+	send := func(body string) int {
+		rec := httptest.NewRecorder()
+		ctrl.Send(rec, httptest.NewRequest("POST", APIPath, strings.NewReader(body)))
+		return rec.Code
+	}
+
+	t.Logf("Scenario: Malformed requests do not reach the Transport")
+	if code := send("{"); code != http.StatusBadRequest {
+		t.Fatalf("got status %d", code)
+	}
+	if calls := spy.Calls(); len(calls) != 0 {
+		t.Fatalf("got calls %v", calls)
+	}
+
+	t.Logf("Scenario: Calls are recorded in order with the messages sent")
+	if code := send(`{"From":"kkrs","To":"world","Message":"hello"}`); code != http.StatusCreated {
+		t.Fatalf("got status %d", code)
+	}
+	rec := httptest.NewRecorder()
+	ctrl.List(rec, httptest.NewRequest("GET", APIPath, nil))
+	if calls := spy.Calls(); !reflect.DeepEqual(calls, []string{"Send", "List"}) {
+		t.Fatalf("got calls %v", calls)
+	}
+	if sent := spy.Sent(); len(sent) != 1 || sent[0].ID != "1" || sent[0].Message != "hello" {
+		t.Fatalf("got sent %+v", sent)
+	}
+
+	t.Logf("Scenario: Canned errors are returned once each")
+	spy.Fail("Send", errors.New("down"))
+	if code := send(`{"From":"kkrs","To":"world","Message":"again"}`); code != http.StatusInternalServerError {
+		t.Fatalf("got status %d", code)
+	}
+	if code := send(`{"From":"kkrs","To":"world","Message":"again"}`); code != http.StatusCreated {
+		t.Fatalf("got status %d", code)
+	}
+	if sent := spy.Sent(); len(sent) != 2 {
+		t.Fatalf("got sent %+v", sent)
+	}
+
+	t.Logf("Scenario: The spy is safe for concurrent use")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send(`{"From":"kkrs","To":"world","Message":"hi"}`)
+		}()
+	}
+	wg.Wait()
+	if sent := spy.Sent(); len(sent) != 10 {
+		t.Fatalf("got %d sent", len(sent))
+	}
+}
+
+func TestListEncodingError(t *testing.T) {
+	spy := &messagetest.SpyTransport{}
+	ctrl := MessageController{Transport: spy}
+	// times past year 9999 cannot be encoded in JSON
+	spy.Send(Message{From: "kkrs", To: "world", Message: "later", Sent: time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)})
+	list := func(accept string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", APIPath, nil)
+		req.Header.Set("Accept", accept)
+		ctrl.List(rec, req)
+		return rec
+	}
+
+	for _, accept := range []string{"application/json", NDJSON} {
+		t.Logf("Scenario: A message failing to encode as %s is answered with a clean 500", accept)
+		rec := list(accept)
+		var body struct{ Error string }
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusInternalServerError {
+			t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+		}
+		if !strings.Contains(body.Error, "encoding response as "+accept) {
+			t.Fatalf("got error '%s'", body.Error)
+		}
+	}
+
+	t.Logf("Scenario: A message failing to encode mid-stream cuts the stream after the last whole line")
+	spy.Send(Message{From: "kkrs", To: "world", Message: "now", Sent: time.Now()})
+	rec := list(NDJSON)
+	lines := strings.Split(rec.Body.String(), "\n")
+	if rec.Code != http.StatusOK || len(lines) != 2 || lines[1] != "" || !strings.Contains(lines[0], `"now"`) {
+		t.Fatalf("got %d '%s'", rec.Code, rec.Body.String())
+	}
+}
+
+func TestFactoryError(t *testing.T) {
+	t.Logf("Scenario: An unknown Env is answered with 500 without panicking")
+	server := httptest.NewServer(Setup(AppFactory{Env: "unknown"}, []Registration{{MessageController{}, "message"}}))
+	defer server.Close()
+	req, desc := listRequest(server.URL)
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusInternalServerError, nil)
+}
+
+// unlistableTransport sends messages but cannot list them, like
+// PubSubTransport.
+type unlistableTransport struct{}
+
+func (unlistableTransport) Send(Message) (string, error) {
+	return "1", nil
+}
+
+func (unlistableTransport) List(MessageFilter) ([]Message, error) {
+	return nil, ErrListUnsupported
+}
+
+func TestSearch(t *testing.T) {
+	search := func(tr Transport, query, accept string) (int, []Message) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", SpyPath+"?"+query, nil)
+		req.Header.Set("Accept", accept)
+		MessageController{Transport: tr}.List(rec, req)
+		var msgs []Message
+		dec := json.NewDecoder(rec.Body)
+		if accept == NDJSON {
+			for dec.More() {
+				var msg Message
+				dec.Decode(&msg)
+				msgs = append(msgs, msg)
+			}
+		} else if rec.Code == http.StatusOK {
+			dec.Decode(&msgs)
+		}
+		return rec.Code, msgs
+	}
+	list, spy := &ListTransport{}, &messagetest.SpyTransport{}
+	for _, msg := range []Message{
+		{From: "kkrs", To: "world", Message: "Hello World"},
+		{From: "other", To: "world", Message: "well, hello there"},
+		{From: "kkrs", To: "world", Message: "bye"},
+	} {
+		list.Send(msg)
+		spy.Send(msg)
+	}
+
+	for _, tr := range []Transport{list, spy} {
+		for _, c := range []struct {
+			query, accept string
+			want          []string
+		}{
+			{"q=HELLO", "application/json", []string{"well, hello there", "Hello World"}},
+			{"q=hello&from=kkrs", "application/json", []string{"Hello World"}},
+			{"q=hello&to=nobody", "application/json", nil},
+			{"q=hello", NDJSON, []string{"well, hello there", "Hello World"}},
+		} {
+			t.Logf("Scenario: Searching %T with %s, accepting %s", tr, c.query, c.accept)
+			status, msgs := search(tr, c.query, c.accept)
+			var got []string
+			for _, msg := range msgs {
+				got = append(got, msg.Message)
+			}
+			if status != http.StatusOK || !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %d %v but expected %v", status, got, c.want)
+			}
+		}
+	}
+
+	t.Logf("Scenario: Searching a Transport that can neither search nor list is not implemented")
+	if status, _ := search(unlistableTransport{}, "q=hello", "application/json"); status != http.StatusNotImplemented {
+		t.Fatalf("got status %d", status)
+	}
+}
+
+func TestPubSubTransport(t *testing.T) {
+	var published []Message
+	var lastPath string
+	pubsub := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lastPath = req.URL.EscapedPath()
+		if req.Method != "POST" || req.URL.Path != "/projects/proj/topics/messages:publish" {
+			http.Error(rw, `{"error": {"code": 404}}`, http.StatusNotFound)
+			return
+		}
+		var body struct {
+			Messages []struct{ Data []byte }
+		}
+		var msg Message
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || len(body.Messages) != 1 {
+			http.Error(rw, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(body.Messages[0].Data, &msg); err != nil {
+			http.Error(rw, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusBadRequest)
+			return
+		}
+		published = append(published, msg)
+		fmt.Fprintf(rw, `{"messageIds": ["%d"]}`, 100+len(published))
+	}))
+	defer pubsub.Close()
+
+	config := PubSubConfig{Client: pubsub.Client(), Endpoint: pubsub.URL, Project: "proj", Topic: "messages"}
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "pubsub", PubSub: config}, []Registration{
+			{MessageController{}, "message"},
+		}))
+	defer server.Close()
+
+	t.Logf("Scenario: A message sent is published with the ID assigned by Pub/Sub")
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world", Message: "hello"})
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+	var sent Message
+	if err := Unmarshal(resp.Body, &sent); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	if sent.ID != "101" || len(published) != 1 || published[0].From != "kkrs" || !published[0].Sent.Equal(sent.Sent) {
+		t.Fatalf("got %+v and published %+v", sent, published)
+	}
+
+	t.Logf("Scenario: Listing messages is not implemented")
+	req, desc = listRequest(server.URL)
+	resp, err = http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusNotImplemented, nil)
+
+	t.Logf("Scenario: A failure to publish fails the send")
+	pub := RESTPublisher{Client: pubsub.Client(), Endpoint: pubsub.URL, Project: "proj", Topic: "missing"}
+	tr := PubSubTransport{Publisher: pub, Ctx: context.Background()}
+	if _, err := tr.Send(Message{}); err == nil || !strings.Contains(err.Error(), "404 Not Found") {
+		t.Fatalf("got error '%v'", err)
+	}
+
+	t.Logf("Scenario: The project and topic are escaped in the URL published to")
+	pub.Project, pub.Topic = "my proj", "a/b?c"
+	pub.Publish(context.Background(), nil)
+	if want := "/projects/my%20proj/topics/a%2Fb%3Fc:publish"; lastPath != want {
+		t.Fatalf("got path '%s' but expected '%s'", lastPath, want)
+	}
+
+	t.Logf("Scenario: Messages are published with the Publisher configured, if any")
+	var data []byte
+	config.Publisher = PublisherFunc(func(ctx context.Context, d []byte) (string, error) {
+		data = d
+		return "client-1", nil
+	})
+	other := httptest.NewServer(Setup(AppFactory{Env: "pubsub", PubSub: config}, []Registration{{MessageController{}, "message"}}))
+	defer other.Close()
+	req, desc = sendRequest(other.URL, Message{From: "kkrs", To: "world", Message: "hello"})
+	resp, err = http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Message != "hello" || len(published) != 1 {
+		t.Fatalf("got %s and error '%v', published %+v", data, err, published)
+	}
+	if resp.Header.Get("Location") != APIPath+"/client-1" {
+		t.Fatalf("got Location '%s'", resp.Header.Get("Location"))
+	}
+}
+
+func TestMultiTransport(t *testing.T) {
+	t.Logf("Scenario: A message sent reaches every backend")
+	primary, other := &ListTransport{}, &ListTransport{}
+	tr := NewMultiTransport(primary, other)
+	id, err := tr.Send(Message{From: "kkrs"})
+	if err != nil || id != "1" {
+		t.Fatalf("got ID '%s' and error '%v'", id, err)
+	}
+	for _, backend := range []*ListTransport{primary, other} {
+		if msgs, _ := backend.List(MessageFilter{}); len(msgs) != 1 || msgs[0].From != "kkrs" {
+			t.Fatalf("got %+v", msgs)
+		}
+	}
+
+	t.Logf("Scenario: A partial failure fails the send and names the backend")
+	failing := &flakyTransport{errs: []error{errors.New("down"), errors.New("down")}}
+	tr = NewMultiTransport(&ListTransport{}, failing)
+	if _, err := tr.Send(Message{}); err == nil || err.Error() != "backend 1: down" {
+		t.Fatalf("got error '%v'", err)
+	}
+
+	t.Logf("Scenario: A partial failure is tolerated in best effort mode")
+	tr.BestEffort = true
+	if id, err := tr.Send(Message{}); err != nil || id != "2" {
+		t.Fatalf("got ID '%s' and error '%v'", id, err)
+	}
+
+	t.Logf("Scenario: Failures of every backend fail the send in best effort mode")
+	tr = NewMultiTransport(&flakyTransport{errs: []error{errors.New("down")}}, &flakyTransport{errs: []error{errors.New("gone")}})
+	tr.BestEffort = true
+	if _, err := tr.Send(Message{}); err == nil || err.Error() != "backend 0: down\nbackend 1: gone" {
+		t.Fatalf("got error '%v'", err)
+	}
+
+	t.Logf("Scenario: Messages of a batch that a backend fails are failed with a BatchError")
+	tr = NewMultiTransport(&ListTransport{}, &flakyTransport{errs: []error{errors.New("down")}})
+	ids, err := tr.SendBatch([]Message{{From: "kkrs"}, {From: "kkrs"}})
+	var batchErr BatchError
+	if !errors.As(err, &batchErr) || batchErr[0] == nil || batchErr[1] != nil || ids[0] != "" || ids[1] != "2" {
+		t.Fatalf("got IDs %q and error '%v'", ids, err)
+	}
+
+	t.Logf("Scenario: Messages cannot be updated in several backends, whose IDs differ")
+	if err := tr.Update(ids[1], Message{From: "kkrs"}, 0); !errors.Is(err, ErrUpdateUnsupported) {
+		t.Fatalf("got error '%v'", err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	for _, c := range []struct {
+		desc    string
+		hold    time.Duration // how long requests take
+		timeout time.Duration
+		err     error
+	}{
+		{"waits for in-flight requests", 50 * time.Millisecond, time.Second, nil},
+		{"fails if in-flight requests outlast the timeout", time.Second, 50 * time.Millisecond, context.DeadlineExceeded},
+	} {
+		t.Logf("Scenario: Shutting down the Server %s", c.desc)
+		started := make(chan struct{})
+		srv := Server{
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				close(started)
+				time.Sleep(c.hold)
+			}),
+			ShutdownTimeout: c.timeout,
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(ctx, l) }()
+
+		responded := make(chan error, 1)
+		go func() {
+			resp, err := http.Get("http://" + l.Addr().String())
+			if err == nil {
+				resp.Body.Close()
+			}
+			responded <- err
+		}()
+		<-started
+		cancel()
+		err = <-served
+		if !errors.Is(err, c.err) || (err == nil) != (c.err == nil) {
+			t.Fatalf("got error '%v' but expected '%v'", err, c.err)
+		}
+		if c.err == nil {
+			if err := <-responded; err != nil {
+				t.Fatalf("in-flight request failed with '%s'", err)
+			}
+		}
+	}
+}
+
+func TestBodyLog(t *testing.T) {
+	var logged []string
+	list := &ListTransport{}
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: list, BodyLog: &BodyLog{
+			Paths:  []string{APIPath},
+			Redact: []string{"message"},
+			Logf:   func(format string, args ...interface{}) { logged = append(logged, fmt.Sprintf(format, args...)) },
+		}}, []Registration{
+			{MessageController{}, "message"},
+		}))
+	defer server.Close()
+
+	t.Logf("Scenario: Bodies are logged for selected routes with redacted fields")
+	testSend(t, server.URL)
+	if len(logged) != 1 {
+		t.Fatalf("got logged %q", logged)
+	}
+	for _, want := range []string{"POST " + APIPath + " request {", "response 201 {", `"From":"kkrs"`, `"Message":"[redacted]"`} {
+		if !strings.Contains(logged[0], want) {
+			t.Fatalf("got logged '%s' without '%s'", logged[0], want)
+		}
+	}
+	if strings.Contains(logged[0], "hello") {
+		t.Fatalf("got logged '%s' with the message", logged[0])
+	}
+
+	t.Logf("Scenario: The handler still reads the request body")
+	if msgs, _ := list.List(MessageFilter{}); len(msgs) != 1 || msgs[0].Message != "hello" {
+		t.Fatalf("got %+v", msgs)
+	}
+
+	t.Logf("Scenario: Requests to upgrade the connection are not logged")
+	logged = nil
+	handler := BodyLog{Logf: func(string, ...interface{}) { logged = append(logged, "upgrade") }}.Middleware()(
+		http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	req := httptest.NewRequest("GET", APIPath+"/watch", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if len(logged) != 0 {
+		t.Fatalf("got logged %q", logged)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	clk := &fakeClock{time.Date(2016, 2, 10, 12, 0, 0, 0, time.UTC)}
+	SetClock(clk)
+	defer SetClock(nil)
+
+	limiter := NewRateLimiter(0.5, 2, RateLimitEvictAfter(time.Minute), RateLimitTrustProxies("127.0.0.1", "::1", "10.0.0.0/8"))
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: &ListTransport{}, RateLimit: limiter}, []Registration{
+			{MessageController{}, "message"},
+		}))
+	defer server.Close()
+
+	do := func(client string, status int, retryAfter string) {
+		req, desc := listRequest(server.URL)
+		req.Header.Set("X-Forwarded-For", client+", 10.0.0.1")
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc+" from "+client, resp, err, status, nil)
+		if got := resp.Header.Get("Retry-After"); got != retryAfter {
+			t.Fatalf("got Retry-After '%s' but expected '%s'", got, retryAfter)
+		}
+	}
+
+	t.Logf("Scenario: A client is limited once its burst is used up")
+	do("192.0.2.1", http.StatusOK, "")
+	do("192.0.2.1", http.StatusOK, "")
+	do("192.0.2.1", http.StatusTooManyRequests, "2")
+
+	t.Logf("Scenario: Other clients are not limited")
+	do("192.0.2.2", http.StatusOK, "")
+
+	t.Logf("Scenario: A client is allowed again once a token is added")
+	clk.Advance(2 * time.Second)
+	do("192.0.2.1", http.StatusOK, "")
+	do("192.0.2.1", http.StatusTooManyRequests, "2")
+
+	t.Logf("Scenario: Idle buckets are evicted")
+	clk.Advance(2 * time.Minute)
+	do("192.0.2.3", http.StatusOK, "")
+	if n := limiter.Buckets(); n != 1 {
+		t.Fatalf("got %d buckets", n)
+	}
+
+	t.Logf("Scenario: A client cannot pose as another by forwarding for it")
+	do("198.51.100.1, 192.0.2.3", http.StatusOK, "")
+	do("198.51.100.2, 192.0.2.3", http.StatusTooManyRequests, "2")
+}
+
+func TestClientIP(t *testing.T) {
+	forwarded := ForwardedClientIP("10.0.0.0/8", "192.0.2.1")
+	for _, c := range []struct {
+		remote, forwardedFor string
+		client, proxied      string
+	}{
+		{"192.0.2.9:1234", "", "192.0.2.9", "192.0.2.9"},
+		{"192.0.2.9:1234", "198.51.100.1", "192.0.2.9", "192.0.2.9"},
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1", "198.51.100.1"},
+		{"10.1.2.3:1234", "198.51.100.1, 203.0.113.7, 10.0.0.1", "10.1.2.3", "203.0.113.7"},
+		{"10.1.2.3:1234", "10.0.0.2, 10.0.0.1", "10.1.2.3", "10.0.0.2"},
+	} {
+		t.Logf("Scenario: A request from %s forwarded for '%s' is from %s, or %s through the proxies", c.remote, c.forwardedFor, c.client, c.proxied)
+		req := httptest.NewRequest("GET", APIPath, nil)
+		req.RemoteAddr = c.remote
+		if c.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+		if got := ClientIP(req); got != c.client {
+			t.Fatalf("got %s from ClientIP", got)
+		}
+		if got := forwarded(req); got != c.proxied {
+			t.Fatalf("got %s from ForwardedClientIP", got)
+		}
+	}
+
+	t.Logf("Scenario: A RateLimiter that would never allow a request cannot be constructed")
+	for _, c := range []struct {
+		rate  float64
+		burst int
+	}{{0, 1}, {-1, 1}, {math.NaN(), 1}, {1, 0}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("got a RateLimiter of %v per second, %d at once", c.rate, c.burst)
+				}
+			}()
+			NewRateLimiter(c.rate, c.burst)
+		}()
+	}
+}
+
+func TestRingTransport(t *testing.T) {
+	const n = 3
+	tr := NewRingTransport(n)
+
+	t.Logf("Scenario: Only the last %d of %d messages sent remain, newest first", n, n+5)
+	for i := 1; i <= n+5; i++ {
+		if _, err := tr.Send(Message{Message: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+	}
+	msgs, err := tr.List(MessageFilter{})
+	if err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, msg.ID+":"+msg.Message)
+	}
+	if want := []string{"8:8", "7:7", "6:6"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q but expected %q", got, want)
+	}
+	if stats := tr.Stats(); stats.Count != n || stats.Capacity != n {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	fallback, acme := &ListTransport{}, &ListTransport{}
+	af := AppFactory{Env: "int", ListTr: fallback, Tenants: map[string]Transport{"acme": acme}}
+	server := httptest.NewServer(Setup(af, []Registration{{MessageController{}, "message"}}))
+	defer server.Close()
+
+	send := func(server, tenant string, status int) {
+		req, desc := sendRequest(server, Message{From: "kkrs", To: "world", Message: tenant})
+		if tenant != "" {
+			req.Header.Set(TenantHeader, tenant)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc+" for tenant '"+tenant+"'", resp, err, status, nil)
+	}
+
+	t.Logf("Scenario: Messages are stored by the Transport of their tenant")
+	send(server.URL, "acme", http.StatusCreated)
+	t.Logf("Scenario: Messages for other tenants or none are stored by the default")
+	send(server.URL, "initech", http.StatusCreated)
+	send(server.URL, "", http.StatusCreated)
+	for tr, want := range map[*ListTransport][]string{acme: {"acme"}, fallback: {"", "initech"}} {
+		msgs, _ := tr.List(MessageFilter{})
+		var got []string
+		for _, msg := range msgs {
+			got = append(got, msg.Message)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got messages for tenants %q but expected %q", got, want)
+		}
+	}
+
+	t.Logf("Scenario: Requests without a tenant fail when one is required")
+	af.TenantRequired = true
+	required := httptest.NewServer(Setup(af, []Registration{{MessageController{}, "message"}}))
+	defer required.Close()
+	send(required.URL, "", http.StatusBadRequest)
+	send(required.URL, "acme", http.StatusCreated)
+}
+
+// batchTransport is a BatchSender failing the messages whose Message is
+// "fail".
+type batchTransport struct {
+	ListTransport
+	batches int
+}
+
+func (tr *batchTransport) SendBatch(msgs []Message) ([]string, error) {
+	tr.batches++
+	ids, errs := make([]string, len(msgs)), make(BatchError, len(msgs))
+	failed := false
+	for i, msg := range msgs {
+		if msg.Message == "fail" {
+			errs[i], failed = errors.New("cannot store"), true
+			continue
+		}
+		ids[i], _ = tr.Send(msg)
+	}
+	if failed {
+		return ids, errs
+	}
+	return ids, nil
+}
+
+func TestSendBatch(t *testing.T) {
+	post := func(server *httptest.Server, body string, status int, want interface{}) {
+		resp, err := http.Post(server.URL+APIPath+"/batch", "application/json", strings.NewReader(body))
+		verify(t, "Request POST, "+APIPath+"/batch with body '"+body+"'", resp, err, status, want)
+	}
+
+	t.Logf("Scenario: A batch is sent one message at a time by Transports that cannot batch")
+	server, list := messagetest.NewServer()
+	defer server.Close()
+	post(server, `[{"From": "kkrs", "To": "world"}, {"From": "kkrs", "To": "moon"}]`, http.StatusCreated, []BatchResult{
+		{Status: http.StatusCreated, ID: "1"},
+		{Status: http.StatusCreated, ID: "2"},
+	})
+
+	t.Logf("Scenario: Invalid messages are reported by index and the rest sent")
+	post(server, `[{"From": "kkrs"}, {"From": "kkrs", "To": "sun"}]`, http.StatusMultiStatus, []BatchResult{
+		{Status: http.StatusBadRequest, Error: "invalid: message has no To"},
+		{Status: http.StatusCreated, ID: "3"},
+	})
+	if msgs, _ := list.List(MessageFilter{}); len(msgs) != 3 {
+		t.Fatalf("got %+v", msgs)
+	}
+
+	t.Logf("Scenario: An empty batch is a bad request")
+	post(server, `[]`, http.StatusBadRequest, nil)
+
+	t.Logf("Scenario: A BatchSender sends the batch at once and reports its failures by index")
+	tr := &batchTransport{}
+	batching := httptest.NewServer(Setup(
+		factoryFunc(func(string) di.Controller { return MessageController{Transport: tr} }),
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer batching.Close()
+	post(batching, `[{"From": "kkrs", "To": "world", "Message": "fail"}, {"From": "kkrs", "To": "world"}]`, http.StatusMultiStatus, []BatchResult{
+		{Status: http.StatusInternalServerError, Error: "error sending message: cannot store"},
+		{Status: http.StatusCreated, ID: "1"},
+	})
+	if tr.batches != 1 {
+		t.Fatalf("got %d batches", tr.batches)
+	}
+
+	t.Logf("Scenario: Messages longer than MaxItemSize are reported by index without being decoded")
+	defer func(size int) { MaxItemSize = size }(MaxItemSize)
+	MaxItemSize = 64
+	dec := &recordingDecoder{}
+	Decoder = dec
+	defer func() { Decoder = StdJSON{} }()
+	long := `{"From": "kkrs", "To": "world", "Message": "` + strings.Repeat("x", 64) + `"}`
+	post(server, `[`+long+`, {"From": "kkrs", "To": "moon"}]`, http.StatusMultiStatus, []BatchResult{
+		{Status: http.StatusRequestEntityTooLarge, Error: fmt.Sprintf("too large: message is %d bytes, longer than 64", len(long))},
+		{Status: http.StatusCreated, ID: "4"},
+	})
+	for _, data := range dec.decoded {
+		if strings.Contains(data, long) {
+			t.Fatalf("got '%s' decoded", data)
+		}
+	}
+
+	t.Logf("Scenario: A batch longer than MaxBodySize has the messages before the limit sent and counted")
+	defer func(size int64) { MaxBodySize = size }(MaxBodySize)
+	item := `{"From": "kkrs", "To": "world"}`
+	MaxBodySize = int64(len("[" + item + ", " + item + ", " + item[:10])) // in the third message
+	body := "[" + strings.Repeat(item+", ", 10) + item + "]"
+	resp, err := http.Post(server.URL+APIPath+"/batch", "application/json", strings.NewReader(body))
+	verify(t, "Request POST, "+APIPath+"/batch with 11 messages", resp, err, http.StatusRequestEntityTooLarge, []BatchResult{
+		{Status: http.StatusCreated, ID: "5"},
+		{Status: http.StatusCreated, ID: "6"},
+	})
+	if got := resp.Header.Get(ProcessedHeader); got != "2" || !resp.Close {
+		t.Fatalf("got %s '%s' and Close %t", ProcessedHeader, got, resp.Close)
+	}
+	if msgs, _ := list.List(MessageFilter{}); len(msgs) != 6 {
+		t.Fatalf("got %d messages sent", len(msgs))
+	}
+}
+
+// recordingDecoder records the JSON it decodes.
+type recordingDecoder struct {
+	decoded []string
+}
+
+func (d *recordingDecoder) Decode(r io.Reader, dst interface{}) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	d.decoded = append(d.decoded, string(data))
+	return StdJSON{}.Decode(bytes.NewReader(data), dst)
+}
+
+func TestListETag(t *testing.T) {
+	server, _ := messagetest.NewServer()
+	defer server.Close()
+
+	list := func(ifNoneMatch string, status int) *http.Response {
+		req, desc := listRequest(server.URL)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc+" with If-None-Match '"+ifNoneMatch+"'", resp, err, status, nil)
+		return resp
+	}
+
+	t.Logf("Scenario: Listing messages responds with a weak ETag and Content-Type")
+	resp := list("", http.StatusOK)
+	etag := resp.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("got headers %v", resp.Header)
+	}
+
+	t.Logf("Scenario: Listing with the same ETag responds 304 without a body")
+	resp = list(`"other", `+etag, http.StatusNotModified)
+	if body, _ := io.ReadAll(resp.Body); len(body) != 0 || resp.Header.Get("ETag") != etag {
+		t.Fatalf("got body '%s' and headers %v", body, resp.Header)
+	}
+
+	t.Logf("Scenario: The ETag changes once a message is sent")
+	testSend(t, server.URL)
+	if resp = list(etag, http.StatusOK); resp.Header.Get("ETag") == etag {
+		t.Fatalf("got the same ETag")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var logged bytes.Buffer
+	flaky := &flakyTransport{errs: []error{errors.New("boom")}}
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: &ListTransport{}, Tenants: map[string]Transport{"flaky": flaky}, LogOutput: &logged},
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer server.Close()
+
+	send := func(id string, status int) string {
+		req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+		req.Header.Set(TenantHeader, "flaky")
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc, resp, err, status, nil)
+		return resp.Header.Get(RequestIDHeader)
+	}
+
+	t.Logf("Scenario: The id sent by the client is echoed and prefixes what is logged")
+	if got := send("req-42", http.StatusInternalServerError); got != "req-42" {
+		t.Fatalf("got %s '%s'", RequestIDHeader, got)
+	}
+	if !strings.HasPrefix(logged.String(), "[req-42] ") || !strings.Contains(logged.String(), "boom") {
+		t.Fatalf("got logged '%s'", logged.String())
+	}
+
+	t.Logf("Scenario: Requests without a valid id are given one")
+	for _, id := range []string{"", "bad id", strings.Repeat("a", MaxRequestIDLength+1)} {
+		if got := send(id, http.StatusCreated); !regexp.MustCompile("^[0-9a-f]{16}$").MatchString(got) {
+			t.Fatalf("sent id '%s' but got '%s'", id, got)
+		}
+	}
+}
+
+// slowTransport blocks sending until release is closed.
+type slowTransport struct {
+	ListTransport
+	release chan struct{}
+}
+
+func (tr *slowTransport) Send(msg Message) (string, error) {
+	<-tr.release
+	return tr.ListTransport.Send(msg)
+}
+
+func TestTimeout(t *testing.T) {
+	slow := &slowTransport{release: make(chan struct{})}
+	defer close(slow.release)
+	server := httptest.NewServer(Setup(
+		AppFactory{
+			Env: "int", ListTr: &ListTransport{}, Tenants: map[string]Transport{"slow": slow},
+			Timeout: &Timeout{Duration: time.Minute, Paths: map[string]time.Duration{APIPath: 20 * time.Millisecond}},
+		},
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer server.Close()
+
+	t.Logf("Scenario: Requests served slower than the timeout of their route fail with 503")
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+	req.Header.Set(TenantHeader, "slow")
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusServiceUnavailable, map[string]string{
+		"error": "error serving request: context deadline exceeded",
+	})
+
+	t.Logf("Scenario: Requests served in time are answered by their handler")
+	req, desc = sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+	resp, err = http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+	if resp.Header.Get("Location") == "" {
+		t.Fatalf("got no Location")
+	}
+}
+
+func TestSetupDispatcher(t *testing.T) {
+	dispatcher := SetupDispatcher(AppFactory{Env: "int", ListTr: &ListTransport{}}, []Registration{{MessageController{}, "message"}})
+	if dispatcher.Name() != "messageService" {
+		t.Fatalf("got name '%s'", dispatcher.Name())
+	}
+	dispatcher.Router().HandleFunc("GET", "/metrics", func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "metrics")
+	})
+	server := httptest.NewServer(dispatcher.Router())
+	defer server.Close()
+
+	t.Logf("Scenario: Handlers registered with the Router are served alongside Controllers")
+	resp, err := http.Get(server.URL + "/metrics")
+	verify(t, "Request GET, /metrics", resp, err, http.StatusOK, nil)
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+	resp, err = http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+}
+
+func TestStrictDecoder(t *testing.T) {
+	server, _ := messagetest.NewServer()
+	defer server.Close()
+	send := func(body string, status int) {
+		resp, err := http.Post(server.URL+APIPath, "application/json", strings.NewReader(body))
+		verify(t, "Request POST, "+APIPath+" with body '"+body+"'", resp, err, status, nil)
+	}
+	typo := `{"From": "kkrs", "To": "world", "Mesage": "hello"}`
+
+	t.Logf("Scenario: Unknown fields are ignored by default")
+	send(typo, http.StatusCreated)
+
+	t.Logf("Scenario: Unknown fields are rejected by a strict Decoder")
+	Decoder = StdJSON{DisallowUnknownFields: true}
+	defer func() { Decoder = StdJSON{} }()
+	send(typo, http.StatusBadRequest)
+	send(`{"From": "kkrs", "To": "world", "Message": "hello"}`, http.StatusCreated)
+
+	t.Logf("Scenario: Data after the JSON value is rejected")
+	send(`{"From": "kkrs", "To": "world"} {}`, http.StatusBadRequest)
+}
+
+func TestBearerAuth(t *testing.T) {
+	list := &ListTransport{}
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: list, Auth: di.BearerTokens{"s3cret": {Name: "alice"}}},
+		[]Registration{{MessageController{}, "message"}, {HealthController{}, "health"}},
+	))
+	defer server.Close()
+
+	send := func(authorization string, status int) *http.Response {
+		req, desc := sendRequest(server.URL, Message{From: "mallory", To: "bob"})
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc+" with Authorization '"+authorization+"'", resp, err, status, nil)
+		return resp
+	}
+
+	t.Logf("Scenario: Requests without a token fail with 401 and a challenge")
+	if resp := send("", http.StatusUnauthorized); resp.Header.Get("WWW-Authenticate") != "Bearer" {
+		t.Fatalf("got WWW-Authenticate '%s'", resp.Header.Get("WWW-Authenticate"))
+	}
+	t.Logf("Scenario: Requests with an invalid token fail with 401")
+	send("Bearer guess", http.StatusUnauthorized)
+	send("Basic s3cret", http.StatusUnauthorized)
+
+	t.Logf("Scenario: Requests with a valid token send messages from its principal")
+	send("Bearer s3cret", http.StatusCreated)
+	if msgs, _ := list.List(MessageFilter{}); len(msgs) != 1 || msgs[0].From != "alice" {
+		t.Fatalf("got %+v", msgs)
+	}
+
+	t.Logf("Scenario: Bindings with the Anonymous Authenticator are served without a token")
+	resp, err := http.Get(server.URL + HealthPath)
+	verify(t, "Request GET, "+HealthPath, resp, err, http.StatusOK, nil)
+}
+
+// streamTransport streams the messages of ListTransport, failing with err
+// after streaming them if it is set.
+type streamTransport struct {
+	ListTransport
+	err      error
+	streamed bool
+}
+
+func (tr *streamTransport) ListStream(filter MessageFilter, fn func(Message) error) error {
+	tr.streamed = true
+	msgs, _ := tr.List(filter)
+	for _, msg := range msgs {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return tr.err
+}
+
+func TestListNDJSON(t *testing.T) {
+	streamer := &streamTransport{}
+	af := AppFactory{Env: "int", ListTr: &ListTransport{}, Tenants: map[string]Transport{"stream": streamer}}
+	server := httptest.NewServer(Setup(af, []Registration{{MessageController{}, "message"}}))
+	defer server.Close()
+	for _, to := range []string{"a", "b"} {
+		af.ListTr.Send(Message{From: "kkrs", To: to})
+		streamer.Send(Message{From: "kkrs", To: to})
+	}
+
+	list := func(tenant string) (*http.Response, []string) {
+		req, desc := listRequest(server.URL)
+		req.Header.Set("Accept", NDJSON)
+		req.Header.Set(TenantHeader, tenant)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc+" accepting "+NDJSON, resp, err, http.StatusOK, nil)
+		if ct := resp.Header.Get("Content-Type"); ct != NDJSON {
+			t.Fatalf("got Content-Type '%s'", ct)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		var tos []string
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			var msg Message
+			if err := json.Unmarshal([]byte(line), &msg); err != nil {
+				t.Fatalf("got line '%s': %s", line, err)
+			}
+			tos = append(tos, msg.To)
+		}
+		return resp, tos
+	}
+
+	for _, tenant := range []string{"", "stream"} {
+		t.Logf("Scenario: Messages are streamed one per line, newest first, from tenant '%s'", tenant)
+		if _, tos := list(tenant); !reflect.DeepEqual(tos, []string{"b", "a"}) {
+			t.Fatalf("got messages to %q", tos)
+		}
+	}
+	if !streamer.streamed {
+		t.Fatalf("got messages without ListStream")
+	}
+
+	t.Logf("Scenario: A failure after streaming started keeps the messages streamed")
+	streamer.err = errors.New("boom")
+	if _, tos := list("stream"); len(tos) != 2 {
+		t.Fatalf("got messages to %q", tos)
+	}
+}
+
+// endlessTransport streams messages until fn fails, and tells how many it
+// streamed once it stops.
+type endlessTransport struct {
+	ListTransport
+	stopped chan int
+}
+
+func (tr *endlessTransport) ListStream(filter MessageFilter, fn func(Message) error) error {
+	for n := 0; ; n++ {
+		if err := fn(Message{From: "kkrs", To: "world", Message: strings.Repeat("x", 100)}); err != nil {
+			tr.stopped <- n
+			return err
+		}
+	}
+}
+
+func TestListNDJSONSlowClient(t *testing.T) {
+	defer func(d time.Duration) { StreamWriteTimeout = d }(StreamWriteTimeout)
+	StreamWriteTimeout = 100 * time.Millisecond
+	endless := &endlessTransport{stopped: make(chan int, 1)}
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: &ListTransport{}, Tenants: map[string]Transport{"endless": endless}},
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer server.Close()
+
+	stream := func() (*http.Response, *bufio.Reader) {
+		req, desc := listRequest(server.URL)
+		req.Header.Set("Accept", NDJSON)
+		req.Header.Set(TenantHeader, "endless")
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc+" accepting "+NDJSON, resp, err, http.StatusOK, nil)
+		return resp, bufio.NewReader(resp.Body)
+	}
+	read := func(r *bufio.Reader) {
+		var msg Message
+		if line, err := r.ReadBytes('\n'); err != nil || json.Unmarshal(line, &msg) != nil || msg.To != "world" {
+			t.Fatalf("got line '%s' and error '%v'", line, err)
+		}
+	}
+	stopped := func(desc string) int {
+		select {
+		case n := <-endless.stopped:
+			return n
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got the stream to a client that %s going on", desc)
+			return 0
+		}
+	}
+
+	t.Logf("Scenario: A client reading slowly is streamed to as it reads")
+	resp, r := stream()
+	for i := 0; i < 3; i++ {
+		time.Sleep(StreamWriteTimeout / 4)
+		read(r)
+	}
+
+	t.Logf("Scenario: The stream to a client that stops reading is dropped")
+	n := stopped("stopped reading")
+	resp.Body.Close()
+	t.Logf("\tafter %d messages", n)
+
+	t.Logf("Scenario: The stream to a client that disconnects stops")
+	StreamWriteTimeout = time.Minute // so that only the disconnect stops it
+	resp, r = stream()
+	read(r)
+	resp.Body.Close()
+	stopped("disconnected")
+}
+
+// spyTransport fails the test if a message is sent.
+type spyTransport struct {
+	ListTransport
+	t *testing.T
+}
+
+func (tr *spyTransport) Send(msg Message) (string, error) {
+	tr.t.Errorf("sent %+v", msg)
+	return "", errors.New("sent")
+}
+
+func TestSendDryRun(t *testing.T) {
+	clk := &fakeClock{time.Date(2016, 2, 10, 12, 0, 0, 0, time.UTC)}
+	SetClock(clk)
+	defer SetClock(nil)
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: &ListTransport{}, Tenants: map[string]Transport{"spy": &spyTransport{t: t}}},
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer server.Close()
+
+	dryRun := func(query, header string, msg Message, status int, body interface{}) {
+		req, desc := sendRequest(server.URL, msg)
+		req.URL.RawQuery = query
+		req.Header.Set(DryRunHeader, header)
+		req.Header.Set(TenantHeader, "spy")
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc+" as a dry run", resp, err, status, body)
+	}
+
+	t.Logf("Scenario: A dry run responds with the message that would be stored")
+	want := Message{From: "kkrs", To: "world", Message: "hello", Sent: clk.Now()}
+	dryRun("dryRun=true", "", Message{From: "kkrs", To: "world", Message: "hello"}, http.StatusOK, want)
+	dryRun("", "true", Message{From: "kkrs", To: "world", Message: "hello"}, http.StatusOK, want)
+
+	t.Logf("Scenario: A dry run of an invalid message fails with 400")
+	dryRun("dryRun=1", "", Message{From: "kkrs"}, http.StatusBadRequest, nil)
+
+	t.Logf("Scenario: Sending the same message for real fails alike, without sending it")
+	dryRun("", "", Message{From: "kkrs"}, http.StatusBadRequest, map[string]string{"error": "invalid: message has no To"})
+}
+
+// claimStore tells when keys are claimed.
+type claimStore struct {
+	*MemoryIdempotencyStore
+	claimed chan struct{}
+}
+
+func (s claimStore) SetNX(key string, resp IdempotentResponse) (bool, error) {
+	ok, err := s.MemoryIdempotencyStore.SetNX(key, resp)
+	if ok {
+		s.claimed <- struct{}{}
+	}
+	return ok, err
+}
+
+// panicTransport panics sending messages.
+type panicTransport struct {
+	ListTransport
+}
+
+func (*panicTransport) Send(Message) (string, error) {
+	panic("transport panicked")
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	clk := &fakeClock{time.Date(2016, 2, 10, 12, 0, 0, 0, time.UTC)}
+	SetClock(clk)
+	defer SetClock(nil)
+	list := &ListTransport{}
+	slow := &slowTransport{release: make(chan struct{})}
+	flaky := &flakyTransport{errs: []error{errors.New("boom")}}
+	store := claimStore{&MemoryIdempotencyStore{TTL: time.Hour}, make(chan struct{}, 10)}
+	server := httptest.NewServer(Setup(
+		AppFactory{
+			Env: "int", ListTr: list, Idempotency: store,
+			Tenants: map[string]Transport{"slow": slow, "flaky": flaky, "panic": &panicTransport{}},
+		},
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer server.Close()
+
+	send := func(key, tenant string, status int) *http.Response {
+		req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+		req.Header.Set(IdempotencyKeyHeader, key)
+		req.Header.Set(TenantHeader, tenant)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc+" with "+IdempotencyKeyHeader+" '"+key+"'", resp, err, status, nil)
+		return resp
+	}
+	count := func(want int) {
+		if msgs, _ := list.List(MessageFilter{}); len(msgs) != want {
+			t.Fatalf("got %d messages, expected %d", len(msgs), want)
+		}
+	}
+
+	t.Logf("Scenario: Retries with the same key are answered without sending again")
+	first := send("k1", "", http.StatusCreated)
+	retry := send("k1", "", http.StatusCreated)
+	if retry.Header.Get("Location") != first.Header.Get("Location") || retry.Header.Get(IdempotentReplayHeader) != "true" {
+		t.Fatalf("got %v for the retry of %v", retry.Header, first.Header)
+	}
+	count(1)
+	send("k2", "", http.StatusCreated)
+	count(2)
+
+	t.Logf("Scenario: Keys are forgotten after the TTL")
+	clk.Advance(time.Hour)
+	send("k1", "", http.StatusCreated)
+	count(3)
+
+	t.Logf("Scenario: Requests with the key of one in progress fail with 409")
+	for len(store.claimed) > 0 {
+		<-store.claimed
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+		req.Header.Set(IdempotencyKeyHeader, "k3")
+		req.Header.Set(TenantHeader, "slow")
+		if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+			t.Errorf("got %v, %v", resp, err)
+		}
+	}()
+	<-store.claimed
+	send("k3", "slow", http.StatusConflict)
+	close(slow.release)
+	<-done
+	send("k3", "slow", http.StatusCreated)
+
+	t.Logf("Scenario: Failed requests can be retried with the same key")
+	send("k4", "flaky", http.StatusInternalServerError)
+	send("k4", "flaky", http.StatusCreated)
+	if flaky.calls != 2 {
+		t.Fatalf("got %d calls", flaky.calls)
+	}
+
+	t.Logf("Scenario: Requests whose Transport panics can be retried with the same key")
+	req, _ := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+	req.Header.Set(IdempotencyKeyHeader, "k5")
+	req.Header.Set(TenantHeader, "panic")
+	if resp, err := http.DefaultClient.Do(req); err == nil && resp.StatusCode < http.StatusInternalServerError {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	send("k5", "", http.StatusCreated)
+
+	t.Logf("Scenario: Requests reusing a key for another message fail with 422")
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "moon"})
+	req.Header.Set(IdempotencyKeyHeader, "k5")
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc+" with "+IdempotencyKeyHeader+" 'k5'", resp, err, http.StatusUnprocessableEntity, nil)
+	count(4)
+
+	t.Logf("Scenario: Keys longer than MaxIdempotencyKeySize fail with 400")
+	send(strings.Repeat("k", MaxIdempotencyKeySize+1), "", http.StatusBadRequest)
+	send(strings.Repeat("k", MaxIdempotencyKeySize), "", http.StatusCreated)
+}
+
+func TestGzip(t *testing.T) {
+	list := &ListTransport{}
+	for i := 0; i < 50; i++ {
+		list.Send(Message{From: "kkrs", To: "world", Message: "hello"})
+	}
+	server := httptest.NewServer(Setup(AppFactory{Env: "int", ListTr: list, Gzip: true}, []Registration{{MessageController{}, "message"}}))
+	defer server.Close()
+
+	get := func(acceptEncoding, accept string) (*http.Response, []byte) {
+		req, desc := listRequest(server.URL)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc+" accepting encoding '"+acceptEncoding+"'", resp, err, http.StatusOK, nil)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		return resp, body
+	}
+
+	t.Logf("Scenario: Clients not accepting gzip get plain responses")
+	resp, plain := get("identity", "application/json")
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("got header %v", resp.Header)
+	}
+
+	for _, accept := range []string{"application/json", NDJSON} {
+		t.Logf("Scenario: Responses of type %s are compressed for clients accepting gzip", accept)
+		resp, compressed := get("gzip, deflate", accept)
+		if resp.Header.Get("Content-Encoding") != "gzip" || len(compressed) >= len(plain) {
+			t.Fatalf("got header %v and %d bytes", resp.Header, len(compressed))
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		decompressed, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		if accept == "application/json" && !bytes.Equal(decompressed, plain) {
+			t.Fatalf("got '%s' but expected '%s'", decompressed, plain)
+		}
+	}
+
+	t.Logf("Scenario: Small responses are not compressed")
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("got header %v", resp.Header)
+	}
+}
+
+func TestGetMessage(t *testing.T) {
+	server, _ := messagetest.NewServer()
+	defer server.Close()
+
+	t.Logf("Scenario: Send responds with the ID of the message and its URI")
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world", Message: "hello"})
+	resp, err := http.DefaultClient.Do(req)
+	var sent Message
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+	if err := Unmarshal(resp.Body, &sent); err != nil || sent.ID == "" {
+		t.Fatalf("got %+v, %v", sent, err)
+	}
+
+	t.Logf("Scenario: The URI in Location resolves to the message")
+	resp, err = http.Get(server.URL + resp.Header.Get("Location"))
+	verify(t, "Request GET, "+resp.Request.URL.Path, resp, err, http.StatusOK, sent)
+
+	t.Logf("Scenario: Unknown IDs are not found")
+	resp, err = http.Get(server.URL + APIPath + "/unknown")
+	verify(t, "Request GET, "+APIPath+"/unknown", resp, err, http.StatusNotFound, nil)
+}
+
+func TestEmptyBody(t *testing.T) {
+	server, list := messagetest.NewServer()
+	defer server.Close()
+
+	for _, c := range []struct {
+		desc string
+		body io.Reader
+	}{
+		{"no body", nil},
+		{"an empty body", strings.NewReader("")},
+	} {
+		t.Logf("Scenario: Sending a message with %s is a client error", c.desc)
+		resp, err := http.Post(server.URL+APIPath, "application/json", c.body)
+		verify(t, "Request POST, "+APIPath+" with "+c.desc, resp, err, http.StatusBadRequest, nil)
+		var body struct{ Error string }
+		if err := Unmarshal(resp.Body, &body); err != nil || !strings.Contains(body.Error, "request body required") {
+			t.Fatalf("got error '%s', %v", body.Error, err)
+		}
+	}
+	if msgs, _ := list.List(MessageFilter{}); len(msgs) != 0 {
+		t.Fatalf("got %+v", msgs)
+	}
+}
+
+func TestFieldSizes(t *testing.T) {
+	server, list := messagetest.NewServer()
+	defer server.Close()
+
+	for _, c := range []struct {
+		field string
+		msg   Message
+	}{
+		{"Message", Message{From: "kkrs", To: "world", Message: strings.Repeat("x", MaxMessageSize+1)}},
+		{"From", Message{From: strings.Repeat("k", MaxAddressSize+1), To: "world", Message: "hello"}},
+	} {
+		t.Logf("Scenario: Sending a message with an oversize %s is a client error naming it", c.field)
+		req, desc := sendRequest(server.URL, c.msg)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc[:80]+"...", resp, err, http.StatusBadRequest, nil)
+		var body struct{ Error string }
+		if err := Unmarshal(resp.Body, &body); err != nil || !strings.HasPrefix(body.Error, "invalid: "+c.field+" is ") {
+			t.Fatalf("got error '%s', %v", body.Error, err)
+		}
+	}
+	if msgs, _ := list.List(MessageFilter{}); len(msgs) != 0 {
+		t.Fatalf("got %d messages sent", len(msgs))
+	}
+
+	t.Logf("Scenario: Messages at the limits are sent")
+	req, desc := sendRequest(server.URL, Message{From: strings.Repeat("k", MaxAddressSize), To: "world", Message: strings.Repeat("x", MaxMessageSize)})
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc[:80]+"...", resp, err, http.StatusCreated, nil)
+}
+
+func TestListSince(t *testing.T) {
+	clk := &fakeClock{time.Date(2016, 2, 10, 12, 0, 0, 0, time.UTC)}
+	SetClock(clk)
+	defer SetClock(nil)
+	server, list := messagetest.NewServer()
+	defer server.Close()
+
+	for _, text := range []string{"first", "second"} {
+		clk.Advance(time.Second)
+		req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world", Message: text})
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc, resp, err, http.StatusCreated, nil)
+	}
+	msgs, _ := list.List(MessageFilter{})
+	first, second := msgs[1], msgs[0]
+
+	poll := func(since, accept string) ([]string, string) {
+		req, desc := listRequest(server.URL)
+		req.URL.RawQuery = "since=" + url.QueryEscape(since)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc+" since "+since, resp, err, http.StatusOK, nil)
+		var texts []string
+		dec := json.NewDecoder(resp.Body)
+		if accept == NDJSON {
+			for {
+				var msg Message
+				if err := dec.Decode(&msg); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("got error '%s'", err)
+				}
+				texts = append(texts, msg.Message)
+			}
+		} else {
+			var got []Message
+			if err := dec.Decode(&got); err != nil {
+				t.Fatalf("got error '%s'", err)
+			}
+			for _, msg := range got {
+				texts = append(texts, msg.Message)
+			}
+		}
+		return texts, resp.Header.Get(NextSinceHeader)
+	}
+
+	for _, accept := range []string{"application/json", NDJSON} {
+		t.Logf("Scenario: Polling since the ID of a message lists only those sent after it, as %s", accept)
+		texts, next := poll(first.ID, accept)
+		if !reflect.DeepEqual(texts, []string{"second"}) {
+			t.Fatalf("got %v", texts)
+		}
+		if want := second.Sent.UTC().Format(time.RFC3339Nano); next != want {
+			t.Fatalf("got %s '%s' but expected '%s'", NextSinceHeader, next, want)
+		}
+
+		t.Logf("Scenario: Polling since the marker returned lists nothing new and returns it again")
+		texts, again := poll(next, accept)
+		if len(texts) != 0 || again != next {
+			t.Fatalf("got %v and %s '%s'", texts, NextSinceHeader, again)
+		}
+	}
+
+	t.Logf("Scenario: Polling since a time lists the messages sent after it")
+	if texts, _ := poll(first.Sent.Add(-time.Millisecond).Format(time.RFC3339Nano), "application/json"); !reflect.DeepEqual(texts, []string{"second", "first"}) {
+		t.Fatalf("got %v", texts)
+	}
+
+	t.Logf("Scenario: Polling since neither an ID nor a time is a client error")
+	resp, err := http.Get(server.URL + SpyPath + "?since=yesterday")
+	verify(t, "Request GET, "+SpyPath+"?since=yesterday", resp, err, http.StatusBadRequest, nil)
+}
+
+func TestUpdate(t *testing.T) {
+	server, _ := messagetest.NewServer()
+	defer server.Close()
+
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world", Message: "hello"})
+	resp, err := http.DefaultClient.Do(req)
+	var sent Message
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+	if err := Unmarshal(resp.Body, &sent); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	uri := server.URL + resp.Header.Get("Location")
+	update := func(ifMatch string, msg Message) (*http.Response, string, error) {
+		body, _ := json.Marshal(msg)
+		req, _ := http.NewRequest("PUT", uri, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		return resp, "Request PUT, " + req.URL.Path + " If-Match " + ifMatch, err
+	}
+
+	t.Logf("Scenario: Get responds with the ETag of the version of the message")
+	resp, err = http.Get(uri)
+	verify(t, "Request GET, "+uri, resp, err, http.StatusOK, sent)
+	etag := resp.Header.Get("ETag")
+	if etag != `"0"` {
+		t.Fatalf("got ETag '%s'", etag)
+	}
+
+	t.Logf("Scenario: An update with the current ETag succeeds, keeping the Sent time")
+	edited := sent
+	edited.Message, edited.Version = "hello again", 1
+	resp, desc, err = update(etag, Message{From: "kkrs", To: "world", Message: "hello again"})
+	verify(t, desc, resp, err, http.StatusOK, edited)
+	if got := resp.Header.Get("ETag"); got != `"1"` {
+		t.Fatalf("got ETag '%s'", got)
+	}
+	resp, err = http.Get(uri)
+	verify(t, "Request GET, "+uri, resp, err, http.StatusOK, edited)
+
+	t.Logf("Scenario: An update with a stale ETag fails without overwriting the message")
+	resp, desc, err = update(etag, Message{From: "kkrs", To: "world", Message: "stale"})
+	verify(t, desc, resp, err, http.StatusPreconditionFailed, nil)
+	resp, err = http.Get(uri)
+	verify(t, "Request GET, "+uri, resp, err, http.StatusOK, edited)
+
+	t.Logf("Scenario: Updates require If-Match with the ETag of a message")
+	resp, desc, err = update("", Message{From: "kkrs", To: "world", Message: "blind"})
+	verify(t, desc, resp, err, http.StatusPreconditionRequired, nil)
+	resp, desc, err = update(`W/"1"`, Message{From: "kkrs", To: "world", Message: "weak"})
+	verify(t, desc, resp, err, http.StatusPreconditionFailed, nil)
+
+	t.Logf("Scenario: Invalid messages and unknown IDs are rejected")
+	resp, desc, err = update(`"1"`, Message{From: "kkrs"})
+	verify(t, desc, resp, err, http.StatusBadRequest, nil)
+	uri = server.URL + APIPath + "/unknown"
+	resp, desc, err = update(`"0"`, Message{From: "kkrs", To: "world", Message: "lost"})
+	verify(t, desc, resp, err, http.StatusNotFound, nil)
+}
+
+func TestUpdateConcurrently(t *testing.T) {
+	list := &ListTransport{}
+	id, _ := list.Send(Message{From: "kkrs", To: "world", Message: "hello"})
+
+	t.Logf("Scenario: Of concurrent updates of the same version only one succeeds")
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- list.Update(id, Message{From: "kkrs", To: "world", Message: fmt.Sprint(i)}, 0)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, ErrPreconditionFailed):
+			t.Fatalf("got error '%s'", err)
+		}
+	}
+	if msg, _ := list.Get(id); succeeded != 1 || msg.Version != 1 {
+		t.Fatalf("got %d updates succeeding and %+v", succeeded, msg)
+	}
+}
+
+func TestTransportErrorStatus(t *testing.T) {
+	ring := NewRingTransport(2)
+	id, _ := ring.Send(Message{From: "kkrs", To: "world"})
+	af := AppFactory{Env: "int", ListTr: &ListTransport{}, Tenants: map[string]Transport{
+		"ring":    ring,
+		"invalid": &flakyTransport{errs: []error{fmt.Errorf("%w: too long", ErrInvalid)}},
+	}}
+	server := httptest.NewServer(Setup(af, []Registration{{MessageController{}, "message"}}))
+	defer server.Close()
+
+	get := func(tenant, id string, status int) {
+		req, _ := http.NewRequest("GET", server.URL+APIPath+"/"+id, nil)
+		req.Header.Set(TenantHeader, tenant)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, "Request GET, "+APIPath+"/"+id+" for tenant '"+tenant+"'", resp, err, status, nil)
+	}
+
+	for _, tenant := range []string{"", "ring"} {
+		t.Logf("Scenario: Missing IDs are not found in Transports that are Getters or not, tenant '%s'", tenant)
+		get(tenant, "42", http.StatusNotFound)
+	}
+	get("ring", id, http.StatusOK)
+
+	t.Logf("Scenario: Messages a Transport rejects as invalid fail with 400")
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+	req.Header.Set(TenantHeader, "invalid")
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusBadRequest, map[string]string{
+		"error": "error sending message: invalid: too long",
+	})
+}
+
+func TestListCSV(t *testing.T) {
+	af := AppFactory{Env: "int", ListTr: &ListTransport{}}
+	server := httptest.NewServer(Setup(af, []Registration{{MessageController{}, "message"}}))
+	defer server.Close()
+	sent := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	af.ListTr.Send(Message{From: "kkrs", To: "a", Message: "line one\nline two", Sent: sent})
+	af.ListTr.Send(Message{From: "kkrs", To: "b", Message: `say "hi", then leave`, Sent: sent.Add(time.Minute)})
+
+	t.Logf("Scenario: Messages are exported as CSV with a header row, newest first")
+	req, desc := listRequest(server.URL)
+	req.Header.Set("Accept", CSV)
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc+" accepting "+CSV, resp, err, http.StatusOK, nil)
+	if ct := resp.Header.Get("Content-Type"); ct != CSV {
+		t.Fatalf("got Content-Type '%s'", ct)
+	}
+	want := "attachment; filename=messages.csv"
+	if cd := resp.Header.Get("Content-Disposition"); cd != want {
+		t.Fatalf("got Content-Disposition '%s' but expected '%s'", cd, want)
+	}
+
+	t.Logf("\tand fields with commas, quotes and newlines are quoted")
+	data, _ := io.ReadAll(resp.Body)
+	want = "From,To,Message,Sent\n" +
+		`kkrs,b,"say ""hi"", then leave",2017-03-01T12:01:00Z` + "\n" +
+		"kkrs,a,\"line one\nline two\",2017-03-01T12:00:00Z\n"
+	if string(data) != want {
+		t.Fatalf("got body\n%s\nbut expected\n%s", data, want)
+	}
+}
+
+func TestRequestIDInTransportErrors(t *testing.T) {
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: &ListTransport{}}, []Registration{{MessageController{}, "message"}},
+	))
+	defer server.Close()
+
+	t.Logf("Scenario: Errors from the Transport carry the id of the request")
+	req, _ := http.NewRequest("GET", server.URL+APIPath+"/42", nil)
+	req.Header.Set(RequestIDHeader, "trace-1")
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, "Request GET, "+APIPath+"/42 with id 'trace-1'", resp, err, http.StatusNotFound, map[string]string{
+		"error": `error getting message "42": request trace-1: not found`,
+	})
+	t.Logf("\tand the response carries it too")
+	if id := resp.Header.Get(RequestIDHeader); id != "trace-1" {
+		t.Fatalf("got %s '%s'", RequestIDHeader, id)
+	}
+}
+
+func TestJSONAPIErrors(t *testing.T) {
+	ErrorEncoder = JSONAPIErrorEncoder
+	defer func() { ErrorEncoder = PlainErrorEncoder }()
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: &ListTransport{}, TenantRequired: true},
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer server.Close()
+
+	type errorObject struct {
+		Status string `json:"status"`
+		Detail string `json:"detail"`
+	}
+	type document struct {
+		Errors []errorObject `json:"errors"`
+	}
+
+	t.Logf("Scenario: Errors are JSON:API error documents once its encoder is installed")
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc+" without tenant", resp, err, http.StatusBadRequest, document{[]errorObject{
+		{"400", "error sending message: no tenant in header " + TenantHeader},
+	}})
+	if ct := resp.Header.Get("Content-Type"); ct != "application/vnd.api+json" {
+		t.Fatalf("got Content-Type '%s'", ct)
+	}
+
+	t.Logf("Scenario: Unrouted requests get them too")
+	resp, err = http.Get(server.URL + "/unknown")
+	verify(t, "Request GET, /unknown", resp, err, http.StatusNotFound, document{[]errorObject{
+		{"404", "no route for /unknown"},
+	}})
+}
+
+func TestWatch(t *testing.T) {
+	list := &ListTransport{}
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: list, Tenants: map[string]Transport{"ring": NewRingTransport(2)}},
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + SpyPath + "/stream"
+
+	t.Logf("Scenario: A WebSocket client is pushed the messages sent once connected")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	if msg.ID == "" || msg.To != "world" {
+		t.Fatalf("got %+v", msg)
+	}
+
+	t.Logf("Scenario: The subscription ends when the client disconnects")
+	conn.Close()
+	for i := 0; list.Subscribers() > 0; i++ {
+		if i == 100 {
+			t.Fatalf("got %d subscribers", list.Subscribers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Logf("Scenario: Transports that are not Subscribers cannot be watched")
+	header := http.Header{TenantHeader: {"ring"}}
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL, header)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("got error '%v' and response %v", err, resp)
+	}
+}
+
+func TestWatchThroughMiddleware(t *testing.T) {
+	list := &ListTransport{}
+	server := httptest.NewServer(Setup(
+		AppFactory{
+			Env: "int", ListTr: list, Gzip: true,
+			BodyLog: &BodyLog{Logf: func(string, ...interface{}) {}},
+			Timeout: &Timeout{Duration: time.Minute},
+		},
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer server.Close()
+
+	t.Logf("Scenario: A WebSocket client can watch through Middleware wrapping the response")
+	header := http.Header{"Accept-Encoding": {"gzip"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+SpyPath+"/stream", header)
+	if err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	defer conn.Close()
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil || msg.To != "world" {
+		t.Fatalf("got %+v and error '%v'", msg, err)
+	}
+}
+
+func TestTimeoutFlush(t *testing.T) {
+	release, written := make(chan struct{}), make(chan error, 1)
+	handler := Timeout{Duration: 50 * time.Millisecond}.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "first\n")
+		rw.(http.Flusher).Flush()
+		<-release
+		_, err := io.WriteString(rw, "second\n")
+		written <- err
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	t.Logf("Scenario: What a handler flushes reaches the client before it returns")
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "first\n" || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, '%s' and error '%v'", resp.StatusCode, line, err)
+	}
+
+	t.Logf("Scenario: Once the timeout passes, writes fail rather than answer 503")
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if err := <-written; err != http.ErrHandlerTimeout {
+		t.Fatalf("got error '%v'", err)
+	}
+	if rest, _ := ioutil.ReadAll(resp.Body); len(rest) != 0 {
+		t.Fatalf("got '%s' after the timeout", rest)
+	}
+}
+
+func TestRegisterWhileWatching(t *testing.T) {
+	dispatcher := SetupDispatcher(AppFactory{Env: "int", ListTr: &ListTransport{}}, []Registration{
+		{MessageController{}, "message"},
+	})
+	server := httptest.NewServer(dispatcher.Router())
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+SpyPath+"/stream", nil)
+	if err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	defer conn.Close()
+
+	t.Logf("Scenario: Controllers are registered while a WebSocket is open")
+	done := make(chan error, 1)
+	go func() { done <- dispatcher.Register(HealthController{}, "health") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Register blocked by the open WebSocket")
+	}
+
+	t.Logf("Scenario: Requests are served while a WebSocket is open")
+	resp, err := http.Get(server.URL + HealthPath)
+	verify(t, "Request GET, "+HealthPath, resp, err, http.StatusOK, nil)
+}
+
+func TestBasicAuth(t *testing.T) {
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: &ListTransport{}, BasicAuth: &BasicAuth{
+			Realm:       "spy",
+			Credentials: map[string]string{"admin": "secret"},
+			Paths:       []string{SpyPath},
+		}}, []Registration{
+			{MessageController{}, "message"},
+		}))
+	defer server.Close()
+
+	do := func(desc string, set func(*http.Request), status int) {
+		req, _ := listRequest(server.URL)
+		set(req)
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, desc, resp, err, status, nil)
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if status == http.StatusUnauthorized && challenge != `Basic realm="spy"` {
+			t.Fatalf("got WWW-Authenticate '%s'", challenge)
+		}
+	}
+
+	t.Logf("Scenario: Requests for a protected route without credentials are challenged")
+	do("no credentials", func(*http.Request) {}, http.StatusUnauthorized)
+
+	t.Logf("Scenario: Requests with wrong credentials are challenged")
+	do("wrong password", func(req *http.Request) { req.SetBasicAuth("admin", "guess") }, http.StatusUnauthorized)
+	do("wrong user", func(req *http.Request) { req.SetBasicAuth("root", "secret") }, http.StatusUnauthorized)
+	do("bearer token", func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") }, http.StatusUnauthorized)
+
+	t.Logf("Scenario: Requests with correct credentials are served")
+	do("correct credentials", func(req *http.Request) { req.SetBasicAuth("admin", "secret") }, http.StatusOK)
+
+	t.Logf("Scenario: Routes that are not protected are served without credentials")
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world", Message: "hello"})
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+}
+
+func TestContentTypes(t *testing.T) {
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: &ListTransport{}, ContentType: &ContentTypes{
+			Allowed: []string{"application/json"},
+			Paths:   []string{APIPath},
+		}}, []Registration{
+			{MessageController{}, "message"},
+		}))
+	defer server.Close()
+
+	tests := []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"application/json", `{"from":"kkrs","to":"world"}`, http.StatusCreated},
+		{"application/json; charset=utf-8", `{"from":"kkrs","to":"world"}`, http.StatusCreated},
+		{"", `{"from":"kkrs","to":"world"}`, http.StatusCreated},
+		{"application/x-www-form-urlencoded", `from=kkrs&to=world`, http.StatusUnsupportedMediaType},
+		{"application/json; charset", `{"from":"kkrs","to":"world"}`, http.StatusUnsupportedMediaType},
+	}
+	t.Logf("Scenario: Writes are served only if their media type is allowed")
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", server.URL+APIPath, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("got error '%s'", err)
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		verify(t, fmt.Sprintf("POST with Content-Type '%s'", test.contentType), resp, err, test.status, nil)
+	}
+
+	t.Logf("Scenario: Reads are not restricted")
+	req, desc := listRequest(server.URL)
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusOK, nil)
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := NewConcurrencyLimiter(1, 2*time.Second)
+	slow := &slowTransport{release: make(chan struct{})}
+	server := httptest.NewServer(Setup(
+		AppFactory{
+			Env: "int", ListTr: &ListTransport{}, Tenants: map[string]Transport{"slow": slow},
+			Concurrency: limiter,
+		},
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer server.Close()
+	send := func() (*http.Response, string, error) {
+		req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+		req.Header.Set(TenantHeader, "slow")
+		resp, err := http.DefaultClient.Do(req)
+		return resp, desc, err
+	}
+
+	t.Logf("Scenario: Requests beyond the limit are rejected while it is saturated")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, desc, err := send()
+		verify(t, desc, resp, err, http.StatusCreated, nil)
+	}()
+	for i := 0; limiter.InFlight() == 0; i++ {
+		if i == 100 {
+			t.Fatalf("got no request in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, desc, err := send()
+	verify(t, desc, resp, err, http.StatusServiceUnavailable, map[string]string{
+		"error": "too many requests in flight",
+	})
+	if ra := resp.Header.Get("Retry-After"); ra != "2" {
+		t.Fatalf("got Retry-After '%s'", ra)
+	}
+
+	t.Logf("Scenario: The slot is released once the request is served")
+	slow.release <- struct{}{}
+	<-done
+	if n := limiter.InFlight(); n != 0 {
+		t.Fatalf("got %d requests in flight", n)
+	}
+
+	t.Logf("Scenario: The slot of a request whose handler panics is released")
+	mux := router.New()
+	dispatcher := di.New("test", mux, factoryFunc(func(string) di.Controller { return panicController{} }))
+	dispatcher.Use(limiter.Middleware())
+	if err := dispatcher.Register(panicController{}, "panic"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	func() {
+		defer func() { recover() }()
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	}()
+	if n := limiter.InFlight(); n != 0 {
+		t.Fatalf("got %d requests in flight", n)
+	}
+
+	t.Logf("Scenario: A ConcurrencyLimiter that would never serve a request cannot be constructed")
+	for _, max := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("got a ConcurrencyLimiter of %d requests", max)
+				}
+			}()
+			NewConcurrencyLimiter(max, time.Second)
+		}()
+	}
+}
+
+func TestImport(t *testing.T) {
+	list := &ListTransport{}
+	server := httptest.NewServer(Setup(
+		AppFactory{Env: "int", ListTr: list, Auth: di.BearerTokens{"s3cret": {Name: "admin"}}},
+		[]Registration{{MessageController{}, "message"}},
+	))
+	defer server.Close()
+	sent := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	stored := Message{From: "kkrs", To: "a", Message: "hello", Sent: sent}
+	id, _ := list.Send(stored)
+
+	importRequest := func(onConflict string, msgs []Message, token string) (*http.Response, string, error) {
+		body, _ := json.Marshal(msgs)
+		urlStr := server.URL + APIPath + "/import"
+		if onConflict != "" {
+			urlStr += "?onConflict=" + onConflict
+		}
+		req, _ := http.NewRequest("POST", urlStr, bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		return resp, fmt.Sprintf("Request POST, %s/import?onConflict=%s with %d messages", APIPath, onConflict, len(msgs)), err
+	}
+	fresh := Message{From: "alice", To: "b", Message: "say \"hi\"", Sent: sent.Add(time.Hour)}
+
+	t.Logf("Scenario: Importing requires authentication when an Authenticator is configured")
+	resp, desc, err := importRequest("", []Message{fresh}, "")
+	verify(t, desc, resp, err, http.StatusUnauthorized, nil)
+
+	t.Logf("Scenario: Invalid messages fail the import")
+	resp, desc, err = importRequest("", []Message{fresh, {From: "alice"}}, "s3cret")
+	verify(t, desc, resp, err, http.StatusBadRequest, map[string]string{
+		"error": "error validating message 1: invalid: message has no To",
+	})
+
+	t.Logf("Scenario: Messages longer than MaxItemSize fail the import")
+	size := MaxItemSize
+	MaxItemSize = 64
+	long := Message{From: "alice", To: "b", Message: strings.Repeat("x", 64)}
+	resp, desc, err = importRequest("", []Message{long}, "s3cret")
+	MaxItemSize = size
+	verify(t, desc, resp, err, http.StatusRequestEntityTooLarge, nil)
+
+	t.Logf("Scenario: Messages already stored fail the import by default")
+	resp, desc, err = importRequest("", []Message{fresh, stored}, "s3cret")
+	verify(t, desc, resp, err, http.StatusConflict, map[string]string{
+		"error": "message 1 is already stored",
+	})
+	if msgs, _ := list.List(MessageFilter{}); len(msgs) != 1 {
+		t.Fatalf("got %d messages stored", len(msgs))
+	}
+
+	t.Logf("Scenario: Conflicts by content or ID are skipped with onConflict=skip")
+	byID := Message{ID: id, From: "kkrs", To: "a", Message: "edited", Sent: sent}
+	resp, desc, err = importRequest("skip", []Message{fresh, stored, byID, fresh}, "s3cret")
+	verify(t, desc, resp, err, http.StatusOK, ImportSummary{Imported: 1, Skipped: 3})
+
+	t.Logf("\tand imported messages keep their From and Sent")
+	msgs, _ := list.List(MessageFilter{From: "alice"})
+	if len(msgs) != 1 || !msgs[0].Sent.Equal(fresh.Sent) || msgs[0].Message != fresh.Message {
+		t.Fatalf("got %+v", msgs)
+	}
+
+	t.Logf("Scenario: An import longer than MaxBodySize has the messages before the limit imported")
+	body, _ := json.Marshal([]Message{{From: "bob", To: "c"}, {From: "bob", To: "d"}, {From: "bob", To: "e"}})
+	bodySize := MaxBodySize
+	MaxBodySize = int64(len(body) - 10)
+	req, _ := http.NewRequest("POST", server.URL+APIPath+"/import", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	MaxBodySize = bodySize
+	verify(t, "Request POST, "+APIPath+"/import with 3 messages", resp, err, http.StatusRequestEntityTooLarge, ImportSummary{Imported: 2})
+	if got := resp.Header.Get(ProcessedHeader); got != "2" {
+		t.Fatalf("got %s '%s'", ProcessedHeader, got)
+	}
+	if msgs, _ = list.List(MessageFilter{From: "bob"}); len(msgs) != 2 {
+		t.Fatalf("got %+v", msgs)
+	}
+
+	t.Logf("Scenario: Unknown conflict policies are rejected")
+	resp, desc, err = importRequest("overwrite", []Message{fresh}, "s3cret")
+	verify(t, desc, resp, err, http.StatusBadRequest, nil)
+}
+
+func TestTransportFromContext(t *testing.T) {
+	stored := &ListTransport{}
+	var built int
+	mux := router.New()
+	dispatcher := di.New("test", mux, AppFactory{Env: "int", ListTr: &ListTransport{}})
+	dispatcher.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			built++
+			next.ServeHTTP(rw, req.WithContext(WithTransport(req.Context(), stored)))
+		})
+	})
+	if err := dispatcher.Register(MessageController{}, "message"); err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	t.Logf("Scenario: Controllers use the Transport Middleware stored in the context")
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world"})
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+	if msgs, _ := stored.List(MessageFilter{}); len(msgs) != 1 || built != 1 {
+		t.Fatalf("got %d messages stored and %d Transports built", len(msgs), built)
+	}
+
+	t.Logf("Scenario: Requests without one get none")
+	if _, ok := TransportFromContext(context.Background()); ok {
+		t.Fatalf("got a Transport")
+	}
+}
+
+func TestDSTransportCanceled(t *testing.T) {
+	// The context is not that of App Engine, so any datastore call would fail
+	// with an error other than that of the context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tr := DSTransport{Ctx: ctx}
+
+	t.Logf("Scenario: Operations with a cancelled context fail without calling datastore")
+	if _, err := tr.Send(Message{From: "kkrs", To: "world"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Send: got error '%v'", err)
+	}
+	if _, err := tr.List(MessageFilter{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("List: got error '%v'", err)
+	}
+	if err := tr.Ping(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Ping: got error '%v'", err)
+	}
+
+	t.Logf("Scenario: Controllers respond 499 to requests whose client went away")
+	rec := httptest.NewRecorder()
+	ctrl := MessageController{Transport: DSTransport{Ctx: ctx}}
+	ctrl.Send(rec, httptest.NewRequest("POST", APIPath, strings.NewReader(`{"from":"kkrs","to":"world"}`)))
+	if rec.Code != StatusClientClosedRequest {
+		t.Fatalf("got status %d", rec.Code)
+	}
+
+	t.Logf("Scenario: Controllers respond 503 to requests out of time")
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	rec = httptest.NewRecorder()
+	ctrl = MessageController{Transport: DSTransport{Ctx: ctx}}
+	ctrl.List(rec, httptest.NewRequest("GET", SpyPath, nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d", rec.Code)
+	}
+}
+
+// fakeDatastore answers the datastore API calls made with its context, with
+// keys of id 1 for Puts and result for queries, recording them as text.
+type fakeDatastore struct {
+	result string // the entities found by queries, as text
+	calls  []string
+}
+
+func (ds *fakeDatastore) context(t *testing.T) context.Context {
+	// so that the app ID of keys is not fetched from the metadata server
+	t.Setenv("GAE_LONG_APP_ID", "test")
+	t.Setenv("GAE_PARTITION", "dev")
+	return appengine.WithAPICallFunc(context.Background(), func(ctx context.Context, service, method string, in, out proto.Message) error {
+		ds.calls = append(ds.calls, method+" "+proto.CompactTextString(in))
+		switch method {
+		case "Put":
+			var keys []string
+			for _, kind := range regexp.MustCompile(`Element\{type:"(\w+)" \} > > entity_group`).FindAllStringSubmatch(proto.CompactTextString(in), -1) {
+				keys = append(keys, fmt.Sprintf(`key < app: "dev~test" path < Element { type: "%s" id: 1 } > >`, kind[1]))
+			}
+			return proto.UnmarshalText(strings.Join(keys, " "), out)
+		case "RunQuery":
+			return proto.UnmarshalText(ds.result+" more_results: false", out)
+		}
+		return fmt.Errorf("unexpected call %s.%s", service, method)
+	})
+}
+
+func TestDSTransportNoAncestor(t *testing.T) {
+	ds := &fakeDatastore{}
+	ctx := ds.context(t)
+	rooted, unrooted := DSTransport{Ctx: ctx}, DSTransport{Ctx: ctx, Kind: "note", Ancestor: NoAncestor}
+	filter := MessageFilter{From: "kkrs", To: "world"}
+	contains := func(desc, call string, want ...string) {
+		for _, w := range want {
+			if !strings.Contains(call, w) {
+				t.Fatalf("got %s '%s' without '%s'", desc, call, w)
+			}
+		}
+	}
+
+	t.Logf("Scenario: By default messages are stored and listed under the root ancestor")
+	ds.calls = nil
+	rooted.Send(Message{From: "kkrs", To: "world"})
+	rooted.List(filter)
+	if len(ds.calls) != 2 {
+		t.Fatalf("got calls %q", ds.calls)
+	}
+	root := `Element{type:"root" name:"root" }`
+	contains("Put", ds.calls[0], `path:<`+root+` Element{type:"message" } >`, `entity_group:<`+root+` >`)
+	contains("RunQuery", ds.calls[1], `kind:"message"`, `ancestor:<app:"dev~test" path:<`+root+` > >`)
+
+	t.Logf("Scenario: With NoAncestor messages are root entities of Kind, in entity groups of their own")
+	ds.calls = nil
+	id, err := unrooted.Send(Message{From: "kkrs", To: "world"})
+	if err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	ids, err := unrooted.SendBatch([]Message{{From: "kkrs", To: "a"}, {From: "kkrs", To: "b"}})
+	if err != nil || len(ids) != 2 || ids[0] != id {
+		t.Fatalf("got IDs %q and error '%v'", ids, err)
+	}
+	for _, call := range ds.calls {
+		contains("Put", call, `path:<Element{type:"note" } >`, `entity_group:<>`)
+		if strings.Contains(call, "root") {
+			t.Fatalf("got Put '%s'", call)
+		}
+	}
+
+	t.Logf("Scenario: With NoAncestor messages are listed by queries without an ancestor")
+	ds.calls = nil
+	ds.result = `result < key < app: "dev~test" path < Element { type: "note" id: 1 } > > entity_group < >
+		property < name: "From" value < stringValue: "kkrs" > multiple: false >
+		property < name: "To" value < stringValue: "world" > multiple: false > >`
+	msgs, err := unrooted.List(filter)
+	if err != nil || len(msgs) != 1 || msgs[0].ID != id || msgs[0].To != "world" {
+		t.Fatalf("got %+v and error '%v'", msgs, err)
+	}
+	var streamed []Message
+	err = unrooted.ListStream(MessageFilter{From: "kkrs", Since: time.Date(2016, 2, 10, 12, 0, 0, 0, time.UTC)}, func(msg Message) error {
+		streamed = append(streamed, msg)
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(streamed, msgs) {
+		t.Fatalf("got %+v and error '%v'", streamed, err)
+	}
+	if len(ds.calls) != 2 {
+		t.Fatalf("got calls %q", ds.calls)
+	}
+	contains("RunQuery", ds.calls[0], `kind:"note"`, `name:"From"`, `name:"To"`, `Order{property:"Sent" direction:DESCENDING }`)
+	contains("RunQuery", ds.calls[1], `kind:"note"`, `name:"From"`, `op:GREATER_THAN property:<meaning:GD_WHEN name:"Sent"`)
+	for _, call := range ds.calls {
+		if strings.Contains(call, "ancestor") {
+			t.Fatalf("got RunQuery '%s'", call)
+		}
+	}
+
+	t.Logf("Scenario: IDs of messages of another Kind are not found")
+	if _, err := rooted.Get(id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got error '%v'", err)
+	}
+}
+
+// segmentRouter routes by path alone, like the routers of other packages, with
+// segments written {name} matching any segment.
+type segmentRouter struct {
+	patterns []string
+	handlers map[string]http.Handler
+}
+
+type segmentVarsKey struct{}
+
+func (sr *segmentRouter) Handle(pattern string, h http.Handler) {
+	if sr.handlers == nil {
+		sr.handlers = make(map[string]http.Handler)
+	}
+	sr.patterns = append(sr.patterns, pattern)
+	sr.handlers[pattern] = h
+}
+
+func (sr *segmentRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	segments := strings.Split(req.URL.Path, "/")
+	for _, pattern := range sr.patterns {
+		want := strings.Split(pattern, "/")
+		if len(want) != len(segments) {
+			continue
+		}
+		vars := make(map[string]string)
+		for i, w := range want {
+			if strings.HasPrefix(w, "{") && strings.HasSuffix(w, "}") {
+				vars[w[1:len(w)-1]] = segments[i]
+			} else if w != segments[i] {
+				vars = nil
+				break
+			}
+		}
+		if vars != nil {
+			sr.handlers[pattern].ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), segmentVarsKey{}, vars)))
+			return
+		}
+	}
+	http.NotFound(rw, req)
+}
+
+func segmentVars(req *http.Request) map[string]string {
+	vars, _ := req.Context().Value(segmentVarsKey{}).(map[string]string)
+	return vars
+}
+
+func TestSetupRouter(t *testing.T) {
+	tr := &ListTransport{}
+	sr := &segmentRouter{}
+	server := httptest.NewServer(SetupRouter(router.Adapt(sr, sr.Handle, segmentVars),
+		AppFactory{Env: "int", ListTr: tr}, []Registration{
+			{MessageController{}, "message"},
+		}))
+	defer server.Close()
+
+	t.Logf("Scenario: Controllers are served by a Router of another package through Adapter")
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world", Message: "hello"})
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+
+	t.Logf("Scenario: Variables the Router matched reach the Controllers")
+	msgs, _ := tr.List(MessageFilter{})
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages", len(msgs))
+	}
+	resp, err = http.Get(server.URL + APIPath + "/" + msgs[0].ID)
+	verify(t, "GET of the message sent", resp, err, http.StatusOK, nil)
+	var got Message
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || got.ID != msgs[0].ID {
+		t.Fatalf("got message %+v and error '%v'", got, err)
+	}
+
+	t.Logf("Scenario: Verbs not bound to a pattern get 405")
+	req, _ = http.NewRequest("DELETE", server.URL+APIPath+"/"+msgs[0].ID, nil)
+	resp, err = http.DefaultClient.Do(req)
+	verify(t, "DELETE of the message sent", resp, err, http.StatusMethodNotAllowed, nil)
+	if allow := resp.Header.Get("Allow"); allow != "GET, PUT" {
+		t.Fatalf("got Allow '%s'", allow)
+	}
+
+	t.Logf("Scenario: Paths bound to nothing are left to the Router")
+	resp, err = http.Get(server.URL + "/nowhere")
+	verify(t, "GET /nowhere", resp, err, http.StatusNotFound, nil)
+}
+
+func TestSetupE(t *testing.T) {
+	af := AppFactory{Env: "int", ListTr: &ListTransport{}}
+
+	t.Logf("Scenario: Registering a Controller with an invalid Binding is an error")
+	r, err := SetupE(af, []Registration{
+		{MessageController{}, "message"},
+		{pathController{"/spy messages"}, "invalid"},
+	})
+	if err == nil || r != nil {
+		t.Fatalf("got router %v and error '%v'", r, err)
+	}
+
+	t.Logf("Scenario: Registering a Controller with a malformed variable is an error, not a panic")
+	r, err = SetupE(af, []Registration{
+		{MessageController{}, "message"},
+		{pathController{APIPath + "/{id"}, "invalid"},
+	})
+	if err == nil || r != nil || !strings.Contains(err.Error(), "unterminated variable") {
+		t.Fatalf("got router %v and error '%v'", r, err)
+	}
+
+	t.Logf("Scenario: Valid Registrations are set up")
+	r, err = SetupE(af, []Registration{{MessageController{}, "message"}})
+	if err != nil {
+		t.Fatalf("got error '%s'", err)
+	}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	req, desc := sendRequest(server.URL, Message{From: "kkrs", To: "world", Message: "hello"})
+	resp, err := http.DefaultClient.Do(req)
+	verify(t, desc, resp, err, http.StatusCreated, nil)
+}
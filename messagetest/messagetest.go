@@ -0,0 +1,21 @@
+// Package messagetest provides utilities for testing Controllers served with
+// package message. It is meant to be imported by tests only.
+package messagetest
+
+import (
+	"net/http/httptest"
+
+	"github.com/kkrs/godi-code"
+)
+
+// NewServer starts a server for the Controllers in regs, set up with the
+// Transport of env "int", and returns it with the ListTransport storing the
+// messages sent so that tests can inspect them. MessageController is
+// registered when regs is empty. The caller should Close the server.
+func NewServer(regs ...message.Registration) (*httptest.Server, *message.ListTransport) {
+	list := &message.ListTransport{}
+	if len(regs) == 0 {
+		regs = []message.Registration{{Ctrl: message.MessageController{}, Label: "message"}}
+	}
+	return httptest.NewServer(message.Setup(message.AppFactory{Env: "int", ListTr: list}, regs)), list
+}
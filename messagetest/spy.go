@@ -0,0 +1,93 @@
+package messagetest
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/kkrs/godi-code"
+)
+
+// SpyTransport is a message.Transport for tests that records the calls made
+// to it. Messages sent are kept, with IDs "1", "2" and so on, and listed
+// newest first, unless an error set with Fail is returned instead. It is safe
+// for concurrent use; the zero value is ready to use.
+//
+// In a controller test, inject it and assert on what the controller did:
+//
+//	spy := &messagetest.SpyTransport{}
+//	ctrl := message.MessageController{Transport: spy}
+//	rec := httptest.NewRecorder()
+//	ctrl.Send(rec, httptest.NewRequest("POST", message.APIPath, strings.NewReader("{")))
+//	if calls := spy.Calls(); len(calls) != 0 {
+//		t.Fatalf("malformed request reached the transport: %v", calls)
+//	}
+type SpyTransport struct {
+	mu    sync.Mutex
+	sent  []message.Message
+	calls []string
+	errs  map[string][]error
+}
+
+// Fail makes the next calls of method, "Send" or "List", return errs in turn,
+// one per call; a nil error lets its call proceed. Calls after errs are used
+// up proceed too.
+func (spy *SpyTransport) Fail(method string, errs ...error) {
+	spy.mu.Lock()
+	defer spy.mu.Unlock()
+	if spy.errs == nil {
+		spy.errs = make(map[string][]error)
+	}
+	spy.errs[method] = append(spy.errs[method], errs...)
+}
+
+// Calls returns the names of the methods called, in the order they were.
+func (spy *SpyTransport) Calls() []string {
+	spy.mu.Lock()
+	defer spy.mu.Unlock()
+	return append([]string(nil), spy.calls...)
+}
+
+// Sent returns the messages sent, oldest first.
+func (spy *SpyTransport) Sent() []message.Message {
+	spy.mu.Lock()
+	defer spy.mu.Unlock()
+	return append([]message.Message(nil), spy.sent...)
+}
+
+// call records a call of method and returns the error it should fail with.
+// spy.mu must be held.
+func (spy *SpyTransport) call(method string) error {
+	spy.calls = append(spy.calls, method)
+	errs := spy.errs[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	spy.errs[method] = errs[1:]
+	return errs[0]
+}
+
+func (spy *SpyTransport) Send(msg message.Message) (string, error) {
+	spy.mu.Lock()
+	defer spy.mu.Unlock()
+	if err := spy.call("Send"); err != nil {
+		return "", err
+	}
+	msg.ID = strconv.Itoa(len(spy.sent) + 1)
+	spy.sent = append(spy.sent, msg)
+	return msg.ID, nil
+}
+
+func (spy *SpyTransport) List(filter message.MessageFilter) ([]message.Message, error) {
+	spy.mu.Lock()
+	defer spy.mu.Unlock()
+	if err := spy.call("List"); err != nil {
+		return nil, err
+	}
+	msgs := []message.Message{}
+	for i := len(spy.sent) - 1; i >= 0; i-- {
+		if filter.Match(spy.sent[i]) {
+			msgs = append(msgs, spy.sent[i])
+		}
+	}
+	return msgs, nil
+}
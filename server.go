@@ -0,0 +1,69 @@
+// +build !appengine
+
+package message
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultShutdownTimeout is how long Server waits for in-flight requests when
+// ShutdownTimeout is zero.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Server serves Handler, usually the router returned by Setup, outside of App
+// Engine and shuts down gracefully on SIGINT or SIGTERM. It is optional: the
+// router can be served by any http.Server.
+type Server struct {
+	Addr            string
+	Handler         http.Handler
+	ShutdownTimeout time.Duration // how long to wait for in-flight requests
+}
+
+// ListenAndServe listens on Addr and calls Serve.
+func (s Server) ListenAndServe(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve serves requests from l until ctx is done or the process receives
+// SIGINT or SIGTERM. It then stops accepting requests and waits up to
+// ShutdownTimeout for those in flight to complete, failing with an error that
+// wraps context.DeadlineExceeded if they do not.
+func (s Server) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{Handler: s.Handler}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	select {
+	case err := <-served:
+		return err
+	case <-sigs:
+	case <-ctx.Done():
+	}
+
+	timeout := s.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdown); err != nil {
+		return fmt.Errorf("error shutting down: %w", err)
+	}
+	<-served // http.ErrServerClosed once Shutdown is called
+	return nil
+}